@@ -15,6 +15,44 @@
 //	"seg-dict" {
 //		"dict-file": "/path/to/dict-file",
 //		"stop-file": "/path/to/stopword-file"
+//	},
+//	"callback": {
+//		"secret": "hmac-secret",
+//		"max-retries": 3,
+//		"backoff-ms": 1000,
+//		"max-errors": 100
+//	},
+//	"import": {
+//		"max-errors": 100
+//	},
+//	"jobs": {
+//		"max-age-hours": 168,
+//		"max-finished": 1000
+//	},
+//	"inbox": {
+//		"poll-seconds": 5,
+//		"disabled": false
+//	},
+//	"wal": {
+//		"mode": "off",
+//		"sync-ms": 1000
+//	},
+//	"queue": {
+//		"capacity": 1000,
+//		"retry-after": 1
+//	},
+//	"ttl": {
+//		"sweep-seconds": 60
+//	},
+//	"snapshot": {
+//		"repo-dir": "/path/to/snapshots"
+//	},
+//	"changes": {
+//		"retention": 10000,
+//		"disabled": false
+//	},
+//	"query": {
+//		"max-expansions": 1024
 //	}
 // }
 //
@@ -41,6 +79,44 @@ var (
 			DictFile   string `json:"dict-file"`
 			StopFile   string `json:"stop-file"`
 		} `json:"seg-dict"`
+		Callback struct {
+			Secret     string `json:"secret"`      // 回调签名的缺省密钥，可以被schema中的callback-secret覆盖
+			MaxRetries int    `json:"max-retries"` // 回调失败后的最大重试次数
+			BackoffMs  int    `json:"backoff-ms"`  // 第一次重试前等待的毫秒数，以后每次加倍
+			MaxErrors  int    `json:"max-errors"`  // 回调中最多报告的出错doc数
+		} `json:"callback"`
+		Import struct {
+			MaxErrors int `json:"max-errors"` // 批量导入的结果中最多报告的出错doc数
+		} `json:"import"`
+		Jobs struct {
+			MaxAgeHours int `json:"max-age-hours"` // 已经结束的job记录保留的小时数
+			MaxFinished int `json:"max-finished"`  // 最多保留的已经结束的job记录数
+		} `json:"jobs"`
+		Inbox struct {
+			PollSeconds int  `json:"poll-seconds"` // 检查inbox目录的间隔秒数，新文件在这段时间内没有修改才导入
+			Disabled    bool `json:"disabled"`     // 是否关闭inbox目录的导入
+		} `json:"inbox"`
+		Wal struct {
+			Mode   string `json:"mode"`    // 缺省的WAL模式: WAL_OFF(缺省)、WAL_ASYNC、WAL_SYNC，可以被schema中的wal覆盖
+			SyncMs int    `json:"sync-ms"` // WAL_ASYNC模式下fsync的间隔毫秒数
+		} `json:"wal"`
+		Queue struct {
+			Capacity   int `json:"capacity"`    // 每个索引库更新队列的容量
+			RetryAfter int `json:"retry-after"` // 队列满时返回的Retry-After秒数
+		} `json:"queue"`
+		TTL struct {
+			SweepSeconds int `json:"sweep-seconds"` // 清除过期doc的间隔秒数
+		} `json:"ttl"`
+		Snapshot struct {
+			RepoDir string `json:"repo-dir"` // 保存快照的目录，缺省为"<root-dir>/_snapshots"
+		} `json:"snapshot"`
+		Changes struct {
+			Retention int  `json:"retention"` // 每个索引库在内存中保留的变更数
+			Disabled  bool `json:"disabled"`  // 是否关闭变更记录
+		} `json:"changes"`
+		Query struct {
+			MaxExpansions int `json:"max-expansions"` // 前缀、通配符最多扩展出的词数，超过时查询出错
+		} `json:"query"`
 	}
 
 	// 缺省时区，会被环境变量TZ覆盖
@@ -126,6 +202,64 @@ func checkMust() error {
 		return fmt.Errorf("%s is not a directory", ServiceConf.RootDir)
 	}
 
+	callback := &ServiceConf.Callback
+	if callback.MaxRetries <= 0 {
+		callback.MaxRetries = 3
+	}
+	if callback.BackoffMs <= 0 {
+		callback.BackoffMs = 1000
+	}
+	if callback.MaxErrors <= 0 {
+		callback.MaxErrors = 100
+	}
+
+	if ServiceConf.Import.MaxErrors <= 0 {
+		ServiceConf.Import.MaxErrors = 100
+	}
+
+	jobs := &ServiceConf.Jobs
+	if jobs.MaxAgeHours <= 0 {
+		jobs.MaxAgeHours = 7*24
+	}
+	if jobs.MaxFinished <= 0 {
+		jobs.MaxFinished = 1000
+	}
+
+	if ServiceConf.Inbox.PollSeconds <= 0 {
+		ServiceConf.Inbox.PollSeconds = 5
+	}
+
+	wal := &ServiceConf.Wal
+	if wal.Mode == "" {
+		wal.Mode = WAL_OFF
+	}
+	if err = CheckWalMode(wal.Mode); err != nil {
+		return err
+	}
+	if wal.SyncMs <= 0 {
+		wal.SyncMs = 1000
+	}
+
+	queue := &ServiceConf.Queue
+	if queue.Capacity <= 0 {
+		queue.Capacity = 1000
+	}
+	if queue.RetryAfter <= 0 {
+		queue.RetryAfter = 1
+	}
+
+	if ServiceConf.TTL.SweepSeconds <= 0 {
+		ServiceConf.TTL.SweepSeconds = 60
+	}
+
+	if ServiceConf.Changes.Retention <= 0 {
+		ServiceConf.Changes.Retention = 10000
+	}
+
+	if ServiceConf.Query.MaxExpansions <= 0 {
+		ServiceConf.Query.MaxExpansions = 1024
+	}
+
 	/*
 	segDict := &ServiceConf.SegDict
 	if err := checkDict(segDict.DictFile, "seg-dict/dict-file"); err != nil {
@@ -6,7 +6,7 @@
 //    "fields": [
 //        {
 //            "name": "f1",
-//            "pk": true|false, // 属于PK的字段一定会保存
+//            "pk": true|false, // 属于PK的字段一定会保存；除了PK字段，值可以是数组，表示多值字段
 //            "type": "string"|"i8"|"u8"|...|"float"|"date"|"datetime"|"time"|"timestamp", // timestamp单位秒，是i64的别名
 //            "tokenizer": "zh"|"space"|"none"|null, // 分词器：中文、空白、不需要；只有字符串有效
 //            "time-fmt": "",    // 当type是date,datetime,time时的格式串，缺省分别为"YYYY-MM-DD", "YYYY-MM-DD HH:MM:SS", "HH:MM:SS"，可以精确到毫秒
@@ -16,7 +16,15 @@
 //            "name":"f2",
 //            ....
 //        }
-//     ]
+//     ],
+//    "callback-secret": "", // 异步导入回调签名的密钥，缺省使用全局配置中的密钥
+//    "inbox-dir": "",        // 自动导入文件的目录，相对路径相对于索引库目录，缺省为"<root-dir>/<name>/inbox"
+//    "pipeline": "",         // 批量导入时对doc做预处理的pipeline名称，可以为空
+//    "wal": "",              // WAL模式: "off"|"async"|"sync"，缺省使用全局配置
+//    "queue-weight": 1,      // 更新队列的权重，即与其它索引库轮流时每轮最多处理的更新操作数，缺省为1
+//    "refresh-interval": "", // 后台刷新索引的间隔，如"1s"，缺省每次写操作后刷新
+//    "ttl": "",              // doc缺省的存活时间，如"720h"，从写入时算起，缺省不过期
+//    "expire-field": ""      // 表示doc过期时间的字段，类型必须是date、datetime或timestamp，有值时优先于ttl
 //}
 package conf
 
@@ -72,6 +80,14 @@ type Field struct {
 type SchemaConf struct {
 	Shards  uint16  `json:"shards"`
 	Fields  []Field `json:"fields"`
+	CallbackSecret string `json:"callback-secret,omitempty"`
+	InboxDir       string `json:"inbox-dir,omitempty"`
+	Pipeline       string `json:"pipeline,omitempty"`
+	Wal            string `json:"wal,omitempty"`
+	QueueWeight    int    `json:"queue-weight,omitempty"`
+	RefreshInterval string `json:"refresh-interval,omitempty"`
+	TTL             string `json:"ttl,omitempty"`
+	ExpireField     string `json:"expire-field,omitempty"`
 }
 
 // 缺省排序列表
@@ -138,6 +154,92 @@ func LoadSchema(index string) (*Schema, error) {
 	}, nil
 }
 
+// 列出所有有schema的索引库名
+func ListIndexes() ([]string, error) {
+	fp, err := os.Open(ServiceConf.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	names, err := fp.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	indexes := []string{}
+	for _, name := range names {
+		if _, p := generateSchemaFile(name); isFile(p) {
+			indexes = append(indexes, name)
+		}
+	}
+	return indexes, nil
+}
+
+func isFile(p string) bool {
+	fi, err := os.Stat(p)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// 自动导入文件的目录
+func (schema *Schema) InboxPath() string {
+	if schema.InboxDir == "" {
+		return path.Join(schema.StorePath, "inbox")
+	}
+	if path.IsAbs(schema.InboxDir) {
+		return schema.InboxDir
+	}
+	return path.Join(schema.StorePath, schema.InboxDir)
+}
+
+// WAL模式
+const (
+	WAL_OFF   = "off"   // 不写WAL
+	WAL_ASYNC = "async" // 写入WAL后就返回，定期fsync
+	WAL_SYNC  = "sync"  // WAL fsync后才返回
+)
+
+func CheckWalMode(mode string) error {
+	switch mode {
+	case WAL_OFF, WAL_ASYNC, WAL_SYNC:
+		return nil
+	default:
+		return fmt.Errorf("unknown wal mode %s, off, async or sync expected", mode)
+	}
+}
+
+// 索引库的WAL模式，schema中没有指定时使用全局配置
+func (schema *Schema) WalMode() string {
+	if schema.Wal == "" {
+		return ServiceConf.Wal.Mode
+	}
+	return schema.Wal
+}
+
+// 后台刷新索引的间隔，0表示每次写操作后刷新
+func (schema *Schema) RefreshDuration() time.Duration {
+	d, _ := time.ParseDuration(schema.RefreshInterval)
+	return d
+}
+
+// doc保存过期时间(UnixNano)的隐藏字段，不会输出
+const EXPIRE_AT_FIELD = "_expire_at"
+
+// doc缺省的存活时间，0表示不过期
+func (schema *Schema) TTLDuration() time.Duration {
+	d, _ := time.ParseDuration(schema.TTL)
+	return d
+}
+
+// doc是否会过期
+func (schema *Schema) HasTTL() bool {
+	return schema.TTL != "" || schema.ExpireField != ""
+}
+
+// 保存WAL的目录
+func (schema *Schema) WalPath() string {
+	return path.Join(schema.StorePath, "wal")
+}
+
 // 保存一个索引库的schema
 //   index: 索引库名
 func SaveSchema(index string, in io.Reader) error {
@@ -184,11 +286,18 @@ func RenameSchema(index, newIndex string) error {
 	return os.Rename(d, nd)
 }
 
-// 把日期、时间字段格式化输出
+// 把日期、时间字段格式化输出，多值字段逐个格式化
 func (field *Field) FormatDatetime(v interface{}) interface{} {
 	if v == nil {
 		return nil
 	}
+	if vs, ok := v.([]interface{}); ok {
+		res := make([]interface{}, len(vs))
+		for i, v := range vs {
+			res[i] = field.FormatDatetime(v)
+		}
+		return res
+	}
 	nsec, ok := v.(int64)
 	if !ok {
 		return nil
@@ -203,9 +312,24 @@ func (field *Field) FormatDatetime(v interface{}) interface{} {
 }
 
 // 根据字段类型把给定的字段值转换为相应的类型
-//    value:   需要转换的值
+//    value:   需要转换的值，除了json类型，数组表示多值字段，每个值分别转换
 // 返回的数据中已经是经过转换的数据
 func (field *Field) ToNativeValue(value interface{}) (interface{}, error) {
+	if vs, ok := value.([]interface{}); ok && field.Type != "json" {
+		res := make([]interface{}, len(vs))
+		for i, v := range vs {
+			if _, ok := v.([]interface{}); ok {
+				return nil, fmt.Errorf("nested array not allowed")
+			}
+			nv, err := field.ToNativeValue(v)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = nv
+		}
+		return res, nil
+	}
+
 	switch field.Type {
 	case "str", "string":
 		if value == nil {
@@ -380,6 +504,9 @@ func toDatetime(v interface{}, timeFmt string) (int64, error) {
 	switch v.(type) {
 	case float64:
 		return int64(v.(float64)), nil
+	case int64:
+		// 已经是UnixNano，如reindex时从源索引库读出的值
+		return v.(int64), nil
 	case string:
 		if t, err := time.ParseInLocation(timeFmt, v.(string), Loc); err != nil {
 			return 0, err
@@ -406,7 +533,7 @@ func createDir(d string) error {
 		return os.Mkdir(d, 0755)
 	}
 	if !fi.IsDir() {
-		return fmt.Errorf("%s is not a directory")
+		return fmt.Errorf("%s is not a directory", d)
 	}
 	return nil
 }
@@ -477,12 +604,44 @@ func checkSchemaConf(name string, schemaConf *SchemaConf) (map[string]int, []int
 		default:
 		}
 
+		if field.Name == EXPIRE_AT_FIELD {
+			return nil, nil, nil, nil, false, fmt.Errorf("field name %s is reserved", field.Name)
+		}
 		fm[field.Name] = i
 	}
 
 	if len(pi) == 0 {
 		return nil, nil, nil, nil, false, fmt.Errorf("no PK field(s) specified")
 	}
+	if schemaConf.RefreshInterval != "" {
+		if d, err := time.ParseDuration(schemaConf.RefreshInterval); err != nil || d < 0 {
+			return nil, nil, nil, nil, false, fmt.Errorf("bad refresh-interval %s", schemaConf.RefreshInterval)
+		}
+	}
+	if schemaConf.TTL != "" {
+		if d, err := time.ParseDuration(schemaConf.TTL); err != nil || d <= 0 {
+			return nil, nil, nil, nil, false, fmt.Errorf("bad ttl %s", schemaConf.TTL)
+		}
+	}
+	if schemaConf.ExpireField != "" {
+		fIdx, ok := fm[schemaConf.ExpireField]
+		if !ok {
+			return nil, nil, nil, nil, false, fmt.Errorf("expire-field %s not found", schemaConf.ExpireField)
+		}
+		switch schemaConf.Fields[fIdx].Type {
+		case "date", "datetime", "timestamp":
+		default:
+			return nil, nil, nil, nil, false, fmt.Errorf("expire-field %s must be date, datetime or timestamp", schemaConf.ExpireField)
+		}
+	}
+	if schemaConf.QueueWeight < 0 {
+		return nil, nil, nil, nil, false, fmt.Errorf("queue-weight must not be negative")
+	}
+	if schemaConf.Wal != "" {
+		if err := CheckWalMode(schemaConf.Wal); err != nil {
+			return nil, nil, nil, nil, false, err
+		}
+	}
 
 	if schemaConf.Shards == 0 {
 		schemaConf.Shards = 8
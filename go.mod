@@ -1,11 +1,42 @@
 module go-search
 
-go 1.12
+go 1.19
 
 require (
-	github.com/go-ego/gse v0.0.0-20190923185659-b86c09691506 // indirect
 	github.com/go-ego/riot v0.0.0-20190802171934-6ed3775d67b6
 	github.com/hashicorp/golang-lru v0.5.3
-	github.com/rosbit/gnet v0.0.4 // indirect
-	github.com/rosbit/mgin v0.0.1 // indirect
+	github.com/klauspost/compress v1.11.13
+	github.com/rosbit/gnet v0.0.4
+	github.com/rosbit/mgin v0.0.1
+	golang.org/x/text v0.3.2
+)
+
+require (
+	github.com/AndreasBriese/bbloom v0.0.0-20190306092124-e2d15f34fcf9 // indirect
+	github.com/dgraph-io/badger v1.6.0 // indirect
+	github.com/dgryski/go-farm v0.0.0-20190423205320-6a90982ecee2 // indirect
+	github.com/dustin/go-humanize v1.0.0 // indirect
+	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/go-ego/cedar v0.0.0-20190908155901-c3ab6f474b14 // indirect
+	github.com/go-ego/gpy v0.0.0-20181128170341-b6d42325845c // indirect
+	github.com/go-ego/gse v0.0.0-20190923185659-b86c09691506 // indirect
+	github.com/go-ego/murmur v0.0.0-20181129155752-fac557227e04 // indirect
+	github.com/go-playground/locales v0.13.0 // indirect
+	github.com/go-playground/universal-translator v0.17.0 // indirect
+	github.com/go-playground/validator/v10 v10.5.0 // indirect
+	github.com/go-vgo/gt v0.0.0-20181207163017-e40d098f9006 // indirect
+	github.com/go-zoo/bone v1.3.0 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db // indirect
+	github.com/leodido/go-urn v1.2.0 // indirect
+	github.com/mroth/weightedrand v0.4.1 // indirect
+	github.com/pelletier/go-toml v1.4.0 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/shirou/gopsutil v2.18.11+incompatible // indirect
+	github.com/syndtr/goleveldb v0.0.0-20181128100959-b001fa50d6b2 // indirect
+	github.com/urfave/negroni v1.0.0 // indirect
+	go.etcd.io/bbolt v1.3.3 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
+	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80 // indirect
+	golang.org/x/sys v0.0.0-20190726091711-fc99dfbffb4e // indirect
 )
@@ -0,0 +1,73 @@
+package indexer
+
+import (
+	"github.com/rosbit/gnet"
+	"go-search/conf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+	"fmt"
+	"log"
+)
+
+const (
+	HEADER_SIGNATURE       = "X-Signature"       // 回调内容的签名: sha256=hex(hmac-sha256(secret, body))
+	HEADER_IDEMPOTENCY_KEY = "X-Idempotency-Key" // 同一个job的回调(包括重试)使用相同的key
+	maxCallbackBackoff     = time.Minute
+)
+
+// 异步导入结束后通知回调url，失败后按指数退避重试
+func (idx *indexer) sendCallback(cb string, j *job, params map[string]interface{}) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		log.Printf("[error] failed to encode callback params: %v\n", err)
+		return
+	}
+
+	headers := map[string]string{
+		HEADER_IDEMPOTENCY_KEY: j.status.Id,
+	}
+	if secret := idx.callbackSecret(); secret != "" {
+		headers[HEADER_SIGNATURE] = signCallback(secret, body)
+	}
+
+	callbackConf := &conf.ServiceConf.Callback
+	backoff := time.Duration(callbackConf.BackoffMs) * time.Millisecond
+	for i:=0; ; i++ {
+		status, content, _, err := gnet.JSON(cb, gnet.Params(body), gnet.Headers(headers))
+		if err == nil && status >= http.StatusOK && status < http.StatusMultipleChoices {
+			log.Printf("send to callback to %s OK: %s\n", cb, string(content))
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("status %d", status)
+		}
+		if i >= callbackConf.MaxRetries {
+			log.Printf("[error] failed to send callback to %s after %d retries: %v\n", cb, i, err)
+			return
+		}
+
+		log.Printf("failed to send callback to %s: %v, retry in %v\n", cb, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxCallbackBackoff {
+			backoff = maxCallbackBackoff
+		}
+	}
+}
+
+// 索引库的回调签名密钥，schema中没有配置时使用全局配置
+func (idx *indexer) callbackSecret() string {
+	if idx.schema.CallbackSecret != "" {
+		return idx.schema.CallbackSecret
+	}
+	return conf.ServiceConf.Callback.Secret
+}
+
+func signCallback(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
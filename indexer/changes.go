@@ -0,0 +1,240 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"sync"
+	"time"
+	"fmt"
+)
+
+// 索引库的变更记录: 写操作放入更新队列并提交(WAL_SYNC模式下fsync)成功后记录变更，
+// 每个索引库在内存中保留最近的变更，客户端可以从某个序号之后继续读取。
+//   - 序号从创建变更记录时的微秒数开始递增，服务重启后新的序号仍然比原来的大
+//   - 提交失败时客户端收到错误，变更不记录
+//   - 变更在提交后记录，这时文档可能还不能被搜到
+const (
+	CHANGE_INDEX  = "index"
+	CHANGE_UPDATE = "update"
+	CHANGE_DELETE = "delete"
+)
+
+// 一个变更
+type Change struct {
+	Seq  uint64    `json:"seq"`
+	Op   string    `json:"op"`
+	Id   string    `json:"id"`
+	Doc  StoredDoc `json:"doc,omitempty"` // 删除时为nil
+	Time time.Time `json:"time"`
+}
+
+// 需要的变更已经不在保留的变更中
+type ChangesGoneError struct {
+	Index  string
+	Since  uint64
+	Oldest uint64
+}
+
+func (e *ChangesGoneError) Error() string {
+	return fmt.Sprintf("changes of %s after %d are no longer retained, the oldest is %d", e.Index, e.Since, e.Oldest)
+}
+
+type changeLog struct {
+	lock    sync.Mutex
+	changes []*Change
+	nextSeq uint64
+	notify  chan struct{} // 有新变更时关闭
+}
+
+var (
+	changeLogs     = map[string]*changeLog{} // 索引库卸载后保留
+	changeLogsLock = &sync.Mutex{}
+)
+
+func changeRetention() int {
+	if r := conf.ServiceConf.Changes.Retention; r > 0 {
+		return r
+	}
+	return 10000
+}
+
+func getChangeLog(index string) *changeLog {
+	changeLogsLock.Lock()
+	defer changeLogsLock.Unlock()
+
+	l, ok := changeLogs[index]
+	if !ok {
+		l = &changeLog{
+			nextSeq: uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+			notify: make(chan struct{}),
+		}
+		changeLogs[index] = l
+	}
+	return l
+}
+
+// 已经放入更新队列、还没有提交的变更
+type pendingChanges struct {
+	changes []*Change
+}
+
+func (p *pendingChanges) add(op, docId string, doc StoredDoc) {
+	if conf.ServiceConf.Changes.Disabled {
+		return
+	}
+	p.changes = append(p.changes, &Change{Op: op, Id: docId, Doc: doc, Time: time.Now()})
+}
+
+// 提交之前放入队列的更新，成功后记录变更，失败时丢弃变更
+func (idx *indexer) commitChanges(p *pendingChanges) error {
+	changes := p.changes
+	p.changes = nil
+	if err := idx.commit(); err != nil {
+		return err
+	}
+	idx.recordChanges(changes)
+	return nil
+}
+
+// 记录一个变更
+func (idx *indexer) recordChange(op, docId string, doc StoredDoc) {
+	idx.recordChanges([]*Change{&Change{Op: op, Id: docId, Doc: doc, Time: time.Now()}})
+}
+
+// 按顺序记录变更，分配序号
+func (idx *indexer) recordChanges(changes []*Change) {
+	if conf.ServiceConf.Changes.Disabled || len(changes) == 0 {
+		return
+	}
+	l := getChangeLog(idx.schema.Name)
+	retention := changeRetention()
+
+	l.lock.Lock()
+	for _, c := range changes {
+		c.Seq = l.nextSeq
+		l.changes = append(l.changes, c)
+		l.nextSeq += 1
+	}
+	if n := len(l.changes); n >= 2*retention {
+		// 只保留最近的retention个变更
+		changes := make([]*Change, retention, 2*retention)
+		copy(changes, l.changes[n-retention:])
+		l.changes = changes
+	}
+	notify := l.notify
+	l.notify = make(chan struct{})
+	l.lock.Unlock()
+
+	close(notify)
+}
+
+// 最早保留的变更的序号，没有变更时为下一个序号
+func (l *changeLog) oldest() uint64 {
+	if n := len(l.changes) - changeRetention(); n > 0 {
+		return l.changes[n].Seq
+	}
+	if len(l.changes) > 0 {
+		return l.changes[0].Seq
+	}
+	return l.nextSeq
+}
+
+// 读取变更的游标
+type ChangeFeed struct {
+	index string
+	idx   *indexer
+	log   *changeLog
+	next  uint64 // 下一个需要读取的序号
+}
+
+// 打开索引库的变更
+//   since: 读取该序号之后的变更，0表示从最早保留的变更开始，<0表示只读取以后的变更
+// 需要的变更已经不再保留时返回*ChangesGoneError
+func OpenChanges(index string, since int64) (*ChangeFeed, error) {
+	if !running {
+		return nil, fmt.Errorf("the service is stopped")
+	}
+	if conf.ServiceConf.Changes.Disabled {
+		return nil, fmt.Errorf("changes are disabled")
+	}
+	idx, err := initIndexer(index)
+	if err != nil {
+		return nil, err
+	}
+	return idx.openChanges(since)
+}
+
+func (idx *indexer) openChanges(since int64) (*ChangeFeed, error) {
+	index := idx.schema.Name
+	l := getChangeLog(index)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	feed := &ChangeFeed{index: index, idx: idx, log: l}
+	oldest := l.oldest()
+	switch {
+	case since < 0:
+		feed.next = l.nextSeq
+	case since == 0:
+		feed.next = oldest
+	case uint64(since) + 1 < oldest:
+		return nil, &ChangesGoneError{Index: index, Since: uint64(since), Oldest: oldest}
+	default:
+		feed.next = uint64(since) + 1
+	}
+	return feed, nil
+}
+
+// 读取最多max个变更，没有新的变更时返回一个有新变更时被关闭的chan
+//   withDoc: 是否输出doc，doc中的时间字段会被格式化
+// 读取得太慢，需要的变更已经不再保留时返回*ChangesGoneError
+func (f *ChangeFeed) Read(max int, withDoc bool) ([]Change, <-chan struct{}, error) {
+	found, notify, err := f.read(max)
+	if err != nil || len(found) == 0 {
+		return nil, notify, err
+	}
+	changes := make([]Change, len(found))
+	for i, c := range found {
+		changes[i] = *c
+		if !withDoc || c.Doc == nil {
+			changes[i].Doc = nil
+		} else {
+			changes[i].Doc = f.idx.formatStoredDoc(c.Doc, nil)
+		}
+	}
+	return changes, nil, nil
+}
+
+// 只读取以后变更的游标，不需要加载索引库
+func liveChanges(index string) *ChangeFeed {
+	l := getChangeLog(index)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return &ChangeFeed{index: index, log: l, next: l.nextSeq}
+}
+
+// 读取最多max个原始的变更，返回的变更不能修改
+func (f *ChangeFeed) read(max int) ([]*Change, <-chan struct{}, error) {
+	l := f.log
+	l.lock.Lock()
+	oldest := l.oldest()
+	if f.next < oldest {
+		l.lock.Unlock()
+		return nil, nil, &ChangesGoneError{Index: f.index, Since: f.next - 1, Oldest: oldest}
+	}
+	var found []*Change
+	if n := len(l.changes); n > 0 && f.next < l.nextSeq {
+		start := n - int(l.nextSeq - f.next)
+		if end := start + max; end < n {
+			n = end
+		}
+		found = l.changes[start:n]
+	}
+	notify := l.notify
+	l.lock.Unlock()
+
+	if len(found) == 0 {
+		return nil, notify, nil
+	}
+	f.next = found[len(found)-1].Seq + 1
+	return found, nil, nil
+}
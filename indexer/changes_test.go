@@ -0,0 +1,53 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"testing"
+)
+
+func TestChangeFeed(t *testing.T) {
+	conf.ServiceConf.Changes.Retention = 3
+	defer func() { conf.ServiceConf.Changes.Retention = 0 }()
+
+	idx := &indexer{schema: &conf.Schema{Name: "c-test", SchemaConf: &conf.SchemaConf{}}}
+	live, _ := idx.openChanges(-1)
+	all, _ := idx.openChanges(0)
+
+	idx.recordChange(CHANGE_INDEX, "1", StoredDoc{"id": 1})
+	idx.recordChange(CHANGE_UPDATE, "1", StoredDoc{"id": 1})
+	changes, _, err := live.Read(10, true)
+	if err != nil || len(changes) != 2 || changes[1].Op != CHANGE_UPDATE || changes[1].Seq != changes[0].Seq+1 {
+		t.Fatalf("unexpected changes: %v, %v", changes, err)
+	}
+	if changes[0].Doc["id"] != 1 {
+		t.Fatalf("doc expected: %v", changes[0])
+	}
+	first := changes[0].Seq
+
+	// 没有新变更时等待
+	_, wait, _ := live.Read(10, false)
+	if wait == nil {
+		t.Fatal("wait chan expected")
+	}
+	idx.recordChange(CHANGE_DELETE, "1", nil)
+	<-wait
+	if changes, _, _ = live.Read(10, false); len(changes) != 1 || changes[0].Op != CHANGE_DELETE {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	// 只保留最近3个变更
+	idx.recordChange(CHANGE_INDEX, "2", nil)
+	if _, _, err = all.Read(10, false); err == nil {
+		t.Fatal("ChangesGoneError expected")
+	}
+	if _, err = idx.openChanges(int64(first) - 1); err == nil {
+		t.Fatal("ChangesGoneError expected")
+	}
+	feed, err := idx.openChanges(int64(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes, _, _ = feed.Read(2, false); len(changes) != 2 || changes[0].Seq != first+1 {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+}
@@ -0,0 +1,156 @@
+package indexer
+
+import (
+	"golang.org/x/text/encoding/htmlindex"
+	"encoding/csv"
+	"strings"
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// csv中引号的处理方式
+const (
+	CSV_QUOTE_STRICT = "strict" // 缺省，引号必须符合RFC 4180
+	CSV_QUOTE_LAZY   = "lazy"   // 允许不规范的引号，如字段中间出现的引号
+	CSV_QUOTE_NONE   = "none"   // 不处理引号，引号作为普通字符
+)
+
+// csv/tsv文件的格式
+type CsvOpts struct {
+	Delimiter rune              // 字段分隔符，缺省为','，tsv缺省为'\t'
+	Quote     string            // CSV_QUOTE_STRICT(缺省)/CSV_QUOTE_LAZY/CSV_QUOTE_NONE
+	Comment   rune              // 以该字符开头的行是注释，0表示没有注释
+	NoHeader  bool              // 第一行不是标题，此时必须指定Columns
+	Columns   []string          // 各列的名称，指定后忽略标题行；名称为空的列不导入
+	Rename    map[string]string // 列名 -> 字段名
+}
+
+func (o *CsvOpts) Check() error {
+	switch o.Quote {
+	case "", CSV_QUOTE_STRICT, CSV_QUOTE_LAZY, CSV_QUOTE_NONE:
+	default:
+		return fmt.Errorf("unknown quote value %s, strict, lazy or none expected", o.Quote)
+	}
+	if o.Delimiter == '\r' || o.Delimiter == '\n' || o.Delimiter == '"' {
+		return fmt.Errorf("invalid delimiter %q", o.Delimiter)
+	}
+	if o.Comment != 0 && o.Comment == o.Delimiter {
+		return fmt.Errorf("comment character must differ from delimiter")
+	}
+	if o.NoHeader && len(o.Columns) == 0 {
+		return fmt.Errorf("columns must be specified if there's no header")
+	}
+	return nil
+}
+
+// 读取csv中的一行
+type recordReader interface {
+	Read() ([]string, error)
+	Line() int // 最近读取的一行的行号
+}
+
+type csvRecordReader struct {
+	*csv.Reader
+}
+
+func (r csvRecordReader) Line() int {
+	line, _ := r.FieldPos(0)
+	return line
+}
+
+// CSV_QUOTE_NONE时使用，按分隔符直接切分每一行
+type plainRecordReader struct {
+	br        *bufio.Reader
+	delimiter string
+	comment   rune
+	line      int
+}
+
+func (r *plainRecordReader) Read() ([]string, error) {
+	for {
+		text, err := r.br.ReadString('\n')
+		if len(text) == 0 && err != nil {
+			return nil, err
+		}
+		r.line += 1
+		text = strings.TrimRight(text, "\r\n")
+		if len(text) == 0 || (r.comment != 0 && strings.HasPrefix(text, string(r.comment))) {
+			continue
+		}
+
+		return strings.Split(text, r.delimiter), nil
+	}
+}
+
+func (r *plainRecordReader) Line() int {
+	return r.line
+}
+
+func newRecordReader(in io.Reader, o *CsvOpts) recordReader {
+	delimiter := o.Delimiter
+	if delimiter == 0 {
+		delimiter = ','
+	}
+
+	if o.Quote == CSV_QUOTE_NONE {
+		return &plainRecordReader{br: bufio.NewReader(in), delimiter: string(delimiter), comment: o.Comment}
+	}
+
+	r := csv.NewReader(in)
+	r.Comma = delimiter
+	r.Comment = o.Comment
+	r.LazyQuotes = o.Quote == CSV_QUOTE_LAZY
+	return csvRecordReader{r}
+}
+
+// 确定各列对应的字段名，返回的字段名为空表示该列不导入
+func (o *CsvOpts) fieldNames(header []string) []string {
+	columns := o.Columns
+	if len(columns) == 0 {
+		columns = header
+	}
+	fields := make([]string, len(columns))
+	for i, c := range columns {
+		c = strings.TrimSpace(c)
+		if i == 0 {
+			c = strings.TrimPrefix(c, "\ufeff") // UTF-8 BOM
+		}
+		if f, ok := o.Rename[c]; ok {
+			c = f
+		}
+		fields[i] = c
+	}
+	return fields
+}
+
+// 把输入从charset转换为UTF-8
+func decodeCharset(in io.Reader, charset string) (io.Reader, error) {
+	if isUTF8(charset) {
+		return in, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+	return enc.NewDecoder().Reader(in), nil
+}
+
+func isUTF8(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8":
+		return true
+	}
+	return false
+}
+
+// 检查字符集是否支持
+func CheckCharset(charset string) error {
+	if isUTF8(charset) {
+		return nil
+	}
+	if _, err := htmlindex.Get(charset); err != nil {
+		return fmt.Errorf("unsupported charset %s", charset)
+	}
+	return nil
+}
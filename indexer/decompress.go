@@ -0,0 +1,95 @@
+package indexer
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"path"
+	"fmt"
+	"io"
+)
+
+// 上传内容的压缩方式
+const (
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+// 把Content-Encoding的值转换为压缩方式，""表示没有压缩
+func ParseCompression(encoding string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return "", nil
+	case "gzip", "x-gzip":
+		return COMPRESSION_GZIP, nil
+	case "zstd":
+		return COMPRESSION_ZSTD, nil
+	default:
+		return "", fmt.Errorf("unsupported encoding %s, gzip or zstd expected", encoding)
+	}
+}
+
+// 从文件名获取扩展名和压缩方式，如"a.json.gz"返回".json"和COMPRESSION_GZIP
+func SplitCompressedExt(fileName string) (ext string, compression string) {
+	name := strings.ToLower(fileName)
+	switch path.Ext(name) {
+	case ".gz":
+		compression = COMPRESSION_GZIP
+	case ".zst", ".zstd":
+		compression = COMPRESSION_ZSTD
+	default:
+		return path.Ext(name), ""
+	}
+	name = strings.TrimSuffix(name, path.Ext(name))
+	return path.Ext(name), compression
+}
+
+// 解压输入，compression为""时不做处理
+func Decompress(in io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "":
+		return ioutil.NopCloser(in), nil
+	case COMPRESSION_GZIP:
+		return gzip.NewReader(in)
+	case COMPRESSION_ZSTD:
+		d, err := zstd.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", compression)
+	}
+}
+
+// 生成doc前先按opts解压输入、转换字符集
+func decoded(docGenerator fnReaderGenerator) fnReaderGenerator {
+	return func(in io.Reader, opts *ImportOpts) (<-chan Doc, error) {
+		dIn, err := Decompress(in, opts.Compression)
+		if err != nil {
+			return nil, err
+		}
+		cIn, err := decodeCharset(dIn, opts.Charset)
+		if err != nil {
+			dIn.Close()
+			return nil, err
+		}
+		docs, err := docGenerator(cIn, opts)
+		if err != nil {
+			dIn.Close()
+			return nil, err
+		}
+
+		// doc都生成后释放解压用的资源
+		docChan := make(chan Doc)
+		go func() {
+			defer close(docChan)
+			defer dIn.Close()
+			for doc := range docs {
+				docChan <- doc
+			}
+		}()
+		return docChan, nil
+	}
+}
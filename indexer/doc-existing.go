@@ -2,7 +2,9 @@ package indexer
 
 import (
 	"github.com/go-ego/riot/types"
+	"go-search/conf"
 	"strings"
+	"strconv"
 	"fmt"
 )
 
@@ -61,15 +63,26 @@ func (idx *indexer) getDoc(doc map[string]interface{}) (map[string]interface{},
 		return nil, nil
 	}
 
-	schema := idx.schema
-	var retDoc StoredDoc
 	for _, doc := range docs {
 		storedDoc, ok := doc.Fields.(StoredDoc)
 		if !ok {
 			continue
 		}
-		retDoc = StoredDoc{}
+		return idx.formatStoredDoc(storedDoc, nil), nil
+	}
+	return nil, nil
+}
+
+// 把保存的doc转换为输出的doc，时间字段会被格式化
+//   outFieldList: 输出字段列表，nil表示输出全部字段
+func (idx *indexer) formatStoredDoc(storedDoc StoredDoc, outFieldList []string) StoredDoc {
+	schema := idx.schema
+	if outFieldList == nil {
+		retDoc := StoredDoc{}
 		for k, v := range storedDoc {
+			if k == conf.EXPIRE_AT_FIELD {
+				continue
+			}
 			if fIdx, ok := schema.TimeIdx[k]; !ok {
 				retDoc[k] = v
 			} else {
@@ -77,7 +90,104 @@ func (idx *indexer) getDoc(doc map[string]interface{}) (map[string]interface{},
 				retDoc[k] = field.FormatDatetime(v)
 			}
 		}
-		return retDoc, nil
+		return retDoc
 	}
-	return nil, nil
+
+	retDoc := StoredDoc{}
+	for _, f := range outFieldList {
+		if v, ok := storedDoc[f]; ok {
+			if fIdx, ok := schema.TimeIdx[f]; !ok {
+				retDoc[f] = v
+			} else {
+				field := &schema.Fields[fIdx]
+				retDoc[f] = field.FormatDatetime(v)
+			}
+		}
+	}
+	return retDoc
+}
+
+// 根据docId获取doc
+//   docId: docId，如果是map[string]interface{}，则根据其中的PK字段生成docId
+//   fl: 输出字段列表，多个字段名用','分割，空串表示输出全部字段
+func GetDoc(index string, docId interface{}, fl string) (StoredDoc, error) {
+	docs, _, err := MultiGetDocs(index, []interface{}{docId}, fl)
+	if err != nil {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// 根据docId批量获取doc
+//   docIds: docId列表，每项可以是docId，也可以是包含PK字段的对象
+//   fl: 输出字段列表，多个字段名用','分割，空串表示输出全部字段
+// 返回结果与docIds一一对应，没找到的doc为nil
+func MultiGetDocs(index string, docIds []interface{}, fl string) (docs []StoredDoc, ids []string, err error) {
+	if !running {
+		return nil, nil, fmt.Errorf("the service is stopped")
+	}
+
+	idx, err := initIndexer(index)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids = make([]string, len(docIds))
+	for i, docId := range docIds {
+		if pk, ok := docId.(map[string]interface{}); ok {
+			if ids[i], err = idx.docIdOf(pk); err != nil {
+				return nil, nil, err
+			}
+		} else if f, ok := docId.(float64); ok {
+			ids[i] = strconv.FormatFloat(f, 'f', -1, 64) // 避免大整数输出为1e+06的形式
+		} else {
+			ids[i] = fmt.Sprintf("%v", docId)
+		}
+	}
+
+	found, err := idx.getDocsById(ids, fl)
+	if err != nil {
+		return nil, nil, err
+	}
+	docs = make([]StoredDoc, len(ids))
+	for i, id := range ids {
+		docs[i] = found[id]
+	}
+	return docs, ids, nil
+}
+
+// 根据docId查找doc，返回 docId -> 输出格式的doc
+func (idx *indexer) getDocsById(ids []string, fl string) (map[string]StoredDoc, error) {
+	pq, err := parseQuery("", "", "", "", "", "", fl)
+	if err != nil {
+		return nil, err
+	}
+	pq.start, pq.rows = 0, 0 // 输出全部结果
+
+	sr, err := idx.pq2SearchQuery(pq)
+	if err != nil {
+		return nil, err
+	}
+	sr.DocIds = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		sr.DocIds[id] = true
+	}
+	searchResp := idx.engine.Search(*sr)
+
+	res := make(map[string]StoredDoc, len(ids))
+	if searchResp.Docs == nil {
+		return res, nil
+	}
+	docs, ok := searchResp.Docs.(types.ScoredDocs)
+	if !ok {
+		return res, nil
+	}
+	for _, doc := range docs {
+		storedDoc, ok := doc.Fields.(StoredDoc)
+		if !ok {
+			continue
+		}
+		res[doc.DocId] = idx.formatStoredDoc(storedDoc, pq.outFieldList)
+	}
+	return res, nil
 }
@@ -2,56 +2,136 @@ package indexer
 
 import (
 	"io"
+	"fmt"
+	"bufio"
+	"bytes"
+	"strings"
 	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 type Doc struct {
-	doc map[string]interface{}
-	err error
+	doc  map[string]interface{}
+	err  error
+	line int    // doc在输入中的行号，从1开始，0表示不确定
+	file string // doc所在的文件，导入zip包时有效
+	mark interface{} // 生成时附带的值，成功写入后传给ImportOpts.OnIndexed，如数据源的watermark字段
 }
 
 //从reader依次获取doc的函数签名
-type fnReaderGenerator func(io.Reader) (<-chan Doc, error)
+type fnReaderGenerator func(io.Reader, *ImportOpts) (<-chan Doc, error)
+
+//从JSON数组文件依次获取doc，数组元素逐个解析，不需要把整个数组读入内存
+func fromJsonFile(in io.Reader, opts *ImportOpts) (<-chan Doc, error) {
+	lc := newLineCounter(in)
+	dec := json.NewDecoder(lc)
 
-//从doc数组依次获取doc
-func fromArray(docs []map[string]interface{}) (<-chan Doc, error) {
 	docChan := make(chan Doc)
+	t, err := dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			close(docChan)
+			return docChan, nil
+		}
+		return nil, err
+	}
+	if delim, ok := t.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("JSON array expected")
+	}
 
 	go func() {
-		for _, doc := range docs {
-			docChan <- Doc{doc, nil}
+		defer close(docChan)
+
+		for dec.More() {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				// 语法错误，无法继续解析
+				docChan <- Doc{err: err, line: lc.lineAt(dec.InputOffset())}
+				return
+			}
+			line := lc.lineAt(dec.InputOffset()) - bytes.Count(raw, []byte{'\n'})
+
+			var doc map[string]interface{}
+			if err := json.Unmarshal(raw, &doc); err != nil {
+				docChan <- Doc{err: fmt.Errorf("JSON object expected: %v", err), line: line}
+				continue
+			}
+			docChan <- Doc{doc: doc, line: line}
+		}
+
+		if _, err := dec.Token(); err != nil {
+			docChan <- Doc{err: err, line: lc.lineAt(dec.InputOffset())}
 		}
-		close(docChan)
 	}()
+
 	return docChan, nil
 }
 
-//从JSON数组文件依次获取doc
-func fromJsonFile(in io.Reader) (<-chan Doc, error) {
-	dec := json.NewDecoder(in)
-	var docs []map[string]interface{}
-	if err := dec.Decode(&docs); err != nil {
-		return nil, err
-	}
-	return fromArray(docs)
+// 记录已读取内容的行号，用于计算某个偏移量所在的行
+type lineCounter struct {
+	r      io.Reader
+	chunks [][]byte // 还没有计算过行数的内容
+	base   int64    // chunks[0]在输入中的偏移量
+	lines  int      // chunks[0]之前的行数
 }
 
-//从csv文件依次读取doc，第一行是标题
-func fromCsvFile(in io.Reader) (<-chan Doc, error) {
-	docChan := make(chan Doc)
+func newLineCounter(r io.Reader) *lineCounter {
+	return &lineCounter{r: r}
+}
 
-	csvIn := csv.NewReader(in)
-	fields, err := csvIn.Read()
-	if err != nil {
-		close(docChan)
-		if err == io.EOF {
-			return docChan, nil
+func (lc *lineCounter) Read(p []byte) (int, error) {
+	n, err := lc.r.Read(p)
+	if n > 0 {
+		chunk := make([]byte, n)
+		copy(chunk, p[:n])
+		lc.chunks = append(lc.chunks, chunk)
+	}
+	return n, err
+}
+
+// 偏移量offset所在的行号，从1开始。offset必须是递增的
+func (lc *lineCounter) lineAt(offset int64) int {
+	for len(lc.chunks) > 0 {
+		chunk := lc.chunks[0]
+		if offset < lc.base + int64(len(chunk)) {
+			return lc.lines + bytes.Count(chunk[:offset-lc.base], []byte{'\n'}) + 1
 		}
+		lc.lines += bytes.Count(chunk, []byte{'\n'})
+		lc.base += int64(len(chunk))
+		lc.chunks = lc.chunks[1:]
+	}
+	return lc.lines + 1
+}
 
+//从csv文件依次读取doc，格式由opts.Csv指定，缺省第一行是标题
+func fromCsvFile(in io.Reader, opts *ImportOpts) (<-chan Doc, error) {
+	co := opts.Csv
+	if co == nil {
+		co = &CsvOpts{}
+	}
+	if err := co.Check(); err != nil {
 		return nil, err
 	}
 
+	docChan := make(chan Doc)
+
+	csvIn := newRecordReader(in, co)
+	var header []string
+	if !co.NoHeader {
+		var err error
+		if header, err = csvIn.Read(); err != nil {
+			close(docChan)
+			if err == io.EOF {
+				return docChan, nil
+			}
+
+			return nil, err
+		}
+	}
+	fields := co.fieldNames(header)
+
 	go func() {
 		l := len(fields)
 
@@ -62,38 +142,306 @@ func fromCsvFile(in io.Reader) (<-chan Doc, error) {
 					close(docChan)
 					break
 				}
-				docChan <- Doc{nil, err}
-				continue
+				if e, ok := err.(*csv.ParseError); ok {
+					// 字段数不匹配等解析错误，跳过该行
+					docChan <- Doc{err: e.Err, line: e.StartLine}
+					continue
+				}
+				// 读取错误(如输入被关闭)时不再继续
+				docChan <- Doc{err: err}
+				close(docChan)
+				break
 			}
 
+			line := csvIn.Line()
+			if len(rec) != l {
+				docChan <- Doc{err: fmt.Errorf("%d fields expected, %d found", l, len(rec)), line: line}
+				continue
+			}
 			doc := make(map[string]interface{}, l)
 			for i, field := range fields {
-				doc[field] = rec[i]
+				if field != "" {
+					doc[field] = rec[i]
+				}
 			}
-			docChan <- Doc{doc, nil}
+			docChan <- Doc{doc: doc, line: line}
 		}
 	}()
 
 	return docChan, nil
 }
 
+//从tsv文件依次读取doc，除了分隔符缺省为'\t'，其它同fromCsvFile
+func fromTsvFile(in io.Reader, opts *ImportOpts) (<-chan Doc, error) {
+	co := CsvOpts{}
+	if opts.Csv != nil {
+		co = *opts.Csv
+	}
+	if co.Delimiter == 0 {
+		co.Delimiter = '\t'
+	}
+	o := *opts
+	o.Csv = &co
+	return fromCsvFile(in, &o)
+}
+
+const (
+	// 一个JSON最多可以占的行数，超过后认为该JSON有错误
+	maxJsonLines = 1000
+)
+
 //从JSON Lines文件(每行一个JSON)依次读取doc；JSON间不能有','
-func fromJsonLines(in io.Reader) (<-chan Doc, error) {
+//一个JSON可以占多行；某行JSON有错误时报告该行，并从下一行继续解析
+func fromJsonLines(in io.Reader, opts *ImportOpts) (<-chan Doc, error) {
 	docChan := make(chan Doc)
 
 	go func() {
-		dec := json.NewDecoder(in)
-		for dec.More() {
+		defer close(docChan)
+
+		lines := &jsonLinesInput{br: bufio.NewReader(in), first: 1}
+		dec := json.NewDecoder(lines)
+		var base int64 // dec开始解析的位置在输入中的偏移
+		for {
 			var doc map[string]interface{}
-			if err := dec.Decode(&doc); err != nil {
-				break
+			prevEnd := base + dec.InputOffset()
+			err := dec.Decode(&doc)
+			if err == io.EOF {
+				return
+			}
+			if lines.err != nil {
+				docChan <- Doc{err: lines.err, line: lines.first + len(lines.lines) - 1}
+				return
+			}
+			i := lines.valueLine(prevEnd)
+
+			switch err.(type) {
+			case nil, *json.UnmarshalTypeError:
+				// 一个完整的JSON，可能不是对象
+				if err != nil {
+					docChan <- Doc{err: fmt.Errorf("JSON object expected: %v", err), line: lines.first + i}
+				} else {
+					docChan <- Doc{doc: doc, line: lines.first + i}
+				}
+				lines.consumed(base + dec.InputOffset())
+			default:
+				// 第一行有错误，报告后从下一行继续；没有JSON时说明剩下的都是空行
+				if i >= 0 {
+					docChan <- Doc{err: err, line: lines.first + i}
+				} else {
+					i = len(lines.lines) - 1
+				}
+				base = lines.restart(i + 1)
+				dec = json.NewDecoder(lines)
+			}
+		}
+	}()
+
+	return docChan, nil
+}
+
+// 逐行交给json.Decoder的输入，Decoder增量解析，不用每读一行都重新解析
+// 保留上一个JSON结束以后读入的行，用于计算JSON的行号，以及出错后从下一行重新解析
+type jsonLinesInput struct {
+	br     *bufio.Reader
+	lines  []string // 上一个JSON结束的行，以及以后读入的行
+	first  int      // lines[0]的行号
+	offset int64    // lines[0]在输入中的偏移
+	replay []string // 出错后需要重新解析的行
+	unread string   // 最后一行中还没有交给Decoder的部分
+	eof    bool
+	err    error    // 读输入出错
+}
+
+var errJsonTooLong = fmt.Errorf("JSON not completed in %d lines", maxJsonLines)
+
+func (in *jsonLinesInput) Read(p []byte) (int, error) {
+	if in.unread == "" {
+		if len(in.lines) > maxJsonLines {
+			return 0, errJsonTooLong
+		}
+		var line string
+		if len(in.replay) > 0 {
+			line, in.replay = in.replay[0], in.replay[1:]
+		} else {
+			if in.eof {
+				return 0, io.EOF
+			}
+			var err error
+			if line, err = in.br.ReadString('\n'); err != nil {
+				if err != io.EOF {
+					in.err = err
+					return 0, err
+				}
+				in.eof = true
+			}
+			if len(line) == 0 {
+				return 0, io.EOF
 			}
-			docChan <- Doc{doc, nil}
 		}
+		in.lines = append(in.lines, line)
+		in.unread = line
+	}
+	n := copy(p, in.unread)
+	in.unread = in.unread[n:]
+	return n, nil
+}
 
-		close(docChan)
+// 偏移off以后第一个非空白字符所在的行在lines中的序号，没有时返回-1
+func (in *jsonLinesInput) valueLine(off int64) int {
+	start := in.offset
+	for i, line := range in.lines {
+		end := start + int64(len(line))
+		if off < end {
+			from := 0
+			if off > start {
+				from = int(off - start)
+			}
+			if strings.TrimSpace(line[from:]) != "" {
+				return i
+			}
+		}
+		start = end
+	}
+	return -1
+}
+
+// JSON在偏移off处结束，丢弃它之前的行
+func (in *jsonLinesInput) consumed(off int64) {
+	for len(in.lines) > 1 && in.offset + int64(len(in.lines[0])) <= off {
+		in.offset += int64(len(in.lines[0]))
+		in.first += 1
+		in.lines = in.lines[1:]
+	}
+}
+
+// 丢弃前n行，其余的行重新交给新的Decoder，返回新Decoder开始解析的位置
+func (in *jsonLinesInput) restart(n int) int64 {
+	for _, line := range in.lines[:n] {
+		in.offset += int64(len(line))
+	}
+	in.first += n
+	in.replay = append(append([]string{}, in.lines[n:]...), in.replay...)
+	in.lines, in.unread = nil, ""
+	return in.offset
+}
+
+//从xml文件依次读取doc，记录元素由opts.XmlRecord指定，缺省为根元素的子元素。
+//记录元素的属性和子元素都作为字段，子元素的属性和下级元素按路径命名，如"price.currency"、"seller.name"；
+//重复的子元素作为多值字段
+func fromXmlFile(in io.Reader, opts *ImportOpts) (<-chan Doc, error) {
+	dec := xml.NewDecoder(in)
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		if opts.Charset != "" {
+			// 已经按opts.Charset转换为UTF-8了
+			return input, nil
+		}
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported charset %s", charset)
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}
+	record := opts.XmlRecord
+
+	docChan := make(chan Doc)
+	go func() {
+		defer close(docChan)
+
+		depth := 0
+		for {
+			t, err := dec.Token()
+			if err != nil {
+				if err != io.EOF {
+					// 语法错误，无法继续解析
+					line, _ := dec.InputPos()
+					docChan <- Doc{err: err, line: line}
+				}
+				return
+			}
+
+			switch e := t.(type) {
+			case xml.StartElement:
+				depth += 1
+				if (record == "" && depth != 2) || (record != "" && e.Name.Local != record) {
+					continue
+				}
+				line, _ := dec.InputPos()
+				doc := map[string]interface{}{}
+				if err := readXmlElement(dec, e, "", doc); err != nil {
+					line, _ = dec.InputPos()
+					docChan <- Doc{err: err, line: line}
+					return
+				}
+				depth -= 1 // 记录元素的结束标签已经读取了
+				docChan <- Doc{doc: doc, line: line}
+			case xml.EndElement:
+				depth -= 1
+			}
+		}
 	}()
 
 	return docChan, nil
 }
 
+// 读取一个元素直到它的结束标签，把属性、文本和下级元素加到doc中
+//   path: 元素对应的字段名，记录元素为""
+func readXmlElement(dec *xml.Decoder, start xml.StartElement, path string, doc map[string]interface{}) error {
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		addXmlValue(doc, xmlPath(path, attr.Name.Local), attr.Value)
+	}
+
+	text := strings.Builder{}
+	hasChild := false
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		switch e := t.(type) {
+		case xml.StartElement:
+			hasChild = true
+			if err := readXmlElement(dec, e, xmlPath(path, e.Name.Local), doc); err != nil {
+				return err
+			}
+		case xml.CharData:
+			text.Write(e)
+		case xml.EndElement:
+			if path == "" {
+				return nil
+			}
+			// 叶子元素的文本总是作为字段值，有下级元素时只保存非空的文本
+			if s := strings.TrimSpace(text.String()); !hasChild || len(s) > 0 {
+				addXmlValue(doc, path, s)
+			}
+			return nil
+		}
+	}
+}
+
+func xmlPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// 增加一个字段值，重复的字段作为多值字段
+func addXmlValue(doc map[string]interface{}, name string, value interface{}) {
+	v, ok := doc[name]
+	if !ok {
+		doc[name] = value
+		return
+	}
+	if vs, ok := v.([]interface{}); ok {
+		doc[name] = append(vs, value)
+	} else {
+		doc[name] = []interface{}{v, value}
+	}
+}
@@ -0,0 +1,99 @@
+package indexer
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"io"
+)
+
+// 读取所有doc，返回每个doc的行号，出错的doc行号为负数
+func readDocLines(t *testing.T, gen fnReaderGenerator, in string) []int {
+	docChan, err := gen(strings.NewReader(in), &ImportOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []int{}
+	for doc := range docChan {
+		if doc.err != nil {
+			lines = append(lines, -doc.line)
+		} else {
+			lines = append(lines, doc.line)
+		}
+	}
+	return lines
+}
+
+func sameLines(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestErrorLines(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		gen   fnReaderGenerator
+		in    string
+		lines []int
+	}{
+		{"jsonl", fromJsonLines, "{\"id\":1}\n\n{\"id\":2,\n \"name\":\"x\"}\n[1]\n{\"id\":\n{\"id\":5}\n", []int{1, 3, -5, -6, 7}},
+		{"jsonl-trailing", fromJsonLines, "{\"id\":1}\n{bad}\n\n", []int{1, -2}},
+		{"csv", fromCsvFile, "id,name\n1,a\n2\n\"3\",\"b\nc\"\n4,d\n", []int{2, -3, 4, 6}},
+		{"tsv", fromTsvFile, "id\tname\n1\ta\n2\tb\tc\n3\td\n", []int{2, -3, 4}},
+	} {
+		if lines := readDocLines(t, c.gen, c.in); !sameLines(lines, c.lines) {
+			t.Errorf("%s: lines %v expected, got %v", c.name, c.lines, lines)
+		}
+	}
+}
+
+func TestJsonArray(t *testing.T) {
+	for _, c := range []struct {
+		in    string
+		lines []int
+	}{
+		{"", []int{}},
+		{"[]", []int{}},
+		{"[\n{\"id\":1},\n  {\"id\":2,\n\"name\":\"x\"}, 3,\n{\"id\":4}\n]", []int{2, 3, -4, 5}},
+		{"[{\"id\":1},\n{\"id\":2}\n{\"id\":3}]", []int{1, 2, -3}}, // 缺少','时无法继续
+		{"[{\"id\":1}", []int{1, -1}},
+	} {
+		if lines := readDocLines(t, fromJsonFile, c.in); !sameLines(lines, c.lines) {
+			t.Errorf("%q: lines %v expected, got %v", c.in, c.lines, lines)
+		}
+	}
+	if _, err := fromJsonFile(strings.NewReader(`{"id":1}`), &ImportOpts{}); err == nil {
+		t.Errorf("error expected for a non-array input")
+	}
+
+	// 数组元素逐个解析，不需要等到整个数组读完
+	r, w := io.Pipe()
+	defer w.Close()
+	go w.Write([]byte("[{\"id\":1},\n"))
+	docChan, err := fromJsonFile(r, &ImportOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case doc := <-docChan:
+		if doc.err != nil || doc.doc["id"] != float64(1) {
+			t.Fatalf("doc 1 expected, got %+v", doc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the first element is not parsed before the array ends")
+	}
+	go w.Write([]byte("{\"id\":2}]"))
+	if doc := <-docChan; doc.err != nil || doc.doc["id"] != float64(2) || doc.line != 2 {
+		t.Fatalf("doc 2 expected, got %+v", doc)
+	}
+	if _, ok := <-docChan; ok {
+		t.Fatalf("no more docs expected")
+	}
+}
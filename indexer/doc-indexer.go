@@ -2,24 +2,83 @@ package indexer
 
 import (
 	"github.com/go-ego/riot/types"
-	"github.com/rosbit/gnet"
 	"go-search/conf"
 	"net/http"
 	"strings"
 	"fmt"
 	"log"
+	"time"
 	"io"
 	"os"
 )
 
+// 出错时的处理方式
+const (
+	ON_ERROR_SKIP  = "skip"  // 跳过出错的doc，继续导入
+	ON_ERROR_ABORT = "abort" // 遇到出错的doc就停止导入
+)
+
+// 批量导入doc的选项
+type ImportOpts struct {
+	Async       bool     // 是否异步导入，异步导入时会创建一个job
+	Cb          string   // 异步导入结束后回调的url，可以为空
+	TmpFile     string   // 异步导入时保存上传内容的临时文件，导入结束后删除
+	OnError     string   // ON_ERROR_SKIP(缺省)或ON_ERROR_ABORT
+	Charset     string   // 上传内容的字符集，如GBK、GB18030，缺省为UTF-8
+	Csv         *CsvOpts // csv/tsv文件的格式，nil表示使用缺省格式
+	XmlRecord   string   // xml文件中表示一个doc的元素名，缺省为根元素的子元素
+	Compression string   // 上传内容的压缩方式，COMPRESSION_GZIP或COMPRESSION_ZSTD，""表示没有压缩
+	Source      string   // 导入内容的来源，如文件名，会记录在job中
+	Pipeline    string   // 导入时使用的pipeline，缺省使用schema中指定的pipeline，PIPELINE_NONE表示不使用
+	Refresh     string   // 导入结束后的刷新方式，同IndexDoc的refresh参数
+	OnDone      func(jobId string, res *ImportResult) // 异步导入结束后调用，可以为nil
+	OnIndexed   func(mark interface{})                // 每个doc成功写入后用Doc.mark调用，可以为nil
+	Skip        int                                   // 跳过输入中的前Skip个doc，用于从上次提交的位置继续导入
+	OnCommitted func(pos, docs, failed int)           // 输入中的前pos个doc(跳过的除外，其中docs个成功、failed个出错)已经持久保存后调用，可以为nil
+}
+
+const (
+	// 导入时每处理这么多doc调用一次ImportOpts.OnCommitted
+	importCommitDocs = 1000
+)
+
+// 导入出错的doc
+type DocError struct {
+	Pos   int    `json:"pos"`            // doc在输入中的序号，从1开始
+	Line  int    `json:"line,omitempty"` // doc在输入中的行号，从1开始，0表示不确定
+	File  string `json:"file,omitempty"` // doc所在的文件，导入zip包时有效
+	Error string `json:"error"`
+}
+
+// 批量导入的结果
+type ImportResult struct {
+	DocIds          []string   // 成功导入的docId
+	Failed          int        // 出错的doc数
+	Dropped         int        // 被pipeline丢弃的doc数
+	Errors          []DocError // 出错的doc，最多保留conf.ServiceConf.Import.MaxErrors个
+	ErrorsTruncated bool       // 是否有出错的doc没有保留
+	Aborted         error      // ON_ERROR_ABORT时导致导入停止的错误
+}
+
+func (res *ImportResult) addError(pos int, doc *Doc, err error) {
+	res.Failed += 1
+	if maxErrors := conf.ServiceConf.Import.MaxErrors; maxErrors > 0 && len(res.Errors) >= maxErrors {
+		res.ErrorsTruncated = true
+		return
+	}
+	res.Errors = append(res.Errors, DocError{Pos: pos, Line: doc.line, File: doc.file, Error: err.Error()})
+}
+
 // IndexJSON/IndexCSV/... 等从文件获取doc建索引的函数签名
-type FnIndexReader func(string,io.ReadCloser,...string)([]string,error)
+//   同步导入时返回导入结果，异步导入时返回jobId
+type FnIndexReader func(index string, in io.ReadCloser, opts *ImportOpts) (res *ImportResult, jobId string, err error)
 
 // IndexDoc/UpdateDoc: 更新一个doc
-type FnUpdateDoc func(index string, doc map[string]interface{}) (docId string, err error)
+//   refresh: REFRESH_DEFAULT、REFRESH_TRUE、REFRESH_FALSE或REFRESH_WAIT_FOR
+type FnUpdateDoc func(index string, doc map[string]interface{}, refresh string) (docId string, err error)
 
 // 把一个doc添加到索引库
-func IndexDoc(index string, doc map[string]interface{}) (docId string, err error) {
+func IndexDoc(index string, doc map[string]interface{}, refresh string) (docId string, err error) {
 	if !running {
 		return "", fmt.Errorf("the service is stopped")
 	}
@@ -28,17 +87,26 @@ func IndexDoc(index string, doc map[string]interface{}) (docId string, err error
 	if err != nil {
 		return "", fmt.Errorf("schema %s not found, please create schema first", index)
 	}
+	r, err := idx.tryEnqueue(1)
+	if err != nil {
+		return "", err
+	}
+	defer r.release()
 
-	docId, err = idx.indexDoc(doc)
+	pc := &pendingChanges{}
+	docId, err = idx.putDoc(doc, CHANGE_INDEX, r, pc)
 	if err != nil {
 		return "", err
 	}
-	idx.flush()
+	if err = idx.commitChanges(pc); err != nil {
+		return "", err
+	}
+	idx.afterWrite(refresh)
 	return docId, nil
 }
 
 // 更新一个doc，可以只更新出现的字段。如果doc不存在，更新会失败
-func UpdateDoc(index string, doc map[string]interface{}) (docId string, err error) {
+func UpdateDoc(index string, doc map[string]interface{}, refresh string) (docId string, err error) {
 	if !running {
 		return "", fmt.Errorf("the service is stopped")
 	}
@@ -47,6 +115,11 @@ func UpdateDoc(index string, doc map[string]interface{}) (docId string, err erro
 	if err != nil {
 		return "", fmt.Errorf("schema %s not found, please create schema first", index)
 	}
+	r, err := idx.tryEnqueue(1)
+	if err != nil {
+		return "", err
+	}
+	defer r.release()
 
 	existingDoc, err := idx.getDoc(doc)
 	if err != nil {
@@ -60,33 +133,74 @@ func UpdateDoc(index string, doc map[string]interface{}) (docId string, err erro
 	}
 	fmt.Printf("new doc: %v\n", existingDoc)
 
-	docId, err = idx.indexDoc(existingDoc)
+	pc := &pendingChanges{}
+	docId, err = idx.putDoc(existingDoc, CHANGE_UPDATE, r, pc)
 	if err != nil {
 		return "", err
 	}
-	idx.flush()
+	if err = idx.commitChanges(pc); err != nil {
+		return "", err
+	}
+	idx.afterWrite(refresh)
 	return docId, nil
 }
 
 // 把多个JSON(JSON数组)添加到索引库
-func IndexJSON(index string, in io.ReadCloser, cb ...string) (docIds []string, err error) {
-	return indexFromDocGenerator(index, in, fromJsonFile, cb...)
+func IndexJSON(index string, in io.ReadCloser, opts *ImportOpts) (res *ImportResult, jobId string, err error) {
+	return indexFromDocGenerator(index, in, decoded(fromJsonFile), opts)
 }
 
 // 把csv中的一行作为doc添加到索引库
-func IndexCSV(index string, in io.ReadCloser, cb ...string) (docIds []string, err error) {
-	return indexFromDocGenerator(index, in, fromCsvFile, cb...)
+func IndexCSV(index string, in io.ReadCloser, opts *ImportOpts) (res *ImportResult, jobId string, err error) {
+	return indexFromDocGenerator(index, in, decoded(fromCsvFile), opts)
+}
+
+// 把tsv中的一行作为doc添加到索引库，除了分隔符缺省为'\t'，其它同IndexCSV
+func IndexTSV(index string, in io.ReadCloser, opts *ImportOpts) (res *ImportResult, jobId string, err error) {
+	return indexFromDocGenerator(index, in, decoded(fromTsvFile), opts)
+}
+
+// 把xml中的一个记录元素作为doc添加到索引库
+func IndexXML(index string, in io.ReadCloser, opts *ImportOpts) (res *ImportResult, jobId string, err error) {
+	return indexFromDocGenerator(index, in, decoded(fromXmlFile), opts)
 }
 
 // 把JSON Lines(每行一个JSON)添加到索引库
-func IndexJSONLines(index string, in io.ReadCloser, cb ...string) (docIds []string, err error) {
-	return indexFromDocGenerator(index, in, fromJsonLines, cb...)
+func IndexJSONLines(index string, in io.ReadCloser, opts *ImportOpts) (res *ImportResult, jobId string, err error) {
+	return indexFromDocGenerator(index, in, decoded(fromJsonLines), opts)
+}
+
+// 文件扩展名 -> 导入函数
+var ext2IndexReader = map[string]FnIndexReader{
+	".csv":   IndexCSV,
+	".tsv":   IndexTSV,
+	".jsonl": IndexJSONLines,
+	".json":  IndexJSON,
+	".xml":   IndexXML,
+	".zip":   IndexZip,
+}
+
+// 根据文件扩展名(不含压缩扩展名，如".gz")获取导入函数
+func IndexReaderOfExt(ext string) (FnIndexReader, bool) {
+	r, ok := ext2IndexReader[ext]
+	return r, ok
+}
+
+// 把zip包中的文件依次添加到索引库，文件类型由扩展名确定
+func IndexZip(index string, in io.ReadCloser, opts *ImportOpts) (res *ImportResult, jobId string, err error) {
+	return indexFromDocGenerator(index, in, fromZipFile, opts)
 }
 
 //从文件获取doc做索引的统一流程，不同的文件类型需要实现一个fnReaderGenerator
-func indexFromDocGenerator(index string, in io.ReadCloser, docGenerator fnReaderGenerator, cb ...string) (docIds []string, err error) {
+func indexFromDocGenerator(index string, in io.ReadCloser, docGenerator fnReaderGenerator, opts *ImportOpts) (res *ImportResult, jobId string, err error) {
 	var idx *indexer
+	var pl *pipeline
 	var docChan <-chan Doc
+	var j *job
+
+	if opts == nil {
+		opts = &ImportOpts{}
+	}
 
 	if !running {
 		err = fmt.Errorf("the service is stopped")
@@ -99,34 +213,53 @@ func indexFromDocGenerator(index string, in io.ReadCloser, docGenerator fnReader
 		goto ERROR
 	}
 
-	docChan, err = docGenerator(in)
+	pl, err = idx.getPipeline(opts.Pipeline)
 	if err != nil {
 		goto ERROR
 	}
-	if len(cb) == 0 {
-		defer in.Close()
-		// no callback
-		return idx.indexDocs(docChan), nil
+
+	docChan, err = docGenerator(in, opts)
+	if err != nil {
+		goto ERROR
+	}
+	if !opts.Async {
+		res = idx.indexDocs(docChan, nil, pl, opts)
+		drainDocs(in, docChan)
+		return res, "", nil
 	}
 
-	// with callback
+	// async
+	j = newJob("import", index)
+	j.status.Source = opts.Source
 	go func() {
-		defer os.Remove(cb[1])
-		defer in.Close()
-		idx.indexDocs(docChan, cb...)
+		if opts.TmpFile != "" {
+			defer os.Remove(opts.TmpFile)
+		}
+		res := idx.indexDocs(docChan, j, pl, opts)
+		drainDocs(in, docChan)
+		if opts.OnDone != nil {
+			opts.OnDone(j.status.Id, res)
+		}
 	}()
-	return nil, nil
+	return nil, j.status.Id, nil
 
 ERROR:
 	in.Close()
-	if len(cb) > 0 {
-		os.Remove(cb[1])
+	if opts.TmpFile != "" {
+		os.Remove(opts.TmpFile)
 	}
 	return
 }
 
+// 导入停止(取消或出错)时需要关闭输入，并读完剩余的doc，以便生成doc的goroutine退出
+func drainDocs(in io.ReadCloser, docChan <-chan Doc) {
+	in.Close()
+	for range docChan {
+	}
+}
+
 // 删除一个doc
-func DeleteDoc(index string, docId interface{}) error {
+func DeleteDoc(index string, docId interface{}, refresh string) error {
 	if !running {
 		return fmt.Errorf("the service is stopped")
 	}
@@ -135,13 +268,24 @@ func DeleteDoc(index string, docId interface{}) error {
 	if err != nil {
 		return fmt.Errorf("schema %s not found, please create schema first", index)
 	}
-	idx.deleteDoc(fmt.Sprintf("%v", docId))
-	idx.flush()
+	r, err := idx.tryEnqueue(1)
+	if err != nil {
+		return err
+	}
+	defer r.release()
+	pc := &pendingChanges{}
+	if err = idx.deleteDoc(fmt.Sprintf("%v", docId), r, pc); err != nil {
+		return err
+	}
+	if err = idx.commitChanges(pc); err != nil {
+		return err
+	}
+	idx.afterWrite(refresh)
 	return nil
 }
 
 // 删除多个doc
-func DeleteDocs(index string, docIds []interface{}) error {
+func DeleteDocs(index string, docIds []interface{}, refresh string) error {
 	if !running {
 		return fmt.Errorf("the service is stopped")
 	}
@@ -150,21 +294,72 @@ func DeleteDocs(index string, docIds []interface{}) error {
 	if err != nil {
 		return fmt.Errorf("schema %s not found, please create schema first", index)
 	}
+	r, err := idx.tryEnqueue(len(docIds))
+	if err != nil {
+		return err
+	}
+	defer r.release()
+	pc := &pendingChanges{}
 	for _, docId := range docIds {
-		idx.deleteDoc(fmt.Sprintf("%v", docId))
+		if err = idx.deleteDoc(fmt.Sprintf("%v", docId), r, pc); err != nil {
+			break
+		}
 	}
-	idx.flush()
-	return nil
+	if e := idx.commitChanges(pc); err == nil {
+		err = e
+	}
+	idx.afterWrite(refresh)
+	return err
+}
+
+//索引中增加一个文档，变更加入pc，提交后记录
+func (idx *indexer) indexDoc(doc map[string]interface{}, pc *pendingChanges) (string, error) {
+	return idx.putDoc(doc, CHANGE_INDEX, nil, pc)
+}
+
+// 更新一个文档，与indexDoc的区别只是记录的变更操作不同
+func (idx *indexer) updateDoc(doc map[string]interface{}, pc *pendingChanges) (string, error) {
+	return idx.putDoc(doc, CHANGE_UPDATE, nil, pc)
+}
+
+// r:  tryEnqueue预留的队列位置，nil表示队列满时等待
+// pc: 加入变更，调用方用commitChanges提交后记录
+func (idx *indexer) putDoc(doc map[string]interface{}, changeOp string, r *queueReservation, pc *pendingChanges) (string, error) {
+	dId, docData, err := idx.buildDocData(doc)
+	if err != nil {
+		return "", err
+	}
+	if idx, err = idx.beginWrite(); err != nil {
+		return "", err
+	}
+	defer idx.writeLock.RUnlock()
+	idx.walLock.Lock()
+	if idx.wal != nil {
+		if err := idx.wal.append(_INDEX_DOC, dId, docData); err != nil {
+			idx.walLock.Unlock()
+			return "", err
+		}
+	}
+	idx.enqueueOp(&indexerOp{
+		op: _INDEX_DOC,
+		engine: idx.engine,
+		docId: dId,
+		doc: docData,
+		force: idx.refreshEachWrite(),
+	}, r)
+	idx.addTerms(dId, docData.Fields.(StoredDoc))
+	idx.walLock.Unlock()
+	pc.add(changeOp, dId, docData.Fields.(StoredDoc))
+	return dId, nil
 }
 
-//索引中增加一个文档
-func (idx *indexer) indexDoc(doc map[string]interface{}) (string, error) {
+// 把doc转换为搜索引擎需要的数据: 字段值转换、分词、计算docId
+func (idx *indexer) buildDocData(doc map[string]interface{}) (string, *types.DocData, error) {
 	storedDoc := StoredDoc{}
 	tokens := []types.TokenData{}
 
 	fm := idx.schema.FieldMap
 	fields := idx.schema.Fields
-	engine := idx.engine
 	startLoc := 0
 	pk := map[int]interface{}{}
 	for fieldName, value := range doc {
@@ -176,126 +371,234 @@ func (idx *indexer) indexDoc(doc map[string]interface{}) (string, error) {
 
 		val, err := field.ToNativeValue(value)
 		if err != nil {
-			return "", err
+			return "", nil, fmt.Errorf("field %s: %v", fieldName, err)
 		}
+		vals, isMulti := val.([]interface{})
+		isMulti = isMulti && field.Type != "json"
 		if field.PK {
+			if isMulti {
+				return "", nil, fmt.Errorf("pk field %s can't have multiple values", fieldName)
+			}
 			pk[fieldIdx] = val
 		}
 
-		switch val.(type) {
-		case string:
-			s := val.(string)
-			var segTokens []string
-			switch field.Tokenizer {
-			case conf.ZH_TOKENIZER:
-				// segTokens = engine.Segment(s)
-				segTokens = hanziTokenize(s)
-			case conf.NONE_TOKENIZER:
-				// segTokens = []string{strings.TrimSpace(s)}
-				val = strings.TrimSpace(s)
-			default:
-				segTokens = whitespaceTokenize(s)
-			}
-			if len(segTokens) > 0 {
-				fieldTokens := buildIndexTokens(fieldIdx, segTokens, startLoc)
-				tokens = append(tokens, fieldTokens...)
-				startLoc += len(fieldTokens) + 10 // 与下一字段的索引间加上几个间隔
+		if isMulti {
+			// 多值字段，每个字符串值分别分词
+			for i, v := range vals {
+				if s, ok := v.(string); ok {
+					vals[i] = appendFieldTokens(&tokens, field, fieldIdx, s, &startLoc)
+				}
 			}
-		default:
+		} else if s, ok := val.(string); ok {
+			val = appendFieldTokens(&tokens, field, fieldIdx, s, &startLoc)
 		}
 
 		storedDoc[fieldName] = val
 	}
-	pkIdx := idx.schema.PKIdx
-	if len(pk) != len(pkIdx) {
-		return "", fmt.Errorf("pk field must be specified")
+	if len(pk) != len(idx.schema.PKIdx) {
+		missing := []string{}
+		for _, fIdx := range idx.schema.PKIdx {
+			if _, ok := pk[fIdx]; !ok {
+				missing = append(missing, fields[fIdx].Name)
+			}
+		}
+		return "", nil, fmt.Errorf("pk field %s must be specified", strings.Join(missing, ","))
+	}
+
+	if expireAt, ok := idx.expireAt(storedDoc, time.Now()); ok {
+		storedDoc[conf.EXPIRE_AT_FIELD] = expireAt
 	}
 
+	dId := idx.pkToDocId(pk)
+	count := mergeTokenLocs(&tokens)
+	docData := &types.DocData{
+		Tokens: tokens[:count],
+		Fields: storedDoc,
+		Labels: allDocs,
+	}
+	return dId, docData, nil
+}
+
+// 对字符串字段值分词，把分词结果加到tokens中，返回需要保存的字段值
+func appendFieldTokens(tokens *[]types.TokenData, field *conf.Field, fieldIdx int, s string, startLoc *int) string {
+	var segTokens []string
+	switch field.Tokenizer {
+	case conf.ZH_TOKENIZER:
+		// segTokens = engine.Segment(s)
+		segTokens = hanziTokenize(s)
+	case conf.NONE_TOKENIZER:
+		// segTokens = []string{strings.TrimSpace(s)}
+		return strings.TrimSpace(s)
+	default:
+		segTokens = whitespaceTokenize(s)
+	}
+	if len(segTokens) > 0 {
+		fieldTokens := buildIndexTokens(fieldIdx, segTokens, *startLoc)
+		*tokens = append(*tokens, fieldTokens...)
+		*startLoc += len(fieldTokens) + 10 // 与下一字段的索引间加上几个间隔
+	}
+	return s
+}
+
+// 根据PK字段的值生成docId: 把每个主键转换成字符串，然后用"_"连接
+//   pk: 字段序号 -> 转换后的字段值
+func (idx *indexer) pkToDocId(pk map[int]interface{}) string {
 	docId := strings.Builder{}
-	for i, idx := range pkIdx {
+	for i, fIdx := range idx.schema.PKIdx {
 		if i > 0 {
 			docId.WriteByte('_')
 		}
-		docId.WriteString(fmt.Sprintf("%v", pk[idx]))
+		docId.WriteString(fmt.Sprintf("%v", pk[fIdx]))
 	}
+	return docId.String()
+}
 
-	dId := docId.String()
-	count := mergeTokenLocs(&tokens)
-	indexerChan <- &indexerOp{
-		op: _INDEX_DOC,
-		engine: engine,
-		docId: dId,
-		doc: &types.DocData{
-			Tokens: tokens[:count],
-			Fields: storedDoc,
-			Labels: allDocs,
-		},
+// 根据doc中的PK字段生成docId
+func (idx *indexer) docIdOf(doc map[string]interface{}) (string, error) {
+	fields := idx.schema.Fields
+	pk := make(map[int]interface{}, len(idx.schema.PKIdx))
+	for _, fIdx := range idx.schema.PKIdx {
+		field := &fields[fIdx]
+		value, ok := doc[field.Name]
+		if !ok {
+			return "", fmt.Errorf("pk field %s must be specified", field.Name)
+		}
+		val, err := field.ToNativeValue(value)
+		if err != nil {
+			return "", err
+		}
+		pk[fIdx] = val
 	}
-	return dId, nil
+	return idx.pkToDocId(pk), nil
 }
 
 //批量增加索引文档
-func (idx *indexer) indexDocs(docs <-chan Doc, cb ...string) (docIds []string) {
-	hasError := false
-	hasCb := len(cb) > 0
-
-	count := 0
+//  j:    异步导入时的job，同步导入时为nil
+//  pl:   对每个doc做预处理的pipeline，可以为nil
+//  opts: 导入选项，异步导入结束后会回调opts.Cb
+func (idx *indexer) indexDocs(docs <-chan Doc, j *job, pl *pipeline, opts *ImportOpts) *ImportResult {
+	isAsync := j != nil
+	abortOnError := opts.OnError == ON_ERROR_ABORT
+	res := &ImportResult{}
+
+	count, pos := 0, 0
+	pc := &pendingChanges{}
+	committed := func() {
+		if opts.OnCommitted == nil {
+			return
+		}
+		if ok, err := idx.persist(); err != nil {
+			log.Printf("[error] failed to persist index %s: %v\n", idx.schema.Name, err)
+		} else if ok {
+			opts.OnCommitted(pos, count, res.Failed)
+		}
+	}
 	for doc := range docs {
-		if doc.err != nil {
-			if !hasCb {
-				docIds = append(docIds, doc.err.Error())
-			} else {
-				log.Printf("[error] indexing %s: %v\n", idx.schema.Name, doc.err.Error())
-			}
+		if isAsync && j.isCancelled() {
+			log.Printf("[info] job %s on index %s cancelled\n", j.status.Id, idx.schema.Name)
+			break
+		}
+		if pos > opts.Skip && (pos - opts.Skip) % importCommitDocs == 0 {
+			committed()
+		}
+		pos += 1
+		if pos <= opts.Skip {
 			continue
 		}
 
-		if docId, err := idx.indexDoc(doc.doc); err != nil {
-			if !hasCb {
-				docIds = append(docIds, err.Error())
-			} else {
-				log.Printf("[error] indexing %s: %v\n", idx.schema.Name, err.Error())
+		err := doc.err
+		if err == nil && pl != nil {
+			var drop bool
+			if drop, err = pl.run(doc.doc); err == nil && drop {
+				res.Dropped += 1
+				continue
 			}
-			hasError = true
+		}
+		var docId string
+		if err == nil {
+			docId, err = idx.indexDoc(doc.doc, pc)
+		}
+
+		if err != nil {
+			log.Printf("[error] indexing %s: %v\n", idx.schema.Name, err.Error())
+			res.addError(pos, &doc, err)
+			if isAsync {
+				j.progress(false)
+			}
+			if abortOnError {
+				where := fmt.Sprintf("doc #%d", pos)
+				if doc.line > 0 {
+					where = fmt.Sprintf("line %d", doc.line)
+				}
+				if doc.file != "" {
+					where = fmt.Sprintf("%s of %s", where, doc.file)
+				}
+				res.Aborted = fmt.Errorf("import aborted at %s: %v", where, err)
+				break
+			}
+			continue
+		}
+
+		if !isAsync {
+			res.DocIds = append(res.DocIds, docId)
 		} else {
-			if !hasCb {
-				docIds = append(docIds, docId)
+			j.progress(true)
+		}
+		if opts.OnIndexed != nil {
+			opts.OnIndexed(doc.mark)
+		}
+		count += 1
+		if len(pc.changes) >= importCommitDocs {
+			// 分批提交，不在内存中积累整个导入的变更
+			if err := idx.commitChanges(pc); err != nil {
+				res.Aborted = err
+				break
 			}
-			count += 1
 		}
 	}
 
 	if count > 0 {
-		idx.flush()
-	}
-	log.Printf("[info] %d docs appended to index %s\n", count, idx.schema.Name)
-
-	if hasCb {
-		params := func() map[string]interface{} {
-			if hasError {
-				return map[string]interface{}{
-					"code": http.StatusInternalServerError,
-					"msg": "failed to index docs",
-					"index": idx.schema.Name,
-					"docs": count,
-				}
+		if err := idx.commitChanges(pc); err != nil && res.Aborted == nil {
+			res.Aborted = err
+		}
+		idx.afterWrite(opts.Refresh)
+	}
+	committed()
+	log.Printf("[info] %d docs appended to index %s, %d dropped\n", count, idx.schema.Name, res.Dropped)
+
+	if !isAsync {
+		return res
+	}
+	j.finish(res.Aborted)
+
+	if opts.Cb != "" {
+		params := map[string]interface{}{
+			"code": http.StatusOK,
+			"msg": "OK",
+			"index": idx.schema.Name,
+			"job": j.status.Id,
+			"docs": count,
+			"failed": res.Failed,
+			"dropped": res.Dropped,
+		}
+		if res.Failed > 0 {
+			params["code"] = http.StatusInternalServerError
+			if res.Aborted != nil {
+				params["msg"] = res.Aborted.Error()
+			} else {
+				params["msg"] = fmt.Sprintf("%d of %d docs failed to index", res.Failed, pos)
 			}
-			return map[string]interface{}{
-				"code": http.StatusOK,
-				"msg": "OK",
-				"index": idx.schema.Name,
-				"docs": count,
+			// 回调中的出错doc数由conf.ServiceConf.Callback.MaxErrors限制
+			errors, truncated := res.Errors, res.ErrorsTruncated
+			if maxErrors := conf.ServiceConf.Callback.MaxErrors; maxErrors > 0 && len(errors) > maxErrors {
+				errors, truncated = errors[:maxErrors], true
 			}
-		}()
-
-		status, content, _, err := gnet.JSON(cb[0], gnet.Params(params))
-		if err != nil {
-			log.Printf("failed to send callback to %s: %d\n", cb[0], status)
-		} else {
-			log.Printf("send to callback to %s OK: %s\n", cb[0], string(content))
+			params["errors"] = errors
+			params["errors-truncated"] = truncated
 		}
+		idx.sendCallback(opts.Cb, j, params)
 	}
-	return
+	return res
 }
 
 //给每个token加上位置信息，同时生成某个字段内的索引
@@ -340,17 +643,112 @@ func mergeTokenLocs(pTokens *[]types.TokenData) int {
 	return count
 }
 
-func (idx *indexer) deleteDoc(docId string) {
-	indexerChan <- &indexerOp{
+// r, pc: 同putDoc
+func (idx *indexer) deleteDoc(docId string, r *queueReservation, pc *pendingChanges) (err error) {
+	if idx, err = idx.beginWrite(); err != nil {
+		return err
+	}
+	defer idx.writeLock.RUnlock()
+	idx.walLock.Lock()
+	if idx.wal != nil {
+		if err := idx.wal.append(_DELETE_DOC, docId, nil); err != nil {
+			idx.walLock.Unlock()
+			return err
+		}
+	}
+	idx.enqueueOp(&indexerOp{
 		op:     _DELETE_DOC,
 		engine: idx.engine,
 		docId:  docId,
+		force:  idx.refreshEachWrite(),
+	}, r)
+	idx.removeTerms(docId)
+	idx.walLock.Unlock()
+	pc.add(CHANGE_DELETE, docId, nil)
+	return nil
+}
+
+// 开始一个更新，返回持有writeLock读锁的indexer，更新放入队列后释放。
+// 索引库已经关闭(做快照、恢复、被LRU回收)时使用重新加载的indexer，暂停期间initIndexer会等到恢复
+func (idx *indexer) beginWrite() (*indexer, error) {
+	for {
+		idx.writeLock.RLock()
+		if !idx.closed {
+			return idx, nil
+		}
+		idx.writeLock.RUnlock()
+		nidx, err := initIndexer(idx.schema.Name)
+		if err != nil {
+			return nil, err
+		}
+		idx = nidx
 	}
 }
 
-func (idx *indexer) flush() {
-	indexerChan <- &indexerOp{
+// 返回正在使用的indexer: 已经关闭时是重新加载的indexer，还没有重新加载时为nil
+func (idx *indexer) current() *indexer {
+	idx.writeLock.RLock()
+	closed := idx.closed
+	idx.writeLock.RUnlock()
+	if !closed {
+		return idx
+	}
+	indexerLock.RLock()
+	defer indexerLock.RUnlock()
+	return indexers[idx.schema.Name]
+}
+
+// 标记为已经关闭，等待正在进行的更新放入队列后刷新，返回刷新完成的通知。
+// 关闭后的flush等这次刷新完成后通知，因为之前的更新都会在这次刷新中写入
+func (idx *indexer) shutdown() chan struct{} {
+	idx.writeLock.Lock()
+	defer idx.writeLock.Unlock()
+	idx.closed = true
+	idx.shutdownDone = idx.drain()
+	return idx.shutdownDone
+}
+
+// 刷新所有已经放入队列的更新，通知等待刷新的写操作
+func (idx *indexer) drain() chan struct{} {
+	idx.refreshLock.Lock()
+	waiters := idx.waiters
+	idx.waiters, idx.dirty, idx.lastRefresh = nil, false, time.Now()
+	idx.refreshLock.Unlock()
+
+	done := make(chan struct{})
+	idx.enqueueFlush(append(waiters, done)...)
+	return done
+}
+
+// 刷新索引，使更新可以被搜到。waiters在刷新完成后被关闭
+func (idx *indexer) flush(waiters ...chan struct{}) {
+	idx.writeLock.RLock()
+	closed, shutdownDone := idx.closed, idx.shutdownDone
+	if !closed {
+		idx.enqueueFlush(waiters...)
+	}
+	idx.writeLock.RUnlock()
+	if closed {
+		<-shutdownDone
+		for _, w := range waiters {
+			close(w)
+		}
+	}
+}
+
+func (idx *indexer) enqueueFlush(waiters ...chan struct{}) {
+	op := &indexerOp{
 		op:     _FLUSH_DOC,
 		engine: idx.engine,
+		walSeq: -1,
+		waiters: waiters,
+	}
+	// 换段和放入队列之间不能有其它更新，否则flush会删除含有还没有处理的更新的段
+	idx.walLock.Lock()
+	defer idx.walLock.Unlock()
+	if idx.wal != nil && len(conf.UseStore) > 0 {
+		// 持久化时flush后可以删除已经写满的WAL段
+		op.wal, op.walSeq = idx.wal, idx.wal.rotate()
 	}
+	idx.enqueueOp(op, nil)
 }
@@ -0,0 +1,51 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+)
+
+// 导出所有满足q、fq、f条件的doc，不分页，时间字段会被格式化
+//   fl: 输出字段列表，多个字段名用','分割，空串表示输出全部字段
+// 返回输出的字段列表(fl为空时为schema中的全部字段)和doc。调用方需要读完docs，
+// 或者取消ctx(如客户端断开)，这时docs很快被关闭
+func Export(ctx context.Context, index, q, fq, f, fl string) (fields []string, docs <-chan StoredDoc, err error) {
+	if !running {
+		return nil, nil, fmt.Errorf("the service is stopped")
+	}
+
+	idx, err := initIndexer(index)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	schema := idx.schema
+	outFieldList := parseFl(fl)
+	for _, fn := range outFieldList {
+		if _, ok := schema.FieldMap[fn]; !ok {
+			return nil, nil, fmt.Errorf("out field %s not found", fn)
+		}
+	}
+	if outFieldList == nil {
+		fields = make([]string, len(schema.Fields))
+		for i := range schema.Fields {
+			fields[i] = schema.Fields[i].Name
+		}
+	} else {
+		fields = outFieldList
+	}
+
+	matched, err := idx.queryAll(ctx, q, fq, f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	docsCh := make(chan StoredDoc)
+	go func() {
+		defer close(docsCh)
+		for d := range matched {
+			docsCh <- idx.formatStoredDoc(d.doc, outFieldList)
+		}
+	}()
+	return fields, docsCh, nil
+}
@@ -0,0 +1,319 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"path"
+	"time"
+	"fmt"
+	"log"
+	"os"
+)
+
+// inbox目录下的子目录：
+//   processing: 正在导入的文件。已经持久保存的doc数定期记录在".<文件名>.offset"中，服务重启后从该位置继续导入
+//   done:       导入成功的文件
+//   failed:     导入失败、被取消或有doc出错的文件，同时有一个"<文件名>.error.json"的报告文件
+const (
+	inboxProcessing = "processing"
+	inboxDone       = "done"
+	inboxFailed     = "failed"
+	inboxReportExt  = ".error.json"
+	inboxOffsetExt  = ".offset"
+)
+
+// processing目录中的文件已经提交的位置
+//   服务正常停止时记录到停止的位置，每个doc只导入一次；
+//   进程崩溃时最后一次记录之后的doc(最多importCommitDocs个)会按主键再写一次
+type inboxOffset struct {
+	Pos    int `json:"pos"`    // 已经处理的doc数，包括出错和被丢弃的doc
+	Docs   int `json:"docs"`   // 其中成功导入的doc数
+	Failed int `json:"failed"` // 其中出错的doc数
+}
+
+func inboxOffsetPath(inbox, name string) string {
+	return path.Join(inbox, inboxProcessing, "." + name + inboxOffsetExt)
+}
+
+func loadInboxOffset(inbox, name string) *inboxOffset {
+	offset := &inboxOffset{}
+	if b, err := ioutil.ReadFile(inboxOffsetPath(inbox, name)); err == nil {
+		if err = json.Unmarshal(b, offset); err != nil {
+			log.Printf("[error] inbox: bad offset of %s: %v\n", name, err)
+			return &inboxOffset{}
+		}
+	}
+	return offset
+}
+
+// 先写临时文件再改名，崩溃时不会留下不完整的记录
+func saveInboxOffset(inbox, name string, offset *inboxOffset) error {
+	b, err := json.Marshal(offset)
+	if err != nil {
+		return err
+	}
+	p := inboxOffsetPath(inbox, name)
+	tmp := p + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// inbox导入的报告
+type inboxReport struct {
+	File            string     `json:"file"`
+	Index           string     `json:"index"`
+	Job             string     `json:"job,omitempty"`
+	Time            time.Time  `json:"time"`
+	Error           string     `json:"error,omitempty"` // 导入停止的原因
+	Docs            int        `json:"docs"`            // 成功导入的doc数
+	Failed          int        `json:"failed"`          // 出错的doc数
+	Errors          []DocError `json:"errors,omitempty"`
+	ErrorsTruncated bool       `json:"errors-truncated,omitempty"`
+}
+
+var (
+	inboxStopChan    chan struct{}
+	inboxStoppedChan chan struct{}
+)
+
+func startInbox() {
+	if conf.ServiceConf.Inbox.Disabled {
+		return
+	}
+	inboxStopChan = make(chan struct{})
+	inboxStoppedChan = make(chan struct{})
+	go inboxThread()
+}
+
+func stopInbox() {
+	if inboxStopChan == nil {
+		return
+	}
+	close(inboxStopChan)
+	<-inboxStoppedChan
+}
+
+func inboxStopped() bool {
+	select {
+	case <-inboxStopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// 定期检查所有索引库的inbox目录，逐个导入其中的文件
+func inboxThread() {
+	defer close(inboxStoppedChan)
+
+	interval := time.Duration(conf.ServiceConf.Inbox.PollSeconds) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		indexes, err := conf.ListIndexes()
+		if err != nil {
+			log.Printf("[error] inbox: %v\n", err)
+		}
+		for _, index := range indexes {
+			if inboxStopped() {
+				return
+			}
+			scanInbox(index, interval)
+		}
+
+		select {
+		case <-inboxStopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func scanInbox(index string, settleTime time.Duration) {
+	schema, err := conf.LoadSchema(index)
+	if err != nil {
+		return
+	}
+	inbox := schema.InboxPath()
+	for _, d := range []string{inboxProcessing, inboxDone, inboxFailed} {
+		if err = os.MkdirAll(path.Join(inbox, d), 0755); err != nil {
+			log.Printf("[error] inbox of %s: %v\n", index, err)
+			return
+		}
+	}
+
+	// 先导入上次没有导入完的文件
+	processing := path.Join(inbox, inboxProcessing)
+	if files, err := ioutil.ReadDir(processing); err == nil {
+		for _, fi := range files {
+			if inboxStopped() {
+				return
+			}
+			if fi.Mode().IsRegular() && !isPartialFile(fi.Name()) {
+				importInboxFile(index, inbox, fi.Name())
+			}
+		}
+	}
+
+	files, err := ioutil.ReadDir(inbox)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, fi := range files {
+		if inboxStopped() {
+			return
+		}
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || isPartialFile(name) {
+			continue
+		}
+		if now.Sub(fi.ModTime()) < settleTime {
+			// 可能还在写入，下次再导入
+			continue
+		}
+
+		// 移到processing目录，保证一个文件只被导入一次
+		if err := os.Rename(path.Join(inbox, name), path.Join(processing, name)); err != nil {
+			log.Printf("[error] inbox of %s: failed to claim %s: %v\n", index, name, err)
+			continue
+		}
+		importInboxFile(index, inbox, name)
+	}
+}
+
+// 隐藏文件和临时文件不导入，写入方应该先写临时文件，写完后再改名
+func isPartialFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+	switch path.Ext(name) {
+	case ".tmp", ".part", ".partial":
+		return true
+	}
+	return false
+}
+
+// 导入processing目录中的一个文件，结束后移到done或failed目录
+func importInboxFile(index, inbox, name string) {
+	file := path.Join(inbox, inboxProcessing, name)
+	report := &inboxReport{File: name, Index: index}
+	log.Printf("[info] inbox of %s: importing %s\n", index, name)
+
+	ext, compression := SplitCompressedExt(name)
+	indexReader, ok := IndexReaderOfExt(ext)
+	if !ok {
+		report.Error = "unsupported file type"
+		finishInboxFile(inbox, name, report)
+		return
+	}
+
+	fp, err := os.Open(file)
+	if err != nil {
+		report.Error = err.Error()
+		finishInboxFile(inbox, name, report)
+		return
+	}
+
+	type importDone struct {
+		jobId string
+		res   *ImportResult
+	}
+	doneChan := make(chan importDone, 1)
+	prev := loadInboxOffset(inbox, name)
+	if prev.Pos > 0 {
+		log.Printf("[info] inbox of %s: resuming %s after %d docs\n", index, name, prev.Pos)
+	}
+	opts := &ImportOpts{
+		Async: true,
+		Compression: compression,
+		Source: file,
+		OnDone: func(jobId string, res *ImportResult) {
+			doneChan <- importDone{jobId, res}
+		},
+		Skip: prev.Pos,
+		OnCommitted: func(pos, docs, failed int) {
+			offset := &inboxOffset{Pos: pos, Docs: prev.Docs + docs, Failed: prev.Failed + failed}
+			if err := saveInboxOffset(inbox, name, offset); err != nil {
+				log.Printf("[error] inbox of %s: failed to save offset of %s: %v\n", index, name, err)
+			}
+		},
+	}
+	_, jobId, err := indexReader(index, fp, opts)
+	if err != nil {
+		report.Error = err.Error()
+		finishInboxFile(inbox, name, report)
+		return
+	}
+
+	var done importDone
+	select {
+	case done = <-doneChan:
+	case <-inboxStopChan:
+		// 服务停止，取消导入，文件和导入的位置留在processing目录，重启后继续导入
+		CancelJob(jobId)
+		<-doneChan
+		log.Printf("[info] inbox of %s: importing %s interrupted\n", index, name)
+		return
+	}
+
+	res := done.res
+	report.Job = done.jobId
+	cancelled := false
+	report.Docs = prev.Docs
+	if status, err := GetJob(done.jobId); err == nil {
+		report.Docs += status.Succeeded
+		cancelled = status.State == JOB_CANCELLED
+	}
+	report.Failed = prev.Failed + res.Failed
+	report.Errors = res.Errors
+	report.ErrorsTruncated = res.ErrorsTruncated
+	if res.Aborted != nil {
+		report.Error = res.Aborted.Error()
+	}
+	if cancelled {
+		// 通过DELETE /jobs/:id取消的导入没有导入完，移到failed目录
+		report.Error = "import cancelled"
+	}
+	finishInboxFile(inbox, name, report)
+}
+
+// 把导入结束的文件移到done目录；有错误时移到failed目录，并生成报告文件
+func finishInboxFile(inbox, name string, report *inboxReport) {
+	report.Time = time.Now()
+	src := path.Join(inbox, inboxProcessing, name)
+	defer os.Remove(inboxOffsetPath(inbox, name))
+
+	if report.Error == "" && report.Failed == 0 {
+		dest := uniqueFile(path.Join(inbox, inboxDone), name)
+		if err := os.Rename(src, dest); err != nil {
+			log.Printf("[error] inbox of %s: %v\n", report.Index, err)
+		}
+		log.Printf("[info] inbox of %s: %s imported, %d docs\n", report.Index, name, report.Docs)
+		return
+	}
+
+	dest := uniqueFile(path.Join(inbox, inboxFailed), name)
+	b, _ := json.MarshalIndent(report, "", "  ")
+	if err := ioutil.WriteFile(dest + inboxReportExt, b, 0644); err != nil {
+		log.Printf("[error] inbox of %s: %v\n", report.Index, err)
+	}
+	if err := os.Rename(src, dest); err != nil {
+		log.Printf("[error] inbox of %s: %v\n", report.Index, err)
+	}
+	log.Printf("[error] inbox of %s: %s imported with errors, %d docs, %d failed: %s\n", report.Index, name, report.Docs, report.Failed, report.Error)
+}
+
+// 目标目录中已经有同名文件时，在文件名前加上时间
+func uniqueFile(dir, name string) string {
+	dest := path.Join(dir, name)
+	if _, err := os.Stat(dest); err != nil {
+		return dest
+	}
+	return path.Join(dir, fmt.Sprintf("%s-%s", time.Now().Format("20060102150405.000"), name))
+}
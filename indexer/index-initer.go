@@ -11,10 +11,26 @@ import (
 )
 
 // 初始化/获取索引库
+//   同一个索引库同时只有一个加载，其它的等加载完成后再获取，避免重复打开engine、重放WAL
 func initIndexer(index string) (*indexer, error) {
-	indexerLock.RLock()
+	indexerLock.Lock()
 	idx, ok := indexers[index]
-	indexerLock.RUnlock()
+	paused := pausedIndexers[index]
+	loading := loadingIndexers[index]
+	if !ok && paused == nil && loading == nil {
+		loadingIndexers[index] = make(chan struct{})
+	}
+	indexerLock.Unlock()
+
+	if paused != nil {
+		// 正在做快照或恢复，等待结束
+		<-paused
+		return initIndexer(index)
+	}
+	if loading != nil {
+		<-loading
+		return initIndexer(index)
+	}
 
 	if ok {
 		log.Printf("[LRU] index %s (existing) added to LRU\n", index)
@@ -22,14 +38,31 @@ func initIndexer(index string) (*indexer, error) {
 		return idx, nil
 	}
 
+	idx, err := loadIndexer(index)
+
+	indexerLock.Lock()
+	defer indexerLock.Unlock()
+	if err == nil {
+		// 重放WAL完成后才能被其它的调用获取
+		indexers[index] = idx
+	}
+	close(loadingIndexers[index])
+	delete(loadingIndexers, index)
+	return idx, err
+}
+
+// 加载索引库，重放WAL
+func loadIndexer(index string) (*indexer, error) {
 	schema, err := conf.LoadSchema(index)
 	if err != nil {
 		return nil, fmt.Errorf("schema of %s not found, please create schema first", index)
 	}
 
 	gob.Register(StoredDoc{})
+	gob.Register([]interface{}{})          // 多值字段
+	gob.Register(map[string]interface{}{}) // json字段
 	engine := &riot.Engine{}
-	idx = &indexer{schema:schema, engine:engine}
+	idx := &indexer{schema:schema, engine:engine, refreshInterval:schema.RefreshDuration(), lastRefresh:time.Now()}
 	initOpts := types.EngineOpts{
 		UseStore:    len(conf.UseStore) > 0,
 		NotUseGse:   true,
@@ -56,14 +89,14 @@ func initIndexer(index string) (*indexer, error) {
 	//	initOpts.NotUseGse = true
 	//}
 	engine.Init(initOpts)
+	if idx.wal, err = idx.recoverWal(); err != nil {
+		log.Printf("[error] failed to recover wal of index %s: %v\n", index, err)
+		engine.Close()
+		return nil, fmt.Errorf("failed to recover wal of %s: %v", index, err)
+	}
 	engine.Flush()
 	log.Printf("[LRU] index %s (new) added to LRU\n", index)
 	lruAdd(index)
-
-	indexerLock.Lock()
-	defer indexerLock.Unlock()
-
-	indexers[index] = idx
 	return idx, nil
 }
 
@@ -80,11 +113,60 @@ func RemoveIndexer(index string) {
 	delete(indexers, index)
 	indexerLock.Unlock()
 
+	// 刷新还没有刷新的更新，通知等待刷新的写操作，之后的更新使用重新加载的indexer
+	idx.shutdown()
+	unloadQueue(index)
+	if idx.wal != nil {
+		idx.wal.close()
+	}
 	go func() {
 		idx.engine.Close()
 	}()
 }
 
+// 暂停使用索引库，直到调用返回的resume。暂停期间initIndexer会等待，
+// 已经关闭的indexer上的更新也会等待(见beginWrite)
+func pauseIndexer(index string) (resume func(), err error) {
+	indexerLock.Lock()
+	defer indexerLock.Unlock()
+
+	// 等正在进行的加载完成，之后由调用方关闭加载的indexer
+	for loading := loadingIndexers[index]; loading != nil; loading = loadingIndexers[index] {
+		indexerLock.Unlock()
+		<-loading
+		indexerLock.Lock()
+	}
+	if _, ok := pausedIndexers[index]; ok {
+		return nil, fmt.Errorf("index %s is busy with snapshot or restore", index)
+	}
+	paused := make(chan struct{})
+	pausedIndexers[index] = paused
+	return func() {
+		indexerLock.Lock()
+		delete(pausedIndexers, index)
+		indexerLock.Unlock()
+		close(paused)
+	}, nil
+}
+
+// 关闭索引库，与RemoveIndexer不同，等待所有更新写入后才返回
+func closeIndexer(index string) {
+	indexerLock.Lock()
+	idx, ok := indexers[index]
+	delete(indexers, index)
+	indexerLock.Unlock()
+
+	if !ok {
+		return
+	}
+	<-idx.shutdown()
+	unloadQueue(index)
+	if idx.wal != nil {
+		idx.wal.close()
+	}
+	idx.engine.Close()
+}
+
 // -------------------------------------
 
 const (
@@ -98,19 +180,24 @@ type indexerOp struct {
 	engine *riot.Engine
 	docId   string
 	doc    *types.DocData
+	force   bool // 是否强制更新索引，不强制时要等到flush后才能搜到
+	wal    *wal  // _FLUSH_DOC: flush后删除序号不大于walSeq的WAL段
+	walSeq  int64
+	waiters []chan struct{} // _FLUSH_DOC: flush后通知
+	queue  *opQueue // 取出该操作的队列
 }
 
 var (
-	indexerChan chan *indexerOp
 	stopChan chan struct{}
 	running bool
 	lruTicker *time.Ticker
 )
 
 func StartIndexers(workNum int) {
-	indexerChan = make(chan *indexerOp, workNum)
+	startQueues()
 	stopChan = make(chan struct{})
 	running = true
+	loadJobs()
 	for i:=0; i<workNum; i++ {
 		go opThread(i)
 	}
@@ -119,6 +206,13 @@ func StartIndexers(workNum int) {
 		lruTicker = time.NewTicker(time.Duration(conf.ServiceConf.LruMinutes) * time.Minute)
 		go lruThread()
 	}
+
+	startWalSync()
+	startRefresher()
+	startTTLSweeper()
+	startInbox()
+	startSources()
+	startWebhooks()
 }
 
 func IsRunning() bool {
@@ -130,8 +224,14 @@ func StopIndexers(workNum int) {
 		return
 	}
 
+	// inbox、source正在进行的导入和过期doc的清除需要在停止队列前停止
+	stopWebhooks()
+	stopInbox()
+	stopSources()
+	stopTTLSweeper()
 	running = false
-	close(indexerChan)
+	stopRefresher()
+	stopQueues()
 	if conf.ServiceConf.LruMinutes > 0 {
 		lruTicker.Stop()
 	}
@@ -143,20 +243,31 @@ func StopIndexers(workNum int) {
 	for name, idx := range indexers {
 		log.Printf("stopping index %s ...\n", name)
 		idx.engine.Close()
+		if idx.wal != nil {
+			idx.wal.close()
+		}
 	}
+	stopWalSync()
 }
 
 func opThread(workNo int) {
-	for opData := range indexerChan {
+	for opData := dequeueOp(); opData != nil; opData = dequeueOp() {
 		op, engine, docId, doc := opData.op, opData.engine, opData.docId, opData.doc
 		switch op {
 		case _INDEX_DOC:
-			engine.IndexDoc(docId, *doc, true)
+			engine.IndexDoc(docId, *doc, opData.force)
 		case _DELETE_DOC:
-			engine.RemoveDoc(docId, true)
+			engine.RemoveDoc(docId, opData.force)
 		case _FLUSH_DOC:
 			engine.Flush()
+			if opData.wal != nil && opData.walSeq >= 0 {
+				opData.wal.truncate(opData.walSeq)
+			}
+			for _, done := range opData.waiters {
+				close(done)
+			}
 		}
+		opDone(opData)
 	}
 
 	stopChan <-struct{}{}
@@ -0,0 +1,306 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"strconv"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"fmt"
+	"log"
+	"os"
+)
+
+// job状态
+const (
+	JOB_RUNNING     = "running"
+	JOB_DONE        = "done"
+	JOB_FAILED      = "failed"
+	JOB_CANCELLED   = "cancelled"
+	JOB_INTERRUPTED = "interrupted" // 服务重启时还没有结束的job
+)
+
+const (
+	jobsDir = "_jobs"
+	jobSaveInterval = time.Second // 进度保存的最小间隔
+)
+
+// job状态信息
+type JobStatus struct {
+	Id        string     `json:"id"`
+	Type      string     `json:"type"`
+	Index     string     `json:"index"`
+	Source    string     `json:"source,omitempty"` // 导入内容的来源，如inbox中的文件
+	State     string     `json:"state"`
+	Processed int        `json:"processed"` // 已处理的doc数
+	Succeeded int        `json:"succeeded"` // 成功处理的doc数
+	Failed    int        `json:"failed"`    // 处理失败的doc数
+	Error     string     `json:"error,omitempty"`
+	StartTime time.Time  `json:"start-time"`
+	EndTime   *time.Time `json:"end-time,omitempty"`
+	Elapsed   float64    `json:"elapsed"` // 耗时，单位秒
+}
+
+// 后台运行的任务，如异步导入
+type job struct {
+	status     JobStatus
+	lock       sync.Mutex
+	cancelChan chan struct{}
+	savedTime  time.Time
+	saveLock   sync.Mutex // 保证同一个job的文件一次只有一个写
+}
+
+var (
+	jobs     = map[string]*job{} // job id => job
+	jobsLock = &sync.RWMutex{}
+	jobSeq   uint32
+)
+
+// 创建一个job
+//   jobType: job类型，如"import"
+//   index:   索引库名
+func newJob(jobType, index string) *job {
+	now := time.Now()
+	jobsLock.Lock()
+	jobSeq += 1
+	id := fmt.Sprintf("%s%s", strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 36), strconv.FormatUint(uint64(jobSeq), 36))
+	j := &job{
+		status: JobStatus{
+			Id: id,
+			Type: jobType,
+			Index: index,
+			State: JOB_RUNNING,
+			StartTime: now,
+		},
+		cancelChan: make(chan struct{}),
+	}
+	jobs[id] = j
+	jobsLock.Unlock()
+
+	j.save()
+	return j
+}
+
+// 记录一个doc的处理结果
+func (j *job) progress(ok bool) {
+	j.lock.Lock()
+	j.status.Processed += 1
+	if ok {
+		j.status.Succeeded += 1
+	} else {
+		j.status.Failed += 1
+	}
+	needSave := time.Since(j.savedTime) >= jobSaveInterval
+	j.lock.Unlock()
+
+	if needSave {
+		j.save()
+	}
+}
+
+// 是否已经被取消
+func (j *job) isCancelled() bool {
+	select {
+	case <-j.cancelChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// job结束
+func (j *job) finish(err error) {
+	j.lock.Lock()
+	now := time.Now()
+	j.status.EndTime = &now
+	switch {
+	case j.isCancelled():
+		j.status.State = JOB_CANCELLED
+	case err != nil:
+		j.status.State = JOB_FAILED
+		j.status.Error = err.Error()
+	default:
+		j.status.State = JOB_DONE
+	}
+	j.lock.Unlock()
+
+	j.save()
+	pruneJobs()
+}
+
+// 获取job状态的拷贝
+func (j *job) getStatus() JobStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	status := j.status
+	if status.EndTime != nil {
+		status.Elapsed = status.EndTime.Sub(status.StartTime).Seconds()
+	} else if status.State == JOB_RUNNING {
+		status.Elapsed = time.Since(status.StartTime).Seconds()
+	}
+	return status
+}
+
+// 把job状态保存到文件，服务重启后可以查看。先写临时文件再改名，崩溃时不会留下不完整的文件
+func (j *job) save() {
+	j.saveLock.Lock()
+	defer j.saveLock.Unlock()
+
+	status := j.getStatus()
+
+	j.lock.Lock()
+	j.savedTime = time.Now()
+	j.lock.Unlock()
+
+	b, err := json.Marshal(&status)
+	if err != nil {
+		return
+	}
+	p := jobFile(status.Id)
+	tmp := p + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		log.Printf("[error] failed to save job %s: %v\n", status.Id, err)
+	}
+}
+
+func jobFile(id string) string {
+	return path.Join(conf.ServiceConf.RootDir, jobsDir, fmt.Sprintf("%s.json", id))
+}
+
+// 获取job状态
+func GetJob(id string) (*JobStatus, error) {
+	jobsLock.RLock()
+	j, ok := jobs[id]
+	jobsLock.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	status := j.getStatus()
+	return &status, nil
+}
+
+// 列出所有job
+//   index: 索引库名，空串表示所有索引库
+func ListJobs(index string) []JobStatus {
+	jobsLock.RLock()
+	defer jobsLock.RUnlock()
+
+	res := []JobStatus{}
+	for _, j := range jobs {
+		status := j.getStatus()
+		if index != "" && status.Index != index {
+			continue
+		}
+		res = append(res, status)
+	}
+	return res
+}
+
+// 取消一个正在执行的job；如果job已经结束，则删除job记录
+func CancelJob(id string) (*JobStatus, error) {
+	jobsLock.Lock()
+	j, ok := jobs[id]
+	if !ok {
+		jobsLock.Unlock()
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+
+	j.lock.Lock()
+	running := j.status.State == JOB_RUNNING
+	if running && !j.isCancelled() {
+		close(j.cancelChan)
+	}
+	j.lock.Unlock()
+
+	if !running {
+		delete(jobs, id)
+		os.Remove(jobFile(id))
+	}
+	jobsLock.Unlock()
+
+	status := j.getStatus()
+	return &status, nil
+}
+
+// 删除超过保留时间或超过保留个数的已经结束的job记录，先删除最早结束的
+func pruneJobs() {
+	maxAge := time.Duration(conf.ServiceConf.Jobs.MaxAgeHours) * time.Hour
+	maxFinished := conf.ServiceConf.Jobs.MaxFinished
+
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	finished := []JobStatus{}
+	for _, j := range jobs {
+		if status := j.getStatus(); status.EndTime != nil {
+			finished = append(finished, status)
+		}
+	}
+	sort.Slice(finished, func(i, k int) bool {
+		return finished[i].EndTime.Before(*finished[k].EndTime)
+	})
+	now := time.Now()
+	for i, status := range finished {
+		if (maxAge <= 0 || now.Sub(*status.EndTime) <= maxAge) && (maxFinished <= 0 || len(finished)-i <= maxFinished) {
+			break
+		}
+		delete(jobs, status.Id)
+		os.Remove(jobFile(status.Id))
+	}
+}
+
+// 服务启动时加载job记录，没有结束的job标记为interrupted
+func loadJobs() {
+	d := path.Join(conf.ServiceConf.RootDir, jobsDir)
+	if err := os.MkdirAll(d, 0755); err != nil {
+		log.Printf("[error] failed to create %s: %v\n", d, err)
+		return
+	}
+
+	files, err := ioutil.ReadDir(d)
+	if err != nil {
+		return
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(fi.Name(), ".tmp") {
+			// 保存时崩溃留下的临时文件
+			os.Remove(path.Join(d, fi.Name()))
+			continue
+		}
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(path.Join(d, fi.Name()))
+		if err != nil {
+			continue
+		}
+		j := &job{cancelChan: make(chan struct{})}
+		if err = json.Unmarshal(b, &j.status); err != nil || j.status.Id == "" {
+			continue
+		}
+		close(j.cancelChan)
+
+		jobs[j.status.Id] = j
+		if j.status.State == JOB_RUNNING {
+			// 结束时间取最后一次保存的时间，按保留时间删除
+			endTime := fi.ModTime()
+			j.status.State = JOB_INTERRUPTED
+			j.status.EndTime = &endTime
+			j.save()
+			log.Printf("[info] job %s on index %s was interrupted\n", j.status.Id, j.status.Index)
+		}
+	}
+	pruneJobs()
+}
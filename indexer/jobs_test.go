@@ -0,0 +1,67 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"io/ioutil"
+	"testing"
+	"time"
+	"os"
+)
+
+func TestJobRetention(t *testing.T) {
+	conf.ServiceConf.RootDir = t.TempDir()
+	conf.ServiceConf.Jobs.MaxAgeHours = 1
+	conf.ServiceConf.Jobs.MaxFinished = 3
+	defer func() {
+		conf.ServiceConf.Jobs.MaxAgeHours = 0
+		conf.ServiceConf.Jobs.MaxFinished = 0
+	}()
+	jobsLock.Lock()
+	jobs = map[string]*job{}
+	jobsLock.Unlock()
+	loadJobs()
+
+	// 保存时崩溃留下的临时文件在加载时删除
+	tmp := jobFile("crashed") + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(`{"id":"cra`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := newJob("import", "jobs")
+	old.finish(nil)
+	old.lock.Lock()
+	endTime := time.Now().Add(-2*time.Hour)
+	old.status.EndTime = &endTime
+	old.lock.Unlock()
+	old.save()
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		j := newJob("import", "jobs")
+		ids = append(ids, j.status.Id)
+		j.finish(nil)
+	}
+	running := newJob("import", "jobs")
+	running.save()
+
+	// 超过保留时间的和最早结束的超过个数的被删除，重启后没有结束的job标记为interrupted，按最后保存的时间计算
+	jobsLock.Lock()
+	jobs = map[string]*job{}
+	jobsLock.Unlock()
+	loadJobs()
+	for _, id := range []string{old.status.Id, ids[0]} {
+		if _, err := GetJob(id); err == nil {
+			t.Fatalf("job %s should be pruned", id)
+		}
+		if _, err := os.Stat(jobFile(id)); !os.IsNotExist(err) {
+			t.Fatalf("file of job %s should be removed", id)
+		}
+	}
+	for _, id := range []string{ids[1], ids[2], running.status.Id} {
+		if _, err := GetJob(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("%s should be removed", tmp)
+	}
+}
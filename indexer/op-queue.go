@@ -0,0 +1,338 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"sync"
+	"fmt"
+)
+
+// 每个索引库一个更新操作队列，opThread按权重轮流从各个队列取操作，
+// 避免一个索引库的大批量导入阻塞其它索引库的更新。
+//   - 单个doc的更新先用tryEnqueue预留位置，队列满时立即返回QueueFullError，由调用方返回429
+//   - 批量导入在队列满时等待(预留的位置也算满)，导入速度受索引速度限制
+//   - flush操作不占用队列容量，不等待
+//   - 索引库被关闭(LRU回收、删除schema等)后，队列空了就删除
+//   - 同一个索引库不同doc的更新可以由多个opThread同时处理；同一个doc的更新按放入的顺序一个一个处理
+//   - flush等之前取出的操作都处理完后才处理，flush处理完之前不取之后的操作。
+//     flush时之前的更新都已经交给了engine，才能删除WAL段
+type opQueue struct {
+	index     string
+	ops       []*indexerOp
+	running   map[string]int // docId => 正在处理的操作数
+	inFlight  int  // 正在处理的操作数
+	flushing  bool // 正在处理flush
+	reserved  int  // 预留还没有放入的操作数
+	unloaded  bool // 索引库已经关闭，队列空了后删除
+	weight    int // 每轮最多连续处理的操作数
+	credit    int // 本轮还可以处理的操作数
+	enqueued  uint64
+	processed uint64
+	rejected  uint64
+}
+
+// tryEnqueue预留的队列位置，放入队列时使用，用完后调用release
+type queueReservation struct {
+	q *opQueue
+	n int // 还没有使用的位置
+}
+
+// 队列满的错误
+type QueueFullError struct {
+	Index      string
+	RetryAfter int // 建议的重试秒数
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("the indexing queue of %s is full, retry after %d seconds", e.Index, e.RetryAfter)
+}
+
+// 队列的统计信息
+type QueueStats struct {
+	Index     string `json:"index"`
+	Depth     int    `json:"depth"`
+	Capacity  int    `json:"capacity"`
+	Weight    int    `json:"weight"`
+	Enqueued  uint64 `json:"enqueued"`
+	Processed uint64 `json:"processed"`
+	Rejected  uint64 `json:"rejected"`
+}
+
+var (
+	queueLock     sync.Mutex
+	queueNotEmpty = sync.NewCond(&queueLock) // 有新的操作或服务停止
+	queueNotFull  = sync.NewCond(&queueLock) // 有操作被取走
+	queues        = map[string]*opQueue{}
+	queueOrder    []*opQueue // 轮询的顺序
+	nextQueue     int
+	pendingOps    int
+	queueStopping bool
+)
+
+func queueCapacity() int {
+	if c := conf.ServiceConf.Queue.Capacity; c > 0 {
+		return c
+	}
+	return 1000
+}
+
+func (idx *indexer) queueWeight() int {
+	if idx.schema.QueueWeight > 0 {
+		return idx.schema.QueueWeight
+	}
+	return 1
+}
+
+// 获取索引库的队列，需要持有queueLock
+func (idx *indexer) getQueue() *opQueue {
+	name := idx.schema.Name
+	q, ok := queues[name]
+	if !ok {
+		q = &opQueue{index: name}
+		queues[name] = q
+		queueOrder = append(queueOrder, q)
+	}
+	q.unloaded = false
+	if w := idx.queueWeight(); q.weight != w {
+		q.weight, q.credit = w, w
+	}
+	return q
+}
+
+// 为单个doc的更新预留n个位置，不等待，队列满时返回*QueueFullError
+func (idx *indexer) tryEnqueue(n int) (*queueReservation, error) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	q := idx.getQueue()
+	if len(q.ops)+q.reserved+n <= queueCapacity() {
+		q.reserved += n
+		return &queueReservation{q: q, n: n}, nil
+	}
+	q.rejected += 1
+	retryAfter := conf.ServiceConf.Queue.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = 1
+	}
+	return nil, &QueueFullError{Index: q.index, RetryAfter: retryAfter}
+}
+
+// 释放没有用到的预留位置，r可以为nil
+func (r *queueReservation) release() {
+	if r == nil {
+		return
+	}
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	if r.n > 0 {
+		r.q.reserved -= r.n
+		r.n = 0
+		queueNotFull.Broadcast()
+		r.q.pruneIfUnloaded()
+	}
+}
+
+// 把操作放入索引库的队列。使用预留的位置或flush时不等待，否则队列满时等待
+func (idx *indexer) enqueueOp(op *indexerOp, r *queueReservation) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	q := idx.getQueue()
+	if r != nil && r.q != q && r.n > 0 {
+		// 索引库重新加载后换了队列，预留的位置跟着移到新的队列
+		r.q.reserved -= r.n
+		r.q.pruneIfUnloaded()
+		q.reserved += r.n
+		r.q = q
+	}
+	if r != nil && r.n > 0 {
+		r.n -= 1
+		q.reserved -= 1
+	} else if op.op != _FLUSH_DOC {
+		capacity := queueCapacity()
+		for len(q.ops)+q.reserved >= capacity && !queueStopping {
+			queueNotFull.Wait()
+		}
+	}
+	q.ops = append(q.ops, op)
+	q.enqueued += 1
+	pendingOps += 1
+	queueNotEmpty.Signal()
+}
+
+// 按权重轮流从各个队列取一个操作，服务停止且所有队列都空时返回nil
+// 操作处理完后必须调用opDone，之后才能取同一个doc的下一个操作和之后的flush
+func dequeueOp() *indexerOp {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	for {
+		if pendingOps == 0 && queueStopping {
+			return nil
+		}
+		if op := pickOp(); op != nil {
+			return op
+		}
+		queueNotEmpty.Wait()
+	}
+}
+
+// 队列中可以处理的操作的下标，没有时返回-1，需要持有queueLock
+//   - flush在处理时不取任何操作，在队首且没有正在处理的操作时才能取
+//   - 其它操作在同一个doc没有正在处理、前面也没有同一个doc的操作时可以取，不越过flush
+func (q *opQueue) nextRunnable() int {
+	if q.flushing {
+		return -1
+	}
+	var skipped map[string]bool // 前面还不能取的操作的docId
+	for i, op := range q.ops {
+		if op.op == _FLUSH_DOC {
+			if i == 0 && q.inFlight == 0 {
+				return i
+			}
+			return -1
+		}
+		if q.running[op.docId] == 0 && !skipped[op.docId] {
+			return i
+		}
+		if skipped == nil {
+			skipped = map[string]bool{}
+		}
+		skipped[op.docId] = true
+	}
+	return -1
+}
+
+// 取下一个有可以处理的操作的队列中的操作，需要持有queueLock
+func pickOp() *indexerOp {
+	if pendingOps == 0 {
+		return nil
+	}
+	// 跳过的队列会恢复credit，一轮之后有可以处理的操作的队列都可以取
+	for i := 0; i <= len(queueOrder); i++ {
+		q := queueOrder[nextQueue]
+		if j := q.nextRunnable(); j >= 0 && q.credit > 0 {
+			op := q.ops[j]
+			copy(q.ops[j:], q.ops[j+1:])
+			q.ops[len(q.ops)-1] = nil
+			q.ops = q.ops[:len(q.ops)-1]
+			if op.op == _FLUSH_DOC {
+				q.flushing = true
+			} else {
+				if q.running == nil {
+					q.running = map[string]int{}
+				}
+				q.running[op.docId] += 1
+			}
+			q.inFlight += 1
+			op.queue = q
+			pendingOps -= 1
+			if q.credit -= 1; q.credit == 0 || len(q.ops) == 0 {
+				q.credit = q.weight
+				nextQueue = (nextQueue + 1) % len(queueOrder)
+			}
+			queueNotFull.Broadcast()
+			return op
+		}
+		q.credit = q.weight
+		nextQueue = (nextQueue + 1) % len(queueOrder)
+	}
+	return nil
+}
+
+// 操作处理完成，可以处理同一个doc的下一个操作和之后的flush
+func opDone(op *indexerOp) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	q := op.queue
+	if op.op == _FLUSH_DOC {
+		q.flushing = false
+	} else if q.running[op.docId] -= 1; q.running[op.docId] <= 0 {
+		delete(q.running, op.docId)
+	}
+	q.inFlight -= 1
+	q.processed += 1
+	if len(q.ops) > 0 || (pendingOps == 0 && queueStopping) {
+		queueNotEmpty.Broadcast()
+	}
+	q.pruneIfUnloaded()
+}
+
+// 索引库已经关闭，之后队列空了就删除
+func unloadQueue(index string) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	if q, ok := queues[index]; ok {
+		q.unloaded = true
+		q.pruneIfUnloaded()
+	}
+}
+
+// 删除已经关闭的索引库的空队列，需要持有queueLock
+func (q *opQueue) pruneIfUnloaded() {
+	if !q.unloaded || len(q.ops) > 0 || q.inFlight > 0 || q.reserved > 0 {
+		return
+	}
+	delete(queues, q.index)
+	for i, o := range queueOrder {
+		if o != q {
+			continue
+		}
+		queueOrder = append(queueOrder[:i], queueOrder[i+1:]...)
+		if i < nextQueue {
+			nextQueue -= 1
+		}
+		if nextQueue >= len(queueOrder) {
+			nextQueue = 0
+		}
+		break
+	}
+}
+
+func startQueues() {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	queueStopping = false
+}
+
+// 处理完队列中所有的操作后opThread退出
+func stopQueues() {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	queueStopping = true
+	queueNotEmpty.Broadcast()
+	queueNotFull.Broadcast()
+}
+
+// 所有队列的统计信息，只包括已经加载的索引库和还有操作的队列
+func GetQueueStats() []QueueStats {
+	indexerLock.RLock()
+	loaded := make(map[string]bool, len(indexers))
+	for name := range indexers {
+		loaded[name] = true
+	}
+	indexerLock.RUnlock()
+
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	capacity := queueCapacity()
+	stats := []QueueStats{}
+	for _, q := range queueOrder {
+		if !loaded[q.index] && len(q.ops) == 0 {
+			continue
+		}
+		stats = append(stats, QueueStats{
+			Index: q.index,
+			Depth: len(q.ops),
+			Capacity: capacity,
+			Weight: q.weight,
+			Enqueued: q.enqueued,
+			Processed: q.processed,
+			Rejected: q.rejected,
+		})
+	}
+	return stats
+}
@@ -0,0 +1,99 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"testing"
+)
+
+func TestOpQueues(t *testing.T) {
+	conf.ServiceConf.Queue.Capacity = 3
+	defer func() { conf.ServiceConf.Queue.Capacity = 0 }()
+
+	big := &indexer{schema: &conf.Schema{Name: "q-big", SchemaConf: &conf.SchemaConf{QueueWeight: 2}}}
+	small := &indexer{schema: &conf.Schema{Name: "q-small", SchemaConf: &conf.SchemaConf{}}}
+	for i := 0; i < 3; i++ {
+		big.enqueueOp(&indexerOp{docId: "big"}, nil)
+	}
+	small.enqueueOp(&indexerOp{docId: "small"}, nil)
+
+	_, err := big.tryEnqueue(1)
+	if e, ok := err.(*QueueFullError); !ok || e.Index != "q-big" {
+		t.Fatalf("QueueFullError expected, got %v", err)
+	}
+	// q-small预留2个位置后只剩下1个，预留的位置放入时不等待
+	r, err := small.tryEnqueue(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = small.tryEnqueue(1); err == nil {
+		t.Fatalf("QueueFullError expected for reserved slots")
+	}
+	small.enqueueOp(&indexerOp{docId: "small"}, r)
+	r.release()
+	if q := queues["q-small"]; len(q.ops) != 2 || q.reserved != 0 {
+		t.Fatalf("unexpected reservation: %+v", q)
+	}
+
+	// q-big每轮最多处理2个操作
+	order := ""
+	for i := 0; i < 5; i++ {
+		op := dequeueOp()
+		order += op.docId + " "
+		opDone(op)
+	}
+	if order != "big big small big small " {
+		t.Fatalf("unexpected order: %s", order)
+	}
+	if q := queues["q-big"]; len(q.ops) != 0 || q.processed != 3 || q.rejected != 1 {
+		t.Fatalf("unexpected stats: %+v", q)
+	}
+
+	// 同一个索引库不同doc的操作可以同时处理，同一个doc的操作处理完才能取下一个
+	big.enqueueOp(&indexerOp{docId: "big1"}, nil)
+	big.enqueueOp(&indexerOp{docId: "big1", force: true}, nil)
+	big.enqueueOp(&indexerOp{docId: "big2"}, nil)
+	op1 := dequeueOp()
+	op2 := dequeueOp()
+	if op1.docId != "big1" || op1.force || op2.docId != "big2" {
+		t.Fatalf("big1 and big2 expected, got %s, %s", op1.docId, op2.docId)
+	}
+	if op := pickOp(); op != nil {
+		t.Fatalf("the second big1 must wait for the first one, got %s", op.docId)
+	}
+	opDone(op1)
+	op3 := dequeueOp()
+	if op3.docId != "big1" || !op3.force {
+		t.Fatalf("the second big1 expected, got %s", op3.docId)
+	}
+
+	// flush等之前的操作都处理完才能取，flush处理完之前不取之后的操作
+	big.enqueueOp(&indexerOp{op: _FLUSH_DOC}, nil)
+	big.enqueueOp(&indexerOp{docId: "big3"}, nil)
+	if op := pickOp(); op != nil {
+		t.Fatalf("flush must wait for running ops, got %v", op)
+	}
+	opDone(op2)
+	opDone(op3)
+	flush := dequeueOp()
+	if flush.op != _FLUSH_DOC {
+		t.Fatalf("flush expected, got %s", flush.docId)
+	}
+	if op := pickOp(); op != nil {
+		t.Fatalf("big3 must wait for the flush, got %s", op.docId)
+	}
+	opDone(flush)
+	if op := dequeueOp(); op.docId != "big3" {
+		t.Fatalf("big3 expected, got %s", op.docId)
+	} else {
+		opDone(op)
+	}
+
+	// 关闭的索引库的队列空了后删除
+	unloadQueue("q-small")
+	if _, ok := queues["q-small"]; ok {
+		t.Fatalf("queue of q-small should be removed")
+	}
+	if len(queueOrder) != 1 || queueOrder[0].index != "q-big" {
+		t.Fatalf("unexpected queue order: %v", queueOrder)
+	}
+}
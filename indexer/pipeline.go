@@ -0,0 +1,492 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"regexp"
+	"html"
+	"path"
+	"time"
+	"fmt"
+	"os"
+)
+
+const (
+	pipelinesDir = "_pipelines"
+
+	// ?pipeline=_none 表示不使用schema中指定的pipeline
+	PIPELINE_NONE = "_none"
+)
+
+// 导入时对doc做预处理的pipeline，由多个processor按顺序组成
+type Pipeline struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Processors  []ProcessorConf `json:"processors"`
+}
+
+// processor配置，不同类型的processor使用其中不同的项
+type ProcessorConf struct {
+	Type          string      `json:"type"`                     // rename,remove,set,default,lowercase,uppercase,trim,split,date,regex,html-strip,drop-if
+	Field         string      `json:"field,omitempty"`          // 处理的字段
+	Fields        []string    `json:"fields,omitempty"`         // remove,lowercase,uppercase,trim,html-strip可以处理多个字段
+	To            string      `json:"to,omitempty"`             // rename的目标字段；split,date,html-strip的结果字段，缺省为field
+	Value         interface{} `json:"value,omitempty"`          // set,default的值
+	Separator     string      `json:"separator,omitempty"`      // split的分隔符，缺省为","
+	Formats       []string    `json:"formats,omitempty"`        // date的输入格式，可以是Go时间格式，或"unix","unix_ms","rfc3339"
+	Format        string      `json:"format,omitempty"`         // date的输出格式，缺省为"2006-01-02 15:04:05"
+	Pattern       string      `json:"pattern,omitempty"`        // regex的正则表达式，命名分组的值保存到同名字段；drop-if匹配的正则表达式
+	Equals        interface{} `json:"equals,omitempty"`         // drop-if: 字段值等于该值时丢弃doc
+	Missing       bool        `json:"missing,omitempty"`        // drop-if: 字段不存在或为空时丢弃doc
+	IgnoreMissing bool        `json:"ignore-missing,omitempty"` // 字段不存在时跳过该processor，否则doc出错
+	IgnoreFailure bool        `json:"ignore-failure,omitempty"` // 处理出错时跳过该processor，否则doc出错
+}
+
+// 处理一个doc，返回doc是否需要丢弃
+type processor func(doc map[string]interface{}) (drop bool, err error)
+
+type pipeline struct {
+	name       string
+	processors []processor
+}
+
+var (
+	validPipelineName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	htmlScriptRe      = regexp.MustCompile(`(?is)<script.*?</script>|<style.*?</style>|<!--.*?-->`)
+	htmlTagRe         = regexp.MustCompile(`(?s)<[^>]*>`)
+	spacesRe          = regexp.MustCompile(`\s+`)
+)
+
+// 处理一个doc，返回doc是否需要丢弃
+func (pl *pipeline) run(doc map[string]interface{}) (bool, error) {
+	for i, p := range pl.processors {
+		drop, err := p(doc)
+		if err != nil {
+			return false, fmt.Errorf("pipeline %s processor #%d: %v", pl.name, i+1, err)
+		}
+		if drop {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func compilePipeline(p *Pipeline) (*pipeline, error) {
+	pl := &pipeline{name: p.Name}
+	for i := range p.Processors {
+		proc, err := compileProcessor(&p.Processors[i])
+		if err != nil {
+			return nil, fmt.Errorf("processor #%d: %v", i+1, err)
+		}
+		pl.processors = append(pl.processors, proc)
+	}
+	return pl, nil
+}
+
+func compileProcessor(c *ProcessorConf) (processor, error) {
+	fields := c.Fields
+	if c.Field != "" {
+		fields = append([]string{c.Field}, fields...)
+	}
+	to := c.To
+	if to == "" {
+		to = c.Field
+	}
+
+	var p processor
+	switch c.Type {
+	case "rename":
+		if c.Field == "" || c.To == "" {
+			return nil, fmt.Errorf("field and to expected")
+		}
+		p = func(doc map[string]interface{}) (bool, error) {
+			v, ok := doc[c.Field]
+			if !ok {
+				return false, missingField(c, c.Field)
+			}
+			delete(doc, c.Field)
+			doc[c.To] = v
+			return false, nil
+		}
+	case "remove":
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("field or fields expected")
+		}
+		p = func(doc map[string]interface{}) (bool, error) {
+			for _, f := range fields {
+				delete(doc, f)
+			}
+			return false, nil
+		}
+	case "set", "default":
+		if c.Field == "" {
+			return nil, fmt.Errorf("field expected")
+		}
+		isDefault := c.Type == "default"
+		p = func(doc map[string]interface{}) (bool, error) {
+			if isDefault && !isEmptyValue(doc[c.Field]) {
+				return false, nil
+			}
+			doc[c.Field] = c.Value
+			return false, nil
+		}
+	case "lowercase", "uppercase", "trim", "html-strip":
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("field or fields expected")
+		}
+		var fn func(string) string
+		switch c.Type {
+		case "lowercase":
+			fn = strings.ToLower
+		case "uppercase":
+			fn = strings.ToUpper
+		case "trim":
+			fn = strings.TrimSpace
+		default:
+			fn = stripHtml
+		}
+		p = func(doc map[string]interface{}) (bool, error) {
+			for _, f := range fields {
+				v, ok := doc[f]
+				if !ok {
+					if err := missingField(c, f); err != nil {
+						return false, err
+					}
+					continue
+				}
+				res, err := mapStrings(v, fn)
+				if err != nil {
+					return false, fmt.Errorf("field %s: %v", f, err)
+				}
+				if f == c.Field {
+					doc[to] = res
+				} else {
+					doc[f] = res
+				}
+			}
+			return false, nil
+		}
+	case "split":
+		if c.Field == "" {
+			return nil, fmt.Errorf("field expected")
+		}
+		sep := c.Separator
+		if sep == "" {
+			sep = ","
+		}
+		p = func(doc map[string]interface{}) (bool, error) {
+			v, ok := doc[c.Field]
+			if !ok {
+				return false, missingField(c, c.Field)
+			}
+			s, ok := v.(string)
+			if !ok {
+				return false, fmt.Errorf("field %s is not a string", c.Field)
+			}
+			res := []interface{}{}
+			for _, part := range strings.Split(s, sep) {
+				if part = strings.TrimSpace(part); len(part) > 0 {
+					res = append(res, part)
+				}
+			}
+			doc[to] = res
+			return false, nil
+		}
+	case "date":
+		if c.Field == "" || len(c.Formats) == 0 {
+			return nil, fmt.Errorf("field and formats expected")
+		}
+		outFmt := c.Format
+		if outFmt == "" {
+			outFmt = "2006-01-02 15:04:05"
+		}
+		p = func(doc map[string]interface{}) (bool, error) {
+			v, ok := doc[c.Field]
+			if !ok {
+				return false, missingField(c, c.Field)
+			}
+			t, err := parseDate(v, c.Formats)
+			if err != nil {
+				return false, fmt.Errorf("field %s: %v", c.Field, err)
+			}
+			doc[to] = t.In(conf.Loc).Format(outFmt)
+			return false, nil
+		}
+	case "regex":
+		if c.Field == "" || c.Pattern == "" {
+			return nil, fmt.Errorf("field and pattern expected")
+		}
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		names := re.SubexpNames()
+		p = func(doc map[string]interface{}) (bool, error) {
+			v, ok := doc[c.Field]
+			if !ok {
+				return false, missingField(c, c.Field)
+			}
+			m := re.FindStringSubmatch(fmt.Sprintf("%v", v))
+			if m == nil {
+				return false, fmt.Errorf("field %s does not match %s", c.Field, c.Pattern)
+			}
+			for i, name := range names {
+				if i > 0 && name != "" {
+					doc[name] = m[i]
+				}
+			}
+			return false, nil
+		}
+	case "drop-if":
+		if c.Field == "" || (c.Equals == nil && c.Pattern == "" && !c.Missing) {
+			return nil, fmt.Errorf("field and one of equals, pattern or missing expected")
+		}
+		var re *regexp.Regexp
+		if c.Pattern != "" {
+			var err error
+			if re, err = regexp.Compile(c.Pattern); err != nil {
+				return nil, err
+			}
+		}
+		equals := ""
+		if c.Equals != nil {
+			equals = fmt.Sprintf("%v", c.Equals)
+		}
+		p = func(doc map[string]interface{}) (bool, error) {
+			v := doc[c.Field]
+			if isEmptyValue(v) {
+				return c.Missing, nil
+			}
+			s := fmt.Sprintf("%v", v)
+			if c.Equals != nil && s == equals {
+				return true, nil
+			}
+			return re != nil && re.MatchString(s), nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown processor type %q", c.Type)
+	}
+
+	if !c.IgnoreFailure {
+		return p, nil
+	}
+	return func(doc map[string]interface{}) (bool, error) {
+		drop, err := p(doc)
+		if err != nil {
+			return false, nil
+		}
+		return drop, nil
+	}, nil
+}
+
+func missingField(c *ProcessorConf, field string) error {
+	if c.IgnoreMissing {
+		return nil
+	}
+	return fmt.Errorf("field %s not found", field)
+}
+
+func isEmptyValue(v interface{}) bool {
+	switch v.(type) {
+	case nil:
+		return true
+	case string:
+		return len(strings.TrimSpace(v.(string))) == 0
+	case []interface{}:
+		return len(v.([]interface{})) == 0
+	default:
+		return false
+	}
+}
+
+// 对字符串或字符串数组的每个值做转换
+func mapStrings(v interface{}, fn func(string) string) (interface{}, error) {
+	switch v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return fn(v.(string)), nil
+	case []interface{}:
+		vs := v.([]interface{})
+		res := make([]interface{}, len(vs))
+		for i, e := range vs {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("string expected")
+			}
+			res[i] = fn(s)
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("string expected")
+	}
+}
+
+// 去掉html标签、脚本和注释，转换实体，合并空白
+func stripHtml(s string) string {
+	s = htmlScriptRe.ReplaceAllString(s, " ")
+	s = htmlTagRe.ReplaceAllString(s, " ")
+	s = html.UnescapeString(s)
+	return strings.TrimSpace(spacesRe.ReplaceAllString(s, " "))
+}
+
+// 按给定的格式依次尝试解析时间，没有时区的时间按conf.Loc解析
+func parseDate(v interface{}, formats []string) (time.Time, error) {
+	s := strings.TrimSpace(fmt.Sprintf("%v", v))
+	if f, ok := v.(float64); ok {
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	for _, format := range formats {
+		switch format {
+		case "unix", "unix_ms":
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				continue
+			}
+			if format == "unix" {
+				return time.Unix(n, 0), nil
+			}
+			return time.Unix(0, n*int64(time.Millisecond)), nil
+		case "rfc3339":
+			format = time.RFC3339
+		}
+		if t, err := time.ParseInLocation(format, s, conf.Loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q does not match any of the formats", s)
+}
+
+// ------------ pipeline的保存 ------------
+
+func pipelineFile(name string) string {
+	return path.Join(conf.ServiceConf.RootDir, pipelinesDir, fmt.Sprintf("%s.json", name))
+}
+
+func checkPipelineName(name string) error {
+	if !validPipelineName.MatchString(name) {
+		return fmt.Errorf("bad pipeline name %q", name)
+	}
+	return nil
+}
+
+// 检查pipeline是否正确
+func CheckPipeline(p *Pipeline) error {
+	_, err := compilePipeline(p)
+	return err
+}
+
+// 保存pipeline，同名的pipeline会被替换
+func SavePipeline(p *Pipeline) error {
+	if err := checkPipelineName(p.Name); err != nil {
+		return err
+	}
+	if err := CheckPipeline(p); err != nil {
+		return err
+	}
+	d := path.Join(conf.ServiceConf.RootDir, pipelinesDir)
+	if err := os.MkdirAll(d, 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pipelineFile(p.Name), b, 0644)
+}
+
+// 获取pipeline
+func GetPipeline(name string) (*Pipeline, error) {
+	if err := checkPipelineName(name); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(pipelineFile(name))
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %s not found", name)
+	}
+	var p Pipeline
+	if err = json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	p.Name = name
+	return &p, nil
+}
+
+// 列出所有pipeline
+func ListPipelines() []*Pipeline {
+	res := []*Pipeline{}
+	files, err := ioutil.ReadDir(path.Join(conf.ServiceConf.RootDir, pipelinesDir))
+	if err != nil {
+		return res
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		if p, err := GetPipeline(strings.TrimSuffix(fi.Name(), ".json")); err == nil {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// 删除pipeline
+func DeletePipeline(name string) error {
+	if err := checkPipelineName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(pipelineFile(name)); err != nil {
+		return fmt.Errorf("pipeline %s not found", name)
+	}
+	return nil
+}
+
+// 获取导入时使用的pipeline。name为空时使用schema中指定的pipeline，为PIPELINE_NONE时不使用pipeline
+func (idx *indexer) getPipeline(name string) (*pipeline, error) {
+	if name == "" {
+		name = idx.schema.Pipeline
+	}
+	if name == "" || name == PIPELINE_NONE {
+		return nil, nil
+	}
+	p, err := GetPipeline(name)
+	if err != nil {
+		return nil, err
+	}
+	return compilePipeline(p)
+}
+
+// pipeline模拟运行的结果
+type SimulateResult struct {
+	Doc     map[string]interface{} `json:"doc,omitempty"`
+	Dropped bool                   `json:"dropped,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+// 用pipeline处理docs，返回处理的结果，不会导入
+func SimulatePipeline(p *Pipeline, docs []map[string]interface{}) ([]SimulateResult, error) {
+	pl, err := compilePipeline(p)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]SimulateResult, len(docs))
+	for i, doc := range docs {
+		if doc == nil {
+			res[i].Error = "JSON object expected"
+			continue
+		}
+		drop, err := pl.run(doc)
+		switch {
+		case err != nil:
+			res[i].Error = err.Error()
+		case drop:
+			res[i].Dropped = true
+		default:
+			res[i].Doc = doc
+		}
+	}
+	return res, nil
+}
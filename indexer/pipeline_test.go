@@ -0,0 +1,56 @@
+package indexer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSimulatePipeline(t *testing.T) {
+	p := &Pipeline{
+		Name: "test",
+		Processors: []ProcessorConf{
+			{Type: "drop-if", Field: "status", Equals: "deleted"},
+			{Type: "rename", Field: "title", To: "name"},
+			{Type: "html-strip", Field: "name"},
+			{Type: "trim", Fields: []string{"brand"}, IgnoreMissing: true},
+			{Type: "lowercase", Field: "brand", IgnoreMissing: true},
+			{Type: "default", Field: "brand", Value: "none"},
+			{Type: "split", Field: "tags", Separator: "|", IgnoreMissing: true},
+			{Type: "date", Field: "ut", Formats: []string{"2006/01/02", "unix"}},
+			{Type: "regex", Field: "sku", Pattern: `^(?P<cat>[A-Z]+)-(?P<num>\d+)$`, IgnoreFailure: true},
+			{Type: "remove", Fields: []string{"status", "sku"}},
+		},
+	}
+	docs := []map[string]interface{}{
+		{"title": "<p>Hello&amp;<b>World</b></p>", "brand": " ACME ", "tags": "a| b||c", "ut": "2020/01/02", "sku": "AB-12", "status": "ok"},
+		{"title": "x", "status": "deleted"},
+		{"title": "y", "ut": 1577836800.0, "sku": "bad"},
+		{"ut": "2020/01/02"},
+		{"title": "z", "ut": "yesterday"},
+	}
+	res, err := SimulatePipeline(p, docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"name": "Hello& World", "brand": "acme", "tags": []interface{}{"a", "b", "c"},
+		"ut": "2020-01-02 00:00:00", "cat": "AB", "num": "12",
+	}
+	if !reflect.DeepEqual(res[0].Doc, expected) {
+		t.Fatalf("unexpected doc: %v", res[0].Doc)
+	}
+	if !res[1].Dropped {
+		t.Fatalf("doc #2 should be dropped: %+v", res[1])
+	}
+	if res[2].Error != "" || res[2].Doc["ut"] != "2020-01-01 08:00:00" || res[2].Doc["brand"] != "none" {
+		t.Fatalf("unexpected doc #3: %+v", res[2])
+	}
+	if res[3].Error == "" || res[4].Error == "" {
+		t.Fatalf("doc #4 and #5 should fail: %+v, %+v", res[3], res[4])
+	}
+
+	if err = CheckPipeline(&Pipeline{Processors: []ProcessorConf{{Type: "regex", Field: "a", Pattern: "("}}}); err == nil {
+		t.Fatal("bad pattern should be rejected")
+	}
+}
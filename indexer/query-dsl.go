@@ -0,0 +1,621 @@
+package indexer
+
+import (
+	"github.com/go-ego/riot/types"
+	"go-search/conf"
+	"strconv"
+	"strings"
+	"fmt"
+)
+
+// JSON查询: POST /search/:index的请求体
+//   - query是一个子句，bool子句可以嵌套，叶子子句是term、terms、match、range、exists、prefix
+//   - 编译成riot的types.Logic，只用于缩小候选doc的范围，每个候选doc在scorerT.Score中用整个子句树判断
+type SearchBody struct {
+	Query    map[string]interface{} `json:"query"`    // 为空时查询全部doc
+	S        string                 `json:"s"`        // 同/search的s参数
+	Page     int                    `json:"page"`
+	Pagesize int                    `json:"pagesize"`
+	Fl       string                 `json:"fl"`       // 同/search的fl参数
+}
+
+const (
+	DSL_BOOL   = "bool"
+	DSL_TERM   = "term"
+	DSL_TERMS  = "terms"
+	DSL_MATCH  = "match"
+	DSL_RANGE  = "range"
+	DSL_EXISTS = "exists"
+	DSL_PREFIX = "prefix"
+)
+
+// 查询条件有错误，如字段不存在、值的类型不对
+type BadQueryError struct {
+	Msg string
+}
+
+func (e *BadQueryError) Error() string {
+	return e.Msg
+}
+
+// 编译后的子句
+type dslNode struct {
+	kind string
+
+	// bool
+	must      []*dslNode
+	should    []*dslNode
+	mustNot   []*dslNode
+	filter    []*dslNode
+	minShould int
+
+	boost     float32 // 计算相关度时的权重，0表示1
+
+	// 叶子子句
+	fieldName string
+	fIdx      int      // match: <0表示所有分词的字段
+	f         *filter  // term, terms, range
+	tokens    []string // match: 查询分词后的结果
+	and       bool     // match: 是否需要所有的词都出现
+	phrase    bool     // match: 短语，词的位置必须连续
+	slop      int      // match: 短语中的词允许移动的位置数
+	prefix    string   // prefix
+}
+
+// 按JSON查询进行搜索
+func QueryDSL(index string, body *SearchBody) (pagination interface{}, timeout bool, docs <-chan interface{}, err error) {
+	if !running {
+		return nil, false, nil, fmt.Errorf("the service is stopped")
+	}
+
+	var page, pagesize string
+	if body.Page > 0 {
+		page = strconv.Itoa(body.Page)
+	}
+	if body.Pagesize > 0 {
+		pagesize = strconv.Itoa(body.Pagesize)
+	}
+	pq, err := parseQuery("", "", body.S, "", page, pagesize, body.Fl)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	idx, err := initIndexer(index)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	var root *dslNode
+	if len(body.Query) > 0 {
+		if root, err = idx.compileDSL(body.Query, "query"); err != nil {
+			return nil, false, nil, &BadQueryError{Msg: err.Error()}
+		}
+	}
+
+	sr, err := idx.pq2SearchQuery(pq)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if root != nil {
+		idx.dslLogic(root, sr)
+		sr.RankOpts.ScoringCriteria.(*scorerT).tree = root
+	}
+
+	resp := idx.engine.Search(*sr)
+	pagination, timeout, docs = idx.outputResult(&resp, pq)
+	return
+}
+
+// 编译一个子句，path用于出错信息
+func (idx *indexer) compileDSL(v interface{}, path string) (*dslNode, error) {
+	clause, ok := v.(map[string]interface{})
+	if !ok || len(clause) != 1 {
+		return nil, fmt.Errorf("%s: an object with one clause expected", path)
+	}
+	for kind, arg := range clause {
+		path = fmt.Sprintf("%s.%s", path, kind)
+		switch kind {
+		case DSL_BOOL:
+			return idx.compileBool(arg, path)
+		case DSL_EXISTS:
+			args, ok := arg.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf(`%s: {"field": "name"} expected`, path)
+			}
+			fieldName, _ := args["field"].(string)
+			fIdx, ok := idx.schema.FieldMap[fieldName]
+			if !ok {
+				return nil, fmt.Errorf("%s: field %q not found", path, fieldName)
+			}
+			return &dslNode{kind: kind, fieldName: fieldName, fIdx: fIdx}, nil
+		case DSL_TERM, DSL_TERMS, DSL_MATCH, DSL_RANGE, DSL_PREFIX:
+			args, ok := arg.(map[string]interface{})
+			if !ok || len(args) != 1 {
+				return nil, fmt.Errorf(`%s: {"field-name": ...} expected`, path)
+			}
+			for fieldName, fv := range args {
+				fIdx, ok := idx.schema.FieldMap[fieldName]
+				if !ok {
+					return nil, fmt.Errorf("%s: field %q not found", path, fieldName)
+				}
+				node := &dslNode{kind: kind, fieldName: fieldName, fIdx: fIdx}
+				if err := idx.compileLeaf(node, fv); err != nil {
+					return nil, fmt.Errorf("%s.%s: %v", path, fieldName, err)
+				}
+				return node, nil
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown clause", path)
+		}
+	}
+	return nil, nil
+}
+
+func (idx *indexer) compileBool(arg interface{}, path string) (*dslNode, error) {
+	args, ok := arg.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: an object expected", path)
+	}
+	node := &dslNode{kind: DSL_BOOL}
+	for name, v := range args {
+		var clauses *[]*dslNode
+		switch name {
+		case "must":
+			clauses = &node.must
+		case "should":
+			clauses = &node.should
+		case "must_not":
+			clauses = &node.mustNot
+		case "filter":
+			clauses = &node.filter
+		case "minimum_should_match":
+			n, ok := v.(float64)
+			if !ok || n < 0 || n != float64(int(n)) {
+				return nil, fmt.Errorf("%s.%s: a non-negative integer expected", path, name)
+			}
+			node.minShould = int(n)
+			continue
+		default:
+			return nil, fmt.Errorf("%s: unknown occurrence %s, must, should, must_not or filter expected", path, name)
+		}
+
+		// 一个子句可以不用数组
+		vs, ok := v.([]interface{})
+		if !ok {
+			vs = []interface{}{v}
+		}
+		for i, c := range vs {
+			child, err := idx.compileDSL(c, fmt.Sprintf("%s.%s[%d]", path, name, i))
+			if err != nil {
+				return nil, err
+			}
+			*clauses = append(*clauses, child)
+		}
+	}
+
+	if _, ok := args["minimum_should_match"]; !ok && len(node.should) > 0 && len(node.must) == 0 && len(node.filter) == 0 {
+		// 只有should时至少要满足一个
+		node.minShould = 1
+	}
+	if node.minShould > len(node.should) {
+		return nil, fmt.Errorf("%s: minimum_should_match is greater than the number of should clauses", path)
+	}
+	return node, nil
+}
+
+func (idx *indexer) compileLeaf(node *dslNode, v interface{}) error {
+	field := &idx.schema.Fields[node.fIdx]
+	switch node.kind {
+	case DSL_TERM, DSL_TERMS:
+		vs, isArray := v.([]interface{})
+		if node.kind == DSL_TERM {
+			if isArray || v == nil {
+				return fmt.Errorf("a single value expected")
+			}
+			vs = []interface{}{v}
+		} else if !isArray || len(vs) == 0 {
+			return fmt.Errorf("an array of values expected")
+		}
+		f := &filter{fieldName: node.fieldName, fIdx: node.fIdx, conds: make([]interface{}, len(vs))}
+		for i, v := range vs {
+			cv, err := field.ToNativeValue(v)
+			if err != nil {
+				return err
+			}
+			if _, ok := cv.([]interface{}); ok {
+				return fmt.Errorf("nested array not allowed")
+			}
+			f.conds[i] = cv
+		}
+		node.f = f
+	case DSL_RANGE:
+		args, ok := v.(map[string]interface{})
+		if !ok || len(args) == 0 {
+			return fmt.Errorf(`{"gte": from, "lte": to} expected`)
+		}
+		r := range_{}
+		for op, bound := range args {
+			bv, err := field.ToNativeValue(bound)
+			if err != nil {
+				return err
+			}
+			switch op {
+			case "gte", "gt":
+				r.from, r.fromExcl = bv, op == "gt"
+			case "lte", "lt":
+				r.to, r.toExcl = bv, op == "lt"
+			default:
+				return fmt.Errorf("unknown range operator %s, gt, gte, lt or lte expected", op)
+			}
+		}
+		node.f = &filter{fieldName: node.fieldName, fIdx: node.fIdx, ranges: []range_{r}}
+	case DSL_MATCH:
+		query := v
+		if args, ok := v.(map[string]interface{}); ok {
+			// {"query": "text", "operator": "and|or"}
+			query = args["query"]
+			switch op, _ := args["operator"].(string); op {
+			case "", "or":
+			case "and":
+				node.and = true
+			default:
+				return fmt.Errorf("unknown operator %s, and or or expected", op)
+			}
+		}
+		s, ok := query.(string)
+		if !ok {
+			return fmt.Errorf("query text expected")
+		}
+		if field.Type == "json" {
+			return fmt.Errorf("match is not supported by json field")
+		}
+		if node.tokens = fieldTokenize(field, s); len(node.tokens) == 0 {
+			return fmt.Errorf("no token in query text %q", s)
+		}
+	case DSL_PREFIX:
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return fmt.Errorf("prefix string expected")
+		}
+		switch field.Type {
+		case "str", "string":
+		default:
+			return fmt.Errorf("prefix is only supported by string field")
+		}
+		node.prefix = s
+	}
+	return nil
+}
+
+// 按字段的分词器分词，不分词的字段是整个值
+func fieldTokenize(field *conf.Field, s string) []string {
+	switch field.Tokenizer {
+	case conf.ZH_TOKENIZER:
+		return hanziTokenize(s)
+	case conf.NONE_TOKENIZER:
+		if s = strings.TrimSpace(s); s == "" {
+			return nil
+		}
+		return []string{s}
+	default:
+		return whitespaceTokenize(s)
+	}
+}
+
+// 把子句树转换为riot的检索条件: 只用顶层的必须满足的match子句缩小候选doc的范围，其它子句都在Score中判断
+func (idx *indexer) dslLogic(root *dslNode, sr *types.SearchReq) {
+	if root.kind != DSL_BOOL {
+		root = &dslNode{kind: DSL_BOOL, must: []*dslNode{root}}
+	}
+
+	logic := types.Logic{
+		Expr: types.Expr{
+			Must:   []string{},
+			Should: []string{},
+			NotIn:  []string{},
+		},
+	}
+	for _, clauses := range [][]*dslNode{root.must, root.filter} {
+		for _, c := range clauses {
+			if c.indexed(idx.schema) && (c.and || len(c.tokens) == 1) {
+				logic.Expr.Must = append(logic.Expr.Must, c.indexTokens()...)
+			}
+		}
+	}
+	if len(root.must) == 0 && len(root.filter) == 0 && root.minShould > 0 {
+		// 至少要满足一个should，所有的should都是match时，doc至少包含其中一个词
+		tokens := []string{}
+		for _, c := range root.should {
+			if !c.indexed(idx.schema) {
+				tokens = nil
+				break
+			}
+			tokens = append(tokens, c.indexTokens()...)
+		}
+		logic.Expr.Should = append(logic.Expr.Should, tokens...)
+	}
+	for _, c := range root.mustNot {
+		if c.indexed(idx.schema) && (!c.and || len(c.tokens) == 1) {
+			logic.Expr.NotIn = append(logic.Expr.NotIn, c.indexTokens()...)
+		}
+	}
+	logic.Must = len(logic.Expr.Must) > 0
+	logic.Should = len(logic.Expr.Should) > 0
+	logic.NotIn = len(logic.Expr.NotIn) > 0
+	if !logic.Must && !logic.Should {
+		if !logic.NotIn {
+			// 没有可用的条件，候选doc为全部doc
+			return
+		}
+		logic.Must = true
+		logic.Expr.Must = allDocs
+	}
+	sr.Logic = logic
+	sr.Labels, sr.Tokens = nil, nil
+}
+
+// 是否是可以通过索引查找的match子句
+func (n *dslNode) indexed(schema *conf.Schema) bool {
+	return n.kind == DSL_MATCH && (n.fIdx < 0 || schema.Fields[n.fIdx].Tokenizer != conf.NONE_TOKENIZER)
+}
+
+func (n *dslNode) indexTokens() []string {
+	if n.fIdx < 0 {
+		return n.tokens
+	}
+	res := make([]string, len(n.tokens))
+	for i, t := range n.tokens {
+		res[i] = fmt.Sprintf("f%d:%s", n.fIdx, t)
+	}
+	return res
+}
+
+// doc的相关度: 满足的must、should子句的权重之和
+func (d StoredDoc) relevance(n *dslNode, schema *conf.Schema) float32 {
+	return d.tokens(schema).relevance(n)
+}
+
+// 判断doc是否满足子句
+func (d StoredDoc) matchesDSL(n *dslNode, schema *conf.Schema) bool {
+	return d.tokens(schema).matches(n)
+}
+
+// 一个doc中分词字段的词的位置，每个字段只分词一次，供Score中的各个子句共用
+//   位置是词的序号，就是buildIndexTokens记录的位置减去值的起始位置
+type docTokens struct {
+	d      StoredDoc
+	schema *conf.Schema
+	locs   map[int][]map[string][]int // 字段序号 -> 每个值中词的位置
+}
+
+func (d StoredDoc) tokens(schema *conf.Schema) *docTokens {
+	return &docTokens{d: d, schema: schema}
+}
+
+// 字段的每个值按建索引时的方式分词后，词的位置
+func (dt *docTokens) fieldLocs(fIdx int) []map[string][]int {
+	if res, ok := dt.locs[fIdx]; ok {
+		return res
+	}
+	field := &dt.schema.Fields[fIdx]
+	vals, ok := dt.d[field.Name].([]interface{})
+	if !ok {
+		vals = []interface{}{dt.d[field.Name]}
+	}
+	res := make([]map[string][]int, 0, len(vals))
+	for _, v := range vals {
+		if v == nil {
+			continue
+		}
+		s, ok := v.(string)
+		if !ok {
+			s = fmt.Sprintf("%v", v)
+		}
+		locs := map[string][]int{}
+		for pos, t := range fieldTokenize(field, s) {
+			locs[t] = append(locs[t], pos)
+		}
+		res = append(res, locs)
+	}
+	if dt.locs == nil {
+		dt.locs = map[int][]map[string][]int{}
+	}
+	dt.locs[fIdx] = res
+	return res
+}
+
+// 指定字段或者所有分词的字段(fIdx<0)的每个值中词的位置
+func (dt *docTokens) valueLocs(fIdx int) []map[string][]int {
+	if fIdx >= 0 {
+		return dt.fieldLocs(fIdx)
+	}
+	var res []map[string][]int
+	for i := range dt.schema.Fields {
+		if dt.schema.Fields[i].Tokenizer != conf.NONE_TOKENIZER {
+			res = append(res, dt.fieldLocs(i)...)
+		}
+	}
+	return res
+}
+
+func (dt *docTokens) relevance(n *dslNode) float32 {
+	boost := n.boost
+	if boost == 0 {
+		boost = 1
+	}
+	if n.kind != DSL_BOOL {
+		if n.phrase && n.slop > 0 {
+			// 词离得越远相关度越低
+			return boost / float32(1 + dt.phraseSpan(n))
+		}
+		return boost
+	}
+	var r float32
+	for _, c := range n.must {
+		r += dt.relevance(c)
+	}
+	for _, c := range n.should {
+		if dt.matches(c) {
+			r += dt.relevance(c)
+		}
+	}
+	return r * boost
+}
+
+func (dt *docTokens) matches(n *dslNode) bool {
+	d := dt.d
+	switch n.kind {
+	case DSL_BOOL:
+		for _, clauses := range [][]*dslNode{n.must, n.filter} {
+			for _, c := range clauses {
+				if !dt.matches(c) {
+					return false
+				}
+			}
+		}
+		for _, c := range n.mustNot {
+			if dt.matches(c) {
+				return false
+			}
+		}
+		if n.minShould > 0 {
+			count := 0
+			for _, c := range n.should {
+				if dt.matches(c) {
+					if count += 1; count >= n.minShould {
+						return true
+					}
+				}
+			}
+			return false
+		}
+		return true
+	case DSL_TERM, DSL_TERMS, DSL_RANGE:
+		return d.satisfied([]filter{*n.f}, dt.schema)
+	case DSL_MATCH:
+		if n.phrase {
+			return dt.phraseSpan(n) >= 0
+		}
+		found := map[string]bool{}
+		for _, locs := range dt.valueLocs(n.fIdx) {
+			for t := range locs {
+				found[t] = true
+			}
+		}
+		return n.matchTokens(found)
+	case DSL_PREFIX:
+		for _, locs := range dt.fieldLocs(n.fIdx) {
+			for t := range locs {
+				if strings.HasPrefix(t, n.prefix) {
+					return true
+				}
+			}
+		}
+		return false
+	case DSL_EXISTS:
+		storedVal, ok := d[n.fieldName]
+		if !ok || storedVal == nil {
+			return false
+		}
+		if vals, ok := storedVal.([]interface{}); ok {
+			return len(vals) > 0
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// doc中的词是否满足match子句
+func (n *dslNode) matchTokens(found map[string]bool) bool {
+	for _, t := range n.tokens {
+		if found[t] != n.and {
+			// and时有一个没有出现即不满足，or时有一个出现即满足
+			return found[t]
+		}
+	}
+	return n.and
+}
+
+// doc中短语的最小跨度，没有出现或超过slop时返回-1
+func (dt *docTokens) phraseSpan(n *dslNode) int {
+	best := -1
+	if n.fIdx >= 0 && dt.schema.Fields[n.fIdx].Tokenizer == conf.NONE_TOKENIZER {
+		return best
+	}
+	for _, locs := range dt.valueLocs(n.fIdx) {
+		span := phraseSpan(n.tokens, locs)
+		if span >= 0 && span <= n.slop && (best < 0 || span < best) {
+			best = span
+		}
+	}
+	return best
+}
+
+// 不在引号中的多个词的紧邻程度: 同一个值中出现的词越多、离得越近越大，最大为1
+//   riot只在不带Logic的检索中计算IndexedDoc.TokenProximity，所以按词的位置计算
+func (dt *docTokens) proximity(n *dslNode) float32 {
+	var best float32
+	for _, locs := range dt.valueLocs(n.fIdx) {
+		lists := [][]int{}
+		for _, t := range n.tokens {
+			if l, ok := locs[t]; ok {
+				lists = append(lists, l)
+			}
+		}
+		if len(lists) == 0 {
+			continue
+		}
+		// 相邻的词之间的距离为0
+		gap := minSpan(lists) - (len(lists) - 1)
+		if gap < 0 {
+			gap = 0
+		}
+		// 出现的词多的总是靠前，出现的词一样多时离得近的靠前
+		if r := (float32(len(lists)) + 1/float32(1 + gap)) / float32(len(n.tokens) + 1); r > best {
+			best = r
+		}
+	}
+	return best
+}
+
+// 短语的词在一个值中的最小跨度: 第i个词的位置减去i后，最大与最小的差
+//   0表示词是连续的，-1表示没有出现全部的词
+func phraseSpan(phrase []string, locs map[string][]int) int {
+	lists := make([][]int, len(phrase))
+	for i, t := range phrase {
+		if len(locs[t]) == 0 {
+			return -1
+		}
+		lists[i] = make([]int, len(locs[t]))
+		for j, pos := range locs[t] {
+			lists[i][j] = pos - i
+		}
+	}
+	return minSpan(lists)
+}
+
+// 从每个有序的位置列表中各取一个位置，最大与最小的差的最小值
+func minSpan(lists [][]int) int {
+	// 每次移动最小位置的指针，求覆盖每个列表的最小区间
+	best := -1
+	ptrs := make([]int, len(lists))
+	for {
+		minI, min, max := 0, lists[0][ptrs[0]], lists[0][ptrs[0]]
+		for i := 1; i < len(lists); i++ {
+			pos := lists[i][ptrs[i]]
+			if pos < min {
+				minI, min = i, pos
+			}
+			if pos > max {
+				max = pos
+			}
+		}
+		if best < 0 || max-min < best {
+			best = max - min
+		}
+		if ptrs[minI] += 1; best == 0 || ptrs[minI] >= len(lists[minI]) {
+			return best
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package indexer
+
+import (
+	"encoding/json"
+	"go-search/conf"
+	"testing"
+)
+
+func TestQueryDSL(t *testing.T) {
+	schema := &conf.Schema{
+		Name: "dsl-test",
+		SchemaConf: &conf.SchemaConf{Fields: []conf.Field{
+			{Name: "id", Type: "u32", PK: true},
+			{Name: "name", Type: "str", Tokenizer: conf.ZH_TOKENIZER},
+			{Name: "brand", Type: "str"},
+			{Name: "age", Type: "u16"},
+		}},
+		FieldMap: map[string]int{"id": 0, "name": 1, "brand": 2, "age": 3},
+	}
+	idx := &indexer{schema: schema}
+
+	docs := []StoredDoc{
+		{"id": uint32(1), "name": "苹果手机 red", "brand": "A", "age": uint16(2)},
+		{"id": uint32(2), "name": "华为手机", "brand": "B", "age": uint16(5)},
+		{"id": uint32(3), "name": "小米电视 red", "brand": "C"},
+		{"id": uint32(4), "name": "苹果电脑", "brand": "A", "age": uint16(7)},
+	}
+	cases := []struct {
+		query    string
+		expected []uint32
+	}{
+		{`{"bool": {"should": [{"term": {"brand": "A"}}, {"term": {"brand": "B"}}],
+			"must_not": {"bool": {"filter": [{"term": {"brand": "A"}}, {"range": {"age": {"gt": 3}}}]}}}}`, []uint32{1, 2}},
+		{`{"match": {"name": {"query": "苹果 手机", "operator": "and"}}}`, []uint32{1}},
+		{`{"bool": {"must": {"match": {"name": "red"}}, "must_not": {"exists": {"field": "age"}}}}`, []uint32{3}},
+		{`{"bool": {"filter": {"prefix": {"name": "re"}}, "should": [{"terms": {"brand": ["A", "B"]}}], "minimum_should_match": 1}}`, []uint32{1}},
+		{`{"range": {"age": {"gte": 2, "lt": 7}}}`, []uint32{1, 2}},
+	}
+	for _, c := range cases {
+		var q map[string]interface{}
+		if err := json.Unmarshal([]byte(c.query), &q); err != nil {
+			t.Fatal(err)
+		}
+		root, err := idx.compileDSL(q, "query")
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		found := []uint32{}
+		for _, d := range docs {
+			if d.matchesDSL(root, schema) {
+				found = append(found, d["id"].(uint32))
+			}
+		}
+		if len(found) != len(c.expected) {
+			t.Fatalf("%s: expected %v, got %v", c.query, c.expected, found)
+		}
+		for i := range found {
+			if found[i] != c.expected[i] {
+				t.Fatalf("%s: expected %v, got %v", c.query, c.expected, found)
+			}
+		}
+	}
+
+	for _, q := range []string{`{"term": {"nope": 1}}`, `{"range": {"age": {"from": 1}}}`, `{"bool": {"must": [], "x": []}}`, `{"a": {}, "b": {}}`} {
+		var v map[string]interface{}
+		json.Unmarshal([]byte(q), &v)
+		if _, err := idx.compileDSL(v, "query"); err == nil {
+			t.Fatalf("%s should be rejected", q)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"strconv"
+	"strings"
+	"unicode"
+	"fmt"
+)
+
+// Lucene风格的查询串: /search/:index?defType=lucene&q=...
+//   - 字段前缀: name:手机、name:(red blue)、name:"red shoes"，没有字段前缀时在所有分词的字段中查询
+//   - 短语: "red shoes"要求词的位置连续，"red shoes"~2允许词移动2个位置，词离得越远相关度越低
+//   - 通配符: iph*、name:te?m*，'*'匹配任意个字符，'?'匹配一个字符，扩展成字段中的词
+//   - 布尔操作: AND、OR、NOT、&&、||、!、+、-，没有操作符的子句之间使用q.op(缺省为OR)
+//   - 括号分组，区间: age:[10 TO 50]、age:{10 TO *]，[]包含边界，{}不包含边界，*表示不限
+//   - 权重: name:手机^2，没有指定排序时按满足的子句的权重之和排序
+//   - field:*表示字段存在
+// 编译成与JSON查询相同的子句树，子句组合的方式与Lucene相同
+const (
+	DEF_TYPE_LUCENE = "lucene"
+
+	Q_OP_AND = "AND"
+	Q_OP_OR  = "OR"
+)
+
+// 按Lucene风格的查询串进行搜索，参数同Query，q为空时查询全部doc
+//   qop: 没有操作符的子句之间的关系，Q_OP_AND或Q_OP_OR
+func QueryLucene(index, q, qop, s, f, page, pagesize, fl string) (pagination interface{}, timeout bool, docs <-chan interface{}, err error) {
+	if !running {
+		return nil, false, nil, fmt.Errorf("the service is stopped")
+	}
+
+	pq, err := parseQuery("", "", s, f, page, pagesize, fl)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	idx, err := initIndexer(index)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	var root *dslNode
+	if strings.TrimSpace(q) != "" {
+		if root, err = idx.compileLucene(q, qop); err != nil {
+			if _, ok := err.(*QuerySyntaxError); !ok {
+				err = &BadQueryError{Msg: err.Error()}
+			}
+			return nil, false, nil, err
+		}
+	}
+
+	sr, err := idx.pq2SearchQuery(pq)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	if root != nil {
+		idx.dslLogic(root, sr)
+		scorer := sr.RankOpts.ScoringCriteria.(*scorerT)
+		scorer.tree = root
+		scorer.relevance = s == ""
+	}
+
+	resp := idx.engine.Search(*sr)
+	pagination, timeout, docs = idx.outputResult(&resp, pq)
+	return
+}
+
+// 查询串语法错误
+type QuerySyntaxError struct {
+	Pos int // 出错的位置，从1开始的字符序号
+	Msg string
+}
+
+func (e *QuerySyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+const (
+	ltEOF = iota
+	ltWord
+	ltPhrase
+	ltLParen
+	ltRParen
+	ltLBracket // '['或'{'
+	ltRBracket // ']'或'}'
+	ltColon
+	ltCaret
+	ltPlus
+	ltMinus
+	ltNot
+	ltAnd
+	ltOr
+	ltTo
+)
+
+type luceneToken struct {
+	kind int
+	text string
+	pos  int
+	slop int // 短语的"~N"
+	wildcard bool // 词中有没有转义的'*'或'?'
+}
+
+func (t *luceneToken) String() string {
+	if t.kind == ltEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// 把查询串分成token
+func lexLucene(q string) ([]luceneToken, error) {
+	rs := []rune(q)
+	tokens := []luceneToken{}
+	inRange := false // 是否在范围的括号中
+	for i:=0; i<len(rs); {
+		ch := rs[i]
+		pos := i + 1
+		if unicode.IsSpace(ch) {
+			i += 1
+			continue
+		}
+
+		kind := -1
+		switch ch {
+		case '(':
+			kind = ltLParen
+		case ')':
+			kind = ltRParen
+		case '[', '{':
+			kind, inRange = ltLBracket, true
+		case ']', '}':
+			kind, inRange = ltRBracket, false
+		case ':':
+			kind = ltColon
+		case '^':
+			kind = ltCaret
+		case '+':
+			kind = ltPlus
+		case '-':
+			// 范围的括号中、"field:"后面的"-"加数字是负数，如price:[-10 TO 5]、temp:-3
+			afterColon := len(tokens) > 0 && tokens[len(tokens)-1].kind == ltColon
+			if !((inRange || afterColon) && i+1 < len(rs) && unicode.IsDigit(rs[i+1])) {
+				kind = ltMinus
+			}
+		case '!':
+			kind = ltNot
+		case '&', '|':
+			if i+1 < len(rs) && rs[i+1] == ch {
+				if ch == '&' {
+					tokens = append(tokens, luceneToken{kind: ltAnd, text: "&&", pos: pos})
+				} else {
+					tokens = append(tokens, luceneToken{kind: ltOr, text: "||", pos: pos})
+				}
+				i += 2
+				continue
+			}
+		case '"':
+			// 短语，可以用'\'转义
+			sb := &strings.Builder{}
+			j := i + 1
+			for ; j < len(rs) && rs[j] != '"'; j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j += 1
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return nil, &QuerySyntaxError{Pos: pos, Msg: "unterminated phrase"}
+			}
+			t := luceneToken{kind: ltPhrase, text: sb.String(), pos: pos}
+			i = j + 1
+			if i < len(rs) && rs[i] == '~' {
+				j = i + 1
+				for ; j < len(rs) && unicode.IsDigit(rs[j]); j++ {
+				}
+				slop, err := strconv.Atoi(string(rs[i+1:j]))
+				if err != nil {
+					return nil, &QuerySyntaxError{Pos: i + 1, Msg: "slop number expected after '~'"}
+				}
+				t.slop = slop
+				i = j
+			}
+			tokens = append(tokens, t)
+			continue
+		}
+		if kind >= 0 {
+			tokens = append(tokens, luceneToken{kind: kind, text: string(ch), pos: pos})
+			i += 1
+			continue
+		}
+
+		// 词，可以用'\'转义特殊字符
+		sb := &strings.Builder{}
+		wildcard := false
+		for ; i < len(rs); i++ {
+			ch = rs[i]
+			if ch == '\\' && i+1 < len(rs) {
+				i += 1
+				sb.WriteRune(rs[i])
+				continue
+			}
+			if unicode.IsSpace(ch) || strings.ContainsRune(`()[]{}:^"`, ch) {
+				break
+			}
+			if ch == '*' || ch == '?' {
+				wildcard = true
+			}
+			sb.WriteRune(ch)
+		}
+		word := sb.String()
+		switch word {
+		case "AND":
+			kind = ltAnd
+		case "OR":
+			kind = ltOr
+		case "NOT":
+			kind = ltNot
+		case "TO":
+			kind = ltTo
+		default:
+			kind = ltWord
+		}
+		tokens = append(tokens, luceneToken{kind: kind, text: word, pos: pos, wildcard: wildcard && isWildcard(word)})
+	}
+	return append(tokens, luceneToken{kind: ltEOF, pos: len(rs) + 1}), nil
+}
+
+type luceneParser struct {
+	idx        *indexer
+	tokens     []luceneToken
+	i          int
+	defaultAnd bool
+}
+
+const (
+	occurShould = iota
+	occurMust
+	occurMustNot
+)
+
+// 编译Lucene风格的查询串
+//   qop: 没有操作符的子句之间的关系，Q_OP_AND或Q_OP_OR，空串表示Q_OP_OR
+func (idx *indexer) compileLucene(q, qop string) (*dslNode, error) {
+	p := &luceneParser{idx: idx}
+	switch strings.ToUpper(qop) {
+	case "", Q_OP_OR:
+	case Q_OP_AND:
+		p.defaultAnd = true
+	default:
+		return nil, fmt.Errorf("unknown q.op %s, AND or OR expected", qop)
+	}
+
+	var err error
+	if p.tokens, err = lexLucene(q); err != nil {
+		return nil, err
+	}
+	root, err := p.parseQuery(nil)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != ltEOF {
+		return nil, p.unexpected(t)
+	}
+	return root, nil
+}
+
+func (p *luceneParser) peek() *luceneToken {
+	return &p.tokens[p.i]
+}
+
+func (p *luceneParser) next() *luceneToken {
+	t := &p.tokens[p.i]
+	if t.kind != ltEOF {
+		p.i += 1
+	}
+	return t
+}
+
+func (p *luceneParser) unexpected(t *luceneToken) error {
+	return &QuerySyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %s", t)}
+}
+
+// 解析到')'或结束的一组子句
+//   field: 字段分组name:(...)中的字段，nil表示所有分词的字段
+func (p *luceneParser) parseQuery(field *conf.Field) (*dslNode, error) {
+	var clauses []*dslNode
+	var occurs []int
+	start := p.peek()
+	for {
+		t := p.peek()
+		if t.kind == ltEOF || t.kind == ltRParen {
+			break
+		}
+
+		// 连接词
+		conj := -1
+		if t.kind == ltAnd || t.kind == ltOr {
+			if len(clauses) == 0 {
+				return nil, p.unexpected(t)
+			}
+			conj = t.kind
+			p.next()
+		}
+
+		// 修饰符
+		mods := occurShould
+		switch p.peek().kind {
+		case ltPlus:
+			mods = occurMust
+			p.next()
+		case ltMinus, ltNot:
+			mods = occurMustNot
+			p.next()
+		}
+
+		clause, err := p.parseClause(field)
+		if err != nil {
+			return nil, err
+		}
+
+		// 与Lucene的QueryParser.addClause基本相同
+		if len(clauses) > 0 {
+			last := len(occurs) - 1
+			if conj == ltAnd && occurs[last] != occurMustNot {
+				occurs[last] = occurMust
+			} else if p.defaultAnd && conj == ltOr && occurs[last] != occurMustNot {
+				occurs[last] = occurShould
+			}
+		}
+		occur := occurShould
+		switch {
+		case mods == occurMustNot:
+			occur = occurMustNot
+		case mods == occurMust:
+			occur = occurMust
+		case conj == ltAnd:
+			occur = occurMust
+		case p.defaultAnd && conj != ltOr:
+			occur = occurMust
+		}
+		clauses = append(clauses, clause)
+		occurs = append(occurs, occur)
+	}
+
+	if len(clauses) == 0 {
+		if start.kind == ltEOF && p.i == 0 {
+			return nil, &QuerySyntaxError{Pos: start.pos, Msg: "empty query"}
+		}
+		return nil, &QuerySyntaxError{Pos: start.pos, Msg: "empty group"}
+	}
+	if len(clauses) == 1 && occurs[0] != occurMustNot {
+		return clauses[0], nil
+	}
+
+	node := &dslNode{kind: DSL_BOOL}
+	for i, c := range clauses {
+		switch occurs[i] {
+		case occurMust:
+			node.must = append(node.must, c)
+		case occurMustNot:
+			node.mustNot = append(node.mustNot, c)
+		default:
+			node.should = append(node.should, c)
+		}
+	}
+	if len(node.must) == 0 && len(node.should) > 0 {
+		// 只有should时至少要满足一个
+		node.minShould = 1
+	}
+	return node, nil
+}
+
+// 解析一个子句和它的权重
+func (p *luceneParser) parseClause(field *conf.Field) (node *dslNode, err error) {
+	t := p.next()
+	switch t.kind {
+	case ltLParen:
+		if node, err = p.parseGroup(field, t); err != nil {
+			return nil, err
+		}
+	case ltWord, ltPhrase:
+		if t.kind == ltWord && p.peek().kind == ltColon {
+			if field != nil {
+				return nil, &QuerySyntaxError{Pos: t.pos, Msg: "nested field prefix"}
+			}
+			p.next()
+			if node, err = p.parseFieldValue(t); err != nil {
+				return nil, err
+			}
+			break
+		}
+		if node, err = p.leaf(field, t); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, p.unexpected(t)
+	}
+
+	if p.peek().kind == ltCaret {
+		p.next()
+		b := p.next()
+		boost, e := strconv.ParseFloat(b.text, 32)
+		if b.kind != ltWord || e != nil || boost <= 0 {
+			return nil, &QuerySyntaxError{Pos: b.pos, Msg: "positive boost number expected"}
+		}
+		node.boost = float32(boost)
+	}
+	return node, nil
+}
+
+func (p *luceneParser) parseGroup(field *conf.Field, lparen *luceneToken) (*dslNode, error) {
+	node, err := p.parseQuery(field)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.next(); t.kind != ltRParen {
+		if t.kind == ltEOF {
+			return nil, &QuerySyntaxError{Pos: lparen.pos, Msg: "unclosed '('"}
+		}
+		return nil, p.unexpected(t)
+	}
+	return node, nil
+}
+
+// 解析"字段名:"之后的部分
+func (p *luceneParser) parseFieldValue(name *luceneToken) (*dslNode, error) {
+	fIdx, ok := p.idx.schema.FieldMap[name.text]
+	if !ok {
+		return nil, &QuerySyntaxError{Pos: name.pos, Msg: fmt.Sprintf("field %q not found", name.text)}
+	}
+	field := &p.idx.schema.Fields[fIdx]
+
+	t := p.next()
+	switch t.kind {
+	case ltLParen:
+		return p.parseGroup(field, t)
+	case ltLBracket:
+		return p.parseRange(field, fIdx, t)
+	case ltWord:
+		if t.text == "*" {
+			return &dslNode{kind: DSL_EXISTS, fieldName: field.Name, fIdx: fIdx}, nil
+		}
+		return p.leaf(field, t)
+	case ltPhrase:
+		return p.leaf(field, t)
+	default:
+		return nil, p.unexpected(t)
+	}
+}
+
+// 区间: [from TO to]，边界可以是"*"
+func (p *luceneParser) parseRange(field *conf.Field, fIdx int, lbracket *luceneToken) (*dslNode, error) {
+	r := range_{fromExcl: lbracket.text == "{"}
+	bound := func() (interface{}, error) {
+		t := p.next()
+		if t.kind != ltWord && t.kind != ltPhrase {
+			return nil, p.unexpected(t)
+		}
+		if t.kind == ltWord && t.text == "*" {
+			return nil, nil
+		}
+		v, err := field.ToNativeValue(t.text)
+		if err != nil {
+			return nil, &QuerySyntaxError{Pos: t.pos, Msg: fmt.Sprintf("field %s: %v", field.Name, err)}
+		}
+		return v, nil
+	}
+
+	var err error
+	if r.from, err = bound(); err != nil {
+		return nil, err
+	}
+	if t := p.next(); t.kind != ltTo {
+		return nil, &QuerySyntaxError{Pos: t.pos, Msg: fmt.Sprintf("TO expected but %s found", t)}
+	}
+	if r.to, err = bound(); err != nil {
+		return nil, err
+	}
+	t := p.next()
+	if t.kind != ltRBracket {
+		if t.kind == ltEOF {
+			return nil, &QuerySyntaxError{Pos: lbracket.pos, Msg: "unclosed range"}
+		}
+		return nil, p.unexpected(t)
+	}
+	r.toExcl = t.text == "}"
+
+	if r.from == nil && r.to == nil {
+		return &dslNode{kind: DSL_EXISTS, fieldName: field.Name, fIdx: fIdx}, nil
+	}
+	f := &filter{fieldName: field.Name, fIdx: fIdx, ranges: []range_{r}}
+	return &dslNode{kind: DSL_RANGE, fieldName: field.Name, fIdx: fIdx, f: f}, nil
+}
+
+// 词或短语: 分词的字符串字段是match，短语要求词的位置连续；其它字段是term
+func (p *luceneParser) leaf(field *conf.Field, t *luceneToken) (*dslNode, error) {
+	phrase := t.kind == ltPhrase
+	if t.wildcard {
+		return p.wildcard(field, t)
+	}
+	if field == nil {
+		tokens := hanziTokenize(t.text)
+		if len(tokens) == 0 {
+			return nil, &QuerySyntaxError{Pos: t.pos, Msg: fmt.Sprintf("no token in %q", t.text)}
+		}
+		return &dslNode{kind: DSL_MATCH, fIdx: -1, tokens: tokens, and: phrase, phrase: phrase, slop: t.slop}, nil
+	}
+
+	fIdx := p.idx.schema.FieldMap[field.Name]
+	switch field.Type {
+	case "str", "string":
+		if field.Tokenizer != conf.NONE_TOKENIZER {
+			tokens := fieldTokenize(field, t.text)
+			if len(tokens) == 0 {
+				return nil, &QuerySyntaxError{Pos: t.pos, Msg: fmt.Sprintf("no token in %q", t.text)}
+			}
+			return &dslNode{kind: DSL_MATCH, fieldName: field.Name, fIdx: fIdx, tokens: tokens, and: phrase, phrase: phrase, slop: t.slop}, nil
+		}
+	case "json":
+		return nil, &QuerySyntaxError{Pos: t.pos, Msg: fmt.Sprintf("json field %s can't be queried", field.Name)}
+	}
+
+	v, err := field.ToNativeValue(t.text)
+	if err != nil {
+		return nil, &QuerySyntaxError{Pos: t.pos, Msg: fmt.Sprintf("field %s: %v", field.Name, err)}
+	}
+	f := &filter{fieldName: field.Name, fIdx: fIdx, conds: []interface{}{v}}
+	return &dslNode{kind: DSL_TERM, fieldName: field.Name, fIdx: fIdx, f: f}, nil
+}
+
+// 通配符: 扩展成字段中的词，doc包含其中一个词即满足
+func (p *luceneParser) wildcard(field *conf.Field, t *luceneToken) (*dslNode, error) {
+	fIdx := -1
+	node := &dslNode{kind: DSL_MATCH}
+	if field != nil {
+		if field.Type != "str" && field.Type != "string" {
+			return nil, &QuerySyntaxError{Pos: t.pos, Msg: fmt.Sprintf("wildcard is only supported by string field, %s is not", field.Name)}
+		}
+		fIdx = p.idx.schema.FieldMap[field.Name]
+		node.fieldName = field.Name
+	}
+	terms, err := p.idx.expandWildcard(fIdx, t.text)
+	if err != nil {
+		return nil, err
+	}
+	node.fIdx, node.tokens = fIdx, terms
+	return node, nil
+}
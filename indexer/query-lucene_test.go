@@ -0,0 +1,102 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"testing"
+)
+
+func TestQueryLucene(t *testing.T) {
+	schema := &conf.Schema{
+		Name: "lucene-test",
+		SchemaConf: &conf.SchemaConf{Fields: []conf.Field{
+			{Name: "id", Type: "u32", PK: true},
+			{Name: "title", Type: "str"},
+			{Name: "brand", Type: "str", Tokenizer: conf.NONE_TOKENIZER},
+			{Name: "status", Type: "str", Tokenizer: conf.NONE_TOKENIZER},
+			{Name: "price", Type: "u16"},
+			{Name: "temp", Type: "i16"},
+		}},
+		FieldMap: map[string]int{"id": 0, "title": 1, "brand": 2, "status": 3, "price": 4, "temp": 5},
+	}
+	idx := &indexer{schema: schema}
+
+	docs := []StoredDoc{
+		{"id": uint32(1), "title": "red shoes", "brand": "nike", "status": "sold", "price": uint16(20), "temp": int16(-3)},
+		{"id": uint32(2), "title": "red running shoes", "brand": "adidas", "status": "new", "price": uint16(50), "temp": int16(-12)},
+		{"id": uint32(3), "title": "blue shoes", "brand": "nike", "status": "new", "price": uint16(30), "temp": int16(5)},
+		{"id": uint32(4), "title": "red shoes", "brand": "puma", "status": "new", "price": uint16(10)},
+		{"id": uint32(5), "title": "red shoes", "brand": "adidas", "price": uint16(51)},
+	}
+	cases := []struct {
+		q        string
+		qop      string
+		expected []uint32
+	}{
+		{`title:"red shoes"~1 AND (brand:nike OR brand:adidas) -status:sold price:[10 TO 50]`, "", []uint32{2, 5}},
+		{`title:"red shoes"~1 AND (brand:nike OR brand:adidas) -status:sold price:[10 TO 50]`, "AND", []uint32{2}},
+		{`title:"red shoes"`, "", []uint32{1, 4, 5}},
+		{`"shoes red"~2`, "", []uint32{1, 4, 5}},
+		{`"shoes red"~3`, "", []uint32{1, 2, 4, 5}},
+		{`red running`, "", []uint32{1, 2, 4, 5}},
+		{`red running`, "and", []uint32{2}},
+		{`price:{20 TO *] NOT brand:adidas`, "", []uint32{3}},
+		{`status:* && !(title:blue || brand:puma)`, "", []uint32{1, 2}},
+		{`title:(blue running)^2`, "", []uint32{2, 3}},
+		{`temp:-3`, "", []uint32{1}},
+		{`temp:[-10 TO 5]`, "", []uint32{1, 3}},
+		{`temp:{-20 TO -3}`, "", []uint32{2}},
+		{`shoes -temp:-3`, "", []uint32{2, 3, 4, 5}},
+	}
+	for _, c := range cases {
+		root, err := idx.compileLucene(c.q, c.qop)
+		if err != nil {
+			t.Fatalf("%s: %v", c.q, err)
+		}
+		found := []uint32{}
+		for _, d := range docs {
+			if d.matchesDSL(root, schema) {
+				found = append(found, d["id"].(uint32))
+			}
+		}
+		if len(found) != len(c.expected) {
+			t.Fatalf("%s(q.op=%s): expected %v, got %v", c.q, c.qop, c.expected, found)
+		}
+		for i := range found {
+			if found[i] != c.expected[i] {
+				t.Fatalf("%s(q.op=%s): expected %v, got %v", c.q, c.qop, c.expected, found)
+			}
+		}
+	}
+
+	// 短语的词离得越远相关度越低
+	root, _ := idx.compileLucene(`"red shoes"~1`, "")
+	if r1, r2 := docs[0].relevance(root, schema), docs[1].relevance(root, schema); r1 <= r2 {
+		t.Fatalf(`"red shoes"~1: relevance of %q(%v) should be greater than %q(%v)`, docs[0]["title"], r1, docs[1]["title"], r2)
+	}
+	// 不在引号中的词也是离得越远越靠后
+	near := &dslNode{kind: DSL_MATCH, fIdx: -1, tokens: []string{"red", "shoes"}}
+	if r1, r2 := docs[0].tokens(schema).proximity(near), docs[1].tokens(schema).proximity(near); r1 <= r2 {
+		t.Fatalf(`red shoes: proximity of %q(%v) should be greater than %q(%v)`, docs[0]["title"], r1, docs[1]["title"], r2)
+	}
+
+	errors := map[string]int{
+		`title:(red`:     7,
+		`red AND`:        8,
+		`AND red`:        1,
+		`"red shoes`:     1,
+		`"red shoes"~x`:  12,
+		`price:[1 5]`:    10,
+		`price:[1 TO x]`: 13,
+		`nope:1`:         1,
+		`red^x`:          5,
+		`red)`:           4,
+		`()`:             2,
+	}
+	for q, pos := range errors {
+		_, err := idx.compileLucene(q, "")
+		e, ok := err.(*QuerySyntaxError)
+		if !ok || e.Pos != pos {
+			t.Fatalf("%s: syntax error at %d expected, got %v", q, pos, err)
+		}
+	}
+}
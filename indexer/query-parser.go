@@ -87,6 +87,32 @@ func parseQ(q string) (*query, error) {
 	return res, nil
 }
 
+// q中的短语: "term1 term2"或"term1 term2"~N，返回引号中的内容和slop
+func parsePhrase(s string) (text string, slop int, ok bool) {
+	if len(s) < 2 {
+		return "", 0, false
+	}
+	quote := s[0]
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", 0, false
+	}
+	end := strings.IndexByte(s[1:], quote) + 1
+	if end <= 0 {
+		return "", 0, false
+	}
+	if rest := s[end+1:]; len(rest) > 0 {
+		if rest[0] != '~' {
+			return "", 0, false
+		}
+		n, err := strconv.Atoi(rest[1:])
+		if err != nil || n < 0 {
+			return "", 0, false
+		}
+		slop = n
+	}
+	return s[1:end], slop, true
+}
+
 // fq: f1:q-in-field,f2:q-field,...
 func parseFq(fq string) ([]fquery, error) {
 	fs := fieldsKeepQuote(fq, ',', ';')
@@ -3,6 +3,9 @@ package indexer
 import (
 	"github.com/go-ego/riot/types"
 	"go-search/conf"
+	"context"
+	"sort"
+	"sync"
 	"fmt"
 	"reflect"
 	"strings"
@@ -37,6 +40,99 @@ func Query(index, q, fq, s, f, page, pagesize, fl string) (pagination interface{
 	return
 }
 
+// 查询结果中的一个doc
+type matchedDoc struct {
+	docId string
+	doc   StoredDoc
+}
+
+// queryAll每批取出的doc数
+const queryAllBatch = 10000
+
+// 查询所有满足q、fq、f条件的doc，不分页，依次输出，ctx被取消后停止输出并关闭返回的chan。
+// 先在打分时收集所有满足条件的doc的docId(不输出搜索结果)，再按docId分批搜索，只有一批doc的结果在内存中
+func (idx *indexer) queryAll(ctx context.Context, q, fq, f string) (<-chan matchedDoc, error) {
+	pq, err := parseQuery(q, fq, "", f, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	pq.start, pq.rows = 0, 0 // MaxOutputs为0时输出一批中的全部结果
+
+	sr, err := idx.pq2SearchQuery(pq)
+	if err != nil {
+		return nil, err
+	}
+	var docIds []string
+	var lock sync.Mutex
+	collector := *sr.RankOpts.ScoringCriteria.(*scorerT)
+	collector.collect = func(docId string, doc StoredDoc) {
+		// 各个shard并发打分
+		lock.Lock()
+		docIds = append(docIds, docId)
+		lock.Unlock()
+	}
+	rankOpts := *sr.RankOpts
+	rankOpts.ScoringCriteria = &collector
+	lookup := *sr
+	lookup.RankOpts = &rankOpts // 不能用Orderless，Orderless时不调用打分函数
+	idx.engine.Search(lookup)
+	// 一个doc有多个查询的词时会被打分多次
+	sort.Strings(docIds)
+	n := 0
+	for i, docId := range docIds {
+		if i == 0 || docId != docIds[n-1] {
+			docIds[n] = docId
+			n += 1
+		}
+	}
+	docIds = docIds[:n]
+
+	docsCh := make(chan matchedDoc)
+	go func() {
+		defer close(docsCh)
+
+		for start := 0; start < len(docIds); start += queryAllBatch {
+			if ctx.Err() != nil {
+				return
+			}
+			end := start + queryAllBatch
+			if end > len(docIds) {
+				end = len(docIds)
+			}
+			batch := make(map[string]bool, end-start)
+			for _, docId := range docIds[start:end] {
+				batch[docId] = true
+			}
+			// 有些查询riot不按DocIds过滤，打分时也要过滤
+			scorer := *sr.RankOpts.ScoringCriteria.(*scorerT)
+			scorer.docIds = batch
+			batchOpts := *sr.RankOpts
+			batchOpts.ScoringCriteria = &scorer
+			req := *sr
+			req.RankOpts = &batchOpts
+			req.DocIds = batch
+			resp := idx.engine.Search(req)
+			docs, ok := resp.Docs.(types.ScoredDocs)
+			if !ok {
+				continue
+			}
+			for _, doc := range docs {
+				storedDoc, ok := doc.Fields.(StoredDoc)
+				if !ok {
+					continue
+				}
+				select {
+				case docsCh <- matchedDoc{docId: doc.DocId, doc: storedDoc}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return docsCh, nil
+}
+
 // 转换为搜索引擎的搜索参数
 func (idx *indexer) pq2SearchQuery(pq *parsedQuery) (*types.SearchReq, error) {
 	// fl
@@ -54,12 +150,15 @@ func (idx *indexer) pq2SearchQuery(pq *parsedQuery) (*types.SearchReq, error) {
 			ScoringCriteria: &scorerT{
 				schema: idx.schema,
 				pq: pq,
+				now: idx.expireCheckTime(),
 			},
 			OutputOffset: pq.start,
 			MaxOutputs: pq.rows,
 		},
 	}
 
+	// q、fq中的短语、通配符
+	sc := &scoredClauses{root: &dslNode{kind: DSL_BOOL}}
 	if pq.labels == nil {
 		sr.Logic = types.Logic{
 			Expr: types.Expr{
@@ -69,9 +168,13 @@ func (idx *indexer) pq2SearchQuery(pq *parsedQuery) (*types.SearchReq, error) {
 			},
 		}
 		// q
-		idx.generateTokens(pq.should, &sr.Logic.Should, &sr.Logic.Expr.Should)
-		idx.generateTokens(pq.must, &sr.Logic.Must, &sr.Logic.Expr.Must)
-		idx.generateTokens(pq.notIn, &sr.Logic.NotIn, &sr.Logic.Expr.NotIn)
+		should, must, notIn, err := idx.compileQuery(sc, pq.query, -1, &sr.Logic)
+		if err != nil {
+			return nil, err
+		}
+		idx.generateTokens(should, &sr.Logic.Should, &sr.Logic.Expr.Should)
+		idx.generateTokens(must, &sr.Logic.Must, &sr.Logic.Expr.Must)
+		idx.generateTokens(notIn, &sr.Logic.NotIn, &sr.Logic.Expr.NotIn)
 	}
 
 	// fq
@@ -82,11 +185,26 @@ func (idx *indexer) pq2SearchQuery(pq *parsedQuery) (*types.SearchReq, error) {
 				continue
 			}
 
-			idx.generateFieldTokens(fIdx, fq.query.should, &sr.Logic.Should, &sr.Logic.Expr.Should)
-			idx.generateFieldTokens(fIdx, fq.query.must, &sr.Logic.Must, &sr.Logic.Expr.Must)
-			idx.generateFieldTokens(fIdx, fq.query.notIn, &sr.Logic.NotIn, &sr.Logic.Expr.NotIn)
+			should, must, notIn, err := idx.compileQuery(sc, fq.query, fIdx, &sr.Logic)
+			if err != nil {
+				return nil, err
+			}
+			idx.generateFieldTokens(fIdx, should, &sr.Logic.Should, &sr.Logic.Expr.Should)
+			idx.generateFieldTokens(fIdx, must, &sr.Logic.Must, &sr.Logic.Expr.Must)
+			idx.generateFieldTokens(fIdx, notIn, &sr.Logic.NotIn, &sr.Logic.Expr.NotIn)
 		}
 	}
+	if !sr.Logic.Should && sc.narrow != nil {
+		// doc必须包含一个扩展出的词
+		sr.Logic.Should = true
+		sr.Logic.Expr.Should = sc.narrow.indexTokens()
+	}
+	if tree := sc.tree(); tree != nil || len(sc.near) > 0 {
+		scorer := sr.RankOpts.ScoringCriteria.(*scorerT)
+		scorer.tree = tree
+		scorer.near = sc.near
+		scorer.relevance = pq.sortBys == nil // 没有指定排序时，满足的should子句多、短语和不在引号中的词离得近的靠前
+	}
 
 	// if there's not, there's must
 	if sr.Logic.NotIn && !sr.Logic.Must {
@@ -111,6 +229,170 @@ func (idx *indexer) pq2SearchQuery(pq *parsedQuery) (*types.SearchReq, error) {
 	return &sr, nil
 }
 
+// q、fq中需要在Score中判断的子句: 短语、must的通配符、不分词字段的通配符
+type scoredClauses struct {
+	root   *dslNode   // bool子句
+	words  []*dslNode // q、fq中其它的should词，doc至少要满足一个should子句或者包含一个should词
+	narrow *dslNode   // 第一个扩展出词的must通配符，没有should词时用来缩小候选doc的范围
+	near   []*dslNode // q、fq中不在引号中的多个词，只用于计算相关度，词离得越近越靠前
+}
+
+// 子句树，没有需要在Score中判断的子句时为nil
+func (sc *scoredClauses) tree() *dslNode {
+	root := sc.root
+	if len(root.must) == 0 && len(root.should) == 0 && len(root.mustNot) == 0 {
+		return nil
+	}
+	if len(root.should) > 0 {
+		root.should = append(root.should, sc.words...)
+		root.minShould = 1
+	}
+	return root
+}
+
+// 把q或fq中的短语、通配符编译成子句加到sc中，返回需要分词后转换成检索条件的should、must、notIn
+//   - 短语只把它的词加到检索条件中，多个词的短语不能用于排除doc，词的位置在Score中判断
+//   - 通配符扩展出的词直接加到检索条件中，must的通配符要求doc包含其中一个词，在Score中判断
+//   - 引号中的'*'、'?'不是通配符，如"is it red?"是短语
+//   - 不分词的字段没有索引，通配符都在Score中判断，引号中的内容还是作为普通的查询串
+//   fIdx: fq的字段，<0表示q
+func (idx *indexer) compileQuery(sc *scoredClauses, q *query, fIdx int, logic *types.Logic) (should, must, notIn []string, err error) {
+	var field *conf.Field
+	fieldName, indexed := "", true
+	if fIdx >= 0 {
+		field = &idx.schema.Fields[fIdx]
+		fieldName, indexed = field.Name, field.Tokenizer != conf.NONE_TOKENIZER
+	}
+	tokenize := func(s string) []string {
+		if field == nil {
+			return hanziTokenize(s)
+		}
+		return fieldTokenize(field, s)
+	}
+	phrase := func(s string) (*dslNode, string) {
+		text, slop, ok := parsePhrase(s)
+		if !ok || !indexed {
+			return nil, ""
+		}
+		return &dslNode{kind: DSL_MATCH, fieldName: fieldName, fIdx: fIdx, tokens: tokenize(text), and: true, phrase: true, slop: slop}, text
+	}
+	// 扩展出的词加到检索条件中，返回匹配其中任何一个词的子句
+	wildcard := func(s string, flag *bool, res *[]string) (*dslNode, error) {
+		terms, err := idx.expandWildcard(fIdx, s)
+		if err != nil {
+			return nil, err
+		}
+		if indexed && flag != nil && len(terms) > 0 {
+			for _, t := range terms {
+				if fIdx >= 0 {
+					t = fmt.Sprintf("f%d:%s", fIdx, t)
+				}
+				*res = append(*res, t)
+			}
+			*flag = true
+		}
+		return &dslNode{kind: DSL_MATCH, fieldName: fieldName, fIdx: fIdx, tokens: terms}, nil
+	}
+
+	words := &dslNode{kind: DSL_MATCH, fieldName: fieldName, fIdx: fIdx, tokens: []string{}}
+	near, seen := &dslNode{kind: DSL_MATCH, fieldName: fieldName, fIdx: fIdx}, map[string]bool{}
+	addNear := func(tokens []string) {
+		for _, t := range tokens {
+			if !seen[t] {
+				seen[t] = true
+				near.tokens = append(near.tokens, t)
+			}
+		}
+	}
+	for _, s := range q.should {
+		if _, _, quoted := parsePhrase(s); !quoted && isWildcard(s) {
+			n, err := wildcard(s, &logic.Should, &logic.Expr.Should)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if len(n.tokens) == 0 || !indexed {
+				// 没有扩展出词时需要用子句排除doc
+				sc.root.should = append(sc.root.should, n)
+			} else {
+				words.tokens = append(words.tokens, n.tokens...)
+			}
+			continue
+		}
+		n, text := phrase(s)
+		if n == nil {
+			should = append(should, s)
+			if indexed {
+				tokens := tokenize(s)
+				words.tokens = append(words.tokens, tokens...)
+				addNear(tokens)
+			}
+			continue
+		}
+		if len(n.tokens) > 0 {
+			should = append(should, text)
+			sc.root.should = append(sc.root.should, n)
+		}
+	}
+	if len(words.tokens) > 0 {
+		sc.words = append(sc.words, words)
+	}
+
+	for _, s := range q.must {
+		if _, _, quoted := parsePhrase(s); !quoted && isWildcard(s) {
+			n, err := wildcard(s, nil, nil)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if indexed && len(n.tokens) > 0 && sc.narrow == nil {
+				sc.narrow = n
+			}
+			sc.root.must = append(sc.root.must, n)
+			continue
+		}
+		n, text := phrase(s)
+		if n == nil {
+			must = append(must, s)
+			if indexed {
+				addNear(tokenize(s))
+			}
+			continue
+		}
+		if len(n.tokens) > 0 {
+			must = append(must, text)
+			sc.root.must = append(sc.root.must, n)
+		}
+	}
+
+	if len(near.tokens) > 1 {
+		sc.near = append(sc.near, near)
+	}
+
+	for _, s := range q.notIn {
+		if _, _, quoted := parsePhrase(s); !quoted && isWildcard(s) {
+			n, err := wildcard(s, &logic.NotIn, &logic.Expr.NotIn)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if !indexed {
+				sc.root.mustNot = append(sc.root.mustNot, n)
+			}
+			continue
+		}
+		n, text := phrase(s)
+		if n == nil {
+			notIn = append(notIn, s)
+			continue
+		}
+		if len(n.tokens) > 0 {
+			if len(n.tokens) == 1 {
+				notIn = append(notIn, text)
+			}
+			sc.root.mustNot = append(sc.root.mustNot, n)
+		}
+	}
+	return
+}
+
 func (idx *indexer) generateTokens(qs []string, flag *bool, res *[]string) {
 	if qs == nil || len(qs) == 0 {
 		return
@@ -331,30 +613,41 @@ func checkFilterRanges(field *conf.Field, franges *[]range_) {
 type scorerT struct {
 	schema *conf.Schema
 	pq     *parsedQuery
+	now    int64 // 不为0时隐藏在该时间(UnixNano)已经过期的doc
+	expiredOnly bool // 只输出已经过期的doc，用于清除过期doc
+	tree   *dslNode // JSON查询或短语的子句树，不为nil时doc必须满足
+	near   []*dslNode // 计算相关度时，其中的词离得越近越靠前
+	relevance bool  // 是否先按子句树的相关度排序
+	collect func(docId string, doc StoredDoc) // 不为nil时只收集满足条件的doc，不输出结果
+	docIds  map[string]bool    // 不为nil时只输出其中的doc
 }
 
-const (
-	// 最大临近距离
-	MaxTokenProximity = 2
-)
-
 // 打分函数，是types.ScoringCriteria接口定义的函数
 func (scorer *scorerT) Score(doc types.IndexedDoc, fields interface{}) []float32 {
-	// 评分第一步
-	// fmt.Printf("doc.TokenProximity: %d\n", doc.TokenProximity)
-	if doc.TokenProximity > MaxTokenProximity {
+	if reflect.TypeOf(fields) != reflect.TypeOf(StoredDoc{}) {
+		return []float32{}
+	}
+	storedDoc := fields.(StoredDoc)
+	if scorer.docIds != nil && !scorer.docIds[doc.DocId] {
 		return []float32{}
 	}
 
-	if reflect.TypeOf(fields) != reflect.TypeOf(StoredDoc{}) {
+	if scorer.now != 0 && storedDoc.expired(scorer.now) != scorer.expiredOnly {
 		return []float32{}
 	}
-	storedDoc := fields.(StoredDoc)
 
 	// 通过字段过滤去掉不需要的doc
 	if !storedDoc.satisfied(scorer.pq.filters, scorer.schema) {
 		return []float32{}
 	}
+	dt := storedDoc.tokens(scorer.schema)
+	if scorer.tree != nil && !dt.matches(scorer.tree) {
+		return []float32{}
+	}
+	if scorer.collect != nil {
+		scorer.collect(doc.DocId, storedDoc)
+		return []float32{}
+	}
 
 	// fmt.Printf("doc.BM25: %v\n", doc.BM25)
 	/*
@@ -363,7 +656,18 @@ func (scorer *scorerT) Score(doc types.IndexedDoc, fields interface{}) []float32
 		return []float32{float32(int(doc.BM25))}
 	}*/
 
-	return storedDoc.score(scorer.pq.sortBys, int(doc.BM25))
+	scores := storedDoc.score(scorer.pq.sortBys, int(doc.BM25))
+	if scorer.relevance {
+		var r float32
+		if scorer.tree != nil {
+			r = dt.relevance(scorer.tree)
+		}
+		for _, n := range scorer.near {
+			r += dt.proximity(n)
+		}
+		return append([]float32{r}, scores...)
+	}
+	return scores
 }
 
 func (d StoredDoc) score(sortBys []sorting, bm25 int) []float32 {
@@ -406,6 +710,12 @@ func sortingScore(storedVal interface{}, bm25 int) float32 {
 			return float32(2)
 		}
 		return float32(1)
+	case []interface{}:
+		// 多值字段按第一个值排序
+		if vs := storedVal.([]interface{}); len(vs) > 0 {
+			return sortingScore(vs[0], bm25)
+		}
+		return float32(0)
 	default:
 		return float32(0)
 	}
@@ -423,34 +733,54 @@ func (d StoredDoc) satisfied(filters []filter, schema *conf.Schema) bool {
 			return false
 		}
 
-		if f.conds != nil {
-			found := false
-			tokenizer := schema.Fields[f.fIdx].Tokenizer
-			for _, cond := range f.conds {
-				if condEquals(storedVal, cond, tokenizer) {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return false
+		// 多值字段只要有一个值满足条件即可
+		vals, ok := storedVal.([]interface{})
+		if !ok {
+			vals = []interface{}{storedVal}
+		}
+		found := false
+		for _, v := range vals {
+			if f.satisfiedBy(v, schema) {
+				found = true
+				break
 			}
 		}
+		if !found {
+			return false
+		}
+	}
 
-		if f.ranges != nil {
-			found := false
-			for _, r := range f.ranges {
-				if inRange(storedVal, &r) {
-					found = true
-					break
-				}
-			}
-			if !found {
-				return false
+	return true
+}
+
+// 判断一个字段值是否满足过滤条件
+func (f *filter) satisfiedBy(storedVal interface{}, schema *conf.Schema) bool {
+	if f.conds != nil {
+		found := false
+		tokenizer := schema.Fields[f.fIdx].Tokenizer
+		for _, cond := range f.conds {
+			if condEquals(storedVal, cond, tokenizer) {
+				found = true
+				break
 			}
 		}
+		if !found {
+			return false
+		}
 	}
 
+	if f.ranges != nil {
+		found := false
+		for _, r := range f.ranges {
+			if inRange(storedVal, &r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
 	return true
 }
 
@@ -484,13 +814,13 @@ func inRange(storedVal interface{}, r *range_) bool {
 		sv := storedVal.(string)
 		if r.from != nil {
 			r1 := r.from.(string)
-			if sv < r1 {
+			if sv < r1 || (r.fromExcl && sv == r1) {
 				return false
 			}
 		}
 		if r.to != nil {
 			r2 := r.to.(string)
-			if sv > r2 {
+			if sv > r2 || (r.toExcl && sv == r2) {
 				return false
 			}
 		}
@@ -498,13 +828,13 @@ func inRange(storedVal interface{}, r *range_) bool {
 		sv := reflect.ValueOf(storedVal).Int()
 		if r.from != nil {
 			r1 := reflect.ValueOf(r.from).Int()
-			if sv < r1 {
+			if sv < r1 || (r.fromExcl && sv == r1) {
 				return false
 			}
 		}
 		if r.to != nil {
 			r2 := reflect.ValueOf(r.to).Int()
-			if sv > r2 {
+			if sv > r2 || (r.toExcl && sv == r2) {
 				return false
 			}
 		}
@@ -512,13 +842,13 @@ func inRange(storedVal interface{}, r *range_) bool {
 		sv := reflect.ValueOf(storedVal).Uint()
 		if r.from != nil {
 			r1 := reflect.ValueOf(r.from).Uint()
-			if sv < r1 {
+			if sv < r1 || (r.fromExcl && sv == r1) {
 				return false
 			}
 		}
 		if r.to != nil {
 			r2 := reflect.ValueOf(r.to).Uint()
-			if sv > r2 {
+			if sv > r2 || (r.toExcl && sv == r2) {
 				return false
 			}
 		}
@@ -526,13 +856,13 @@ func inRange(storedVal interface{}, r *range_) bool {
 		sv := reflect.ValueOf(storedVal).Float()
 		if r.from != nil {
 			r1 := reflect.ValueOf(r.from).Float()
-			if sv < r1 {
+			if sv < r1 || (r.fromExcl && sv == r1) {
 				return false
 			}
 		}
 		if r.to != nil {
 			r2 := reflect.ValueOf(r.to).Float()
-			if sv > r2 {
+			if sv > r2 || (r.toExcl && sv == r2) {
 				return false
 			}
 		}
@@ -584,32 +914,10 @@ func (idx *indexer) outputResult(searchResp *types.SearchResp, pq *parsedQuery)
 			}
 
 			outFieldList := pq.outFieldList
-			if outFieldList == nil {
-				if schema.TimeIdx == nil {
-					retDoc = storedDoc
-				} else {
-					retDoc = StoredDoc{}
-					for k, v := range storedDoc {
-						if fIdx, ok := schema.TimeIdx[k]; !ok {
-							retDoc[k] = v
-						} else {
-							field := &schema.Fields[fIdx]
-							retDoc[k] = field.FormatDatetime(v)
-						}
-					}
-				}
+			if outFieldList == nil && schema.TimeIdx == nil && !schema.HasTTL() {
+				retDoc = storedDoc
 			} else {
-				retDoc = StoredDoc{}
-				for _, f := range outFieldList {
-					if v, ok := storedDoc[f]; ok {
-						if fIdx, ok := schema.TimeIdx[f]; !ok {
-							retDoc[f] = v
-						} else {
-							field := &schema.Fields[fIdx]
-							retDoc[f] = field.FormatDatetime(v)
-						}
-					}
-				}
+				retDoc = idx.formatStoredDoc(storedDoc, outFieldList)
 			}
 
 			docsCh <- retDoc
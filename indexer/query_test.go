@@ -0,0 +1,80 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"context"
+	"strings"
+	"testing"
+	"fmt"
+)
+
+func TestQueryAll(t *testing.T) {
+	conf.ServiceConf.RootDir = t.TempDir()
+	conf.ServiceConf.Inbox.Disabled = true
+	schema := `{"fields":[{"name":"id","type":"u32","pk":true},{"name":"name"},{"name":"brand","tokenizer":"none"}]}`
+	if err := conf.SaveSchema("qall", strings.NewReader(schema)); err != nil {
+		t.Fatal(err)
+	}
+	StartIndexers(2)
+	defer StopIndexers(2)
+	defer closeIndexer("qall")
+
+	for i := 1; i <= 30; i++ {
+		name, brand := "red shoes", "nike"
+		if i % 3 == 0 {
+			name, brand = "blue hat", "puma"
+		}
+		doc := map[string]interface{}{"id": float64(i), "name": fmt.Sprintf("%s %d", name, i), "brand": brand}
+		if _, err := IndexDoc("qall", doc, REFRESH_FALSE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx, err := initIndexer("qall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.flushAndWait()
+
+	// 有多个词的查询每个doc只输出一次
+	cases := []struct {
+		q, f     string
+		expected int
+	}{
+		{"", "", 30},
+		{"red shoes", "", 20},
+		{"red shoes hat", "", 30},
+		{"", "brand:puma", 10},
+	}
+	for _, c := range cases {
+		docs, err := idx.queryAll(context.Background(), c.q, "", c.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := map[string]bool{}
+		for d := range docs {
+			if seen[d.docId] {
+				t.Fatalf("q=%s f=%s: doc %s is output more than once", c.q, c.f, d.docId)
+			}
+			seen[d.docId] = true
+		}
+		if len(seen) != c.expected {
+			t.Fatalf("q=%s f=%s: %d docs expected, got %d", c.q, c.f, c.expected, len(seen))
+		}
+	}
+
+	// 取消后不再输出
+	ctx, cancel := context.WithCancel(context.Background())
+	docs, err := idx.queryAll(ctx, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-docs
+	cancel()
+	count := 0
+	for range docs {
+		count += 1
+	}
+	if count > 1 {
+		t.Fatalf("queryAll should stop after cancelled, got %d more docs", count)
+	}
+}
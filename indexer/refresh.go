@@ -0,0 +1,165 @@
+package indexer
+
+import (
+	"fmt"
+	"time"
+)
+
+// 写操作的refresh参数
+const (
+	REFRESH_DEFAULT  = ""         // 按索引库的刷新策略
+	REFRESH_TRUE     = "true"     // 立即刷新，返回时已经可以搜到
+	REFRESH_FALSE    = "false"    // 不刷新
+	REFRESH_WAIT_FOR = "wait_for" // 等待下一次刷新后返回，没有刷新间隔时同REFRESH_TRUE
+)
+
+// 后台刷新检查的间隔，也是refresh-interval的最小精度
+const refreshTick = 100 * time.Millisecond
+
+var (
+	refreshStopChan    chan struct{}
+	refreshStoppedChan chan struct{}
+)
+
+func CheckRefresh(refresh string) error {
+	switch refresh {
+	case REFRESH_DEFAULT, REFRESH_TRUE, REFRESH_FALSE, REFRESH_WAIT_FOR:
+		return nil
+	default:
+		return fmt.Errorf("unknown refresh value %s, true, false or wait_for expected", refresh)
+	}
+}
+
+// 没有刷新间隔时，每次写操作后都刷新，更新操作会强制更新索引
+func (idx *indexer) refreshEachWrite() bool {
+	return idx.refreshInterval <= 0
+}
+
+// 写操作返回前调用，按refresh参数和索引库的刷新策略刷新
+func (idx *indexer) afterWrite(refresh string) {
+	if idx = idx.current(); idx == nil {
+		// 已经关闭，关闭时已经刷新
+		return
+	}
+	switch refresh {
+	case REFRESH_TRUE:
+		idx.flushAndWait()
+	case REFRESH_WAIT_FOR:
+		if idx.refreshEachWrite() {
+			idx.flushAndWait()
+			return
+		}
+		done := make(chan struct{})
+		idx.refreshLock.Lock()
+		idx.dirty = true
+		idx.waiters = append(idx.waiters, done)
+		idx.refreshLock.Unlock()
+		if idx.current() != idx || refresherStopped() {
+			// 已经被关闭(LRU回收等)或者后台刷新已经停止，没有人会再刷新，直接刷新。
+			// 在这之前关闭或停止时，关闭、最后一次后台刷新会通知waiters
+			idx.flushAndWait()
+		}
+		<-done
+	case REFRESH_FALSE:
+		idx.markDirty()
+	default:
+		if idx.refreshEachWrite() {
+			idx.flush()
+		} else {
+			idx.markDirty()
+		}
+	}
+}
+
+func (idx *indexer) markDirty() {
+	idx.refreshLock.Lock()
+	idx.dirty = true
+	idx.refreshLock.Unlock()
+}
+
+// 立即刷新，并等待刷新完成
+func (idx *indexer) flushAndWait() {
+	idx.refreshLock.Lock()
+	waiters := idx.waiters
+	idx.waiters, idx.dirty, idx.lastRefresh = nil, false, time.Now()
+	idx.refreshLock.Unlock()
+
+	done := make(chan struct{})
+	idx.flush(append(waiters, done)...)
+	<-done
+}
+
+// 有更新且到了刷新时间(或者force)时刷新，刷新完成后通知等待的写操作
+func (idx *indexer) refreshIfDirty(now time.Time, force bool) {
+	idx.refreshLock.Lock()
+	if !idx.dirty || (!force && now.Sub(idx.lastRefresh) < idx.refreshInterval) {
+		idx.refreshLock.Unlock()
+		return
+	}
+	waiters := idx.waiters
+	idx.waiters, idx.dirty, idx.lastRefresh = nil, false, now
+	idx.refreshLock.Unlock()
+
+	idx.flush(waiters...)
+}
+
+func startRefresher() {
+	refreshStopChan = make(chan struct{})
+	refreshStoppedChan = make(chan struct{})
+	go refreshThread()
+}
+
+// 停止前刷新所有有更新的索引库
+func stopRefresher() {
+	if refreshStopChan == nil {
+		return
+	}
+	close(refreshStopChan)
+	<-refreshStoppedChan
+}
+
+// 是否已经开始停止后台刷新
+func refresherStopped() bool {
+	if refreshStopChan == nil {
+		return true
+	}
+	select {
+	case <-refreshStopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func refreshThread() {
+	defer close(refreshStoppedChan)
+
+	ticker := time.NewTicker(refreshTick)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		stopping := false
+		select {
+		case <-refreshStopChan:
+			now, stopping = time.Now(), true
+		case now = <-ticker.C:
+		}
+
+		indexerLock.RLock()
+		idxes := make([]*indexer, 0, len(indexers))
+		for _, idx := range indexers {
+			if !idx.refreshEachWrite() {
+				idxes = append(idxes, idx)
+			}
+		}
+		indexerLock.RUnlock()
+
+		for _, idx := range idxes {
+			idx.refreshIfDirty(now, stopping)
+		}
+		if stopping {
+			return
+		}
+	}
+}
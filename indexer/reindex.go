@@ -0,0 +1,176 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"context"
+	"fmt"
+	"time"
+)
+
+// reindex的参数
+type ReindexOpts struct {
+	Source        string            `json:"source"`          // 源索引库
+	Dest          string            `json:"dest"`            // 目标索引库，schema必须已经存在
+	Q             string            `json:"q"`               // 只导入满足q、fq、f条件的doc，同/search/:index
+	Fq            string            `json:"fq"`
+	F             string            `json:"f"`
+	Rename        map[string]string `json:"rename"`          // 字段改名，源字段名 -> 目标字段名，在pipeline之前执行
+	Pipeline      string            `json:"pipeline"`        // 导入时使用的pipeline，缺省使用目标schema中的pipeline，PIPELINE_NONE表示不使用
+	DocsPerSecond int               `json:"docs-per-second"` // 每秒最多导入的doc数，0表示不限速
+	OnError       string            `json:"on-error"`        // ON_ERROR_SKIP(缺省)或ON_ERROR_ABORT
+	Cb            string            `json:"cb"`              // 结束后回调的url，可以为空
+	Refresh       string            `json:"refresh"`         // 结束后的刷新方式，同IndexDoc的refresh参数
+}
+
+// 检查reindex的参数，不检查索引库是否存在
+func CheckReindexOpts(opts *ReindexOpts) error {
+	if opts.Source == "" || opts.Dest == "" {
+		return fmt.Errorf("source and dest expected")
+	}
+	if opts.Source == opts.Dest {
+		return fmt.Errorf("source and dest must be different")
+	}
+	if opts.DocsPerSecond < 0 {
+		return fmt.Errorf("docs-per-second must not be negative")
+	}
+	switch opts.OnError {
+	case "", ON_ERROR_SKIP, ON_ERROR_ABORT:
+	default:
+		return fmt.Errorf("unknown on-error value %s, skip or abort expected", opts.OnError)
+	}
+	return CheckRefresh(opts.Refresh)
+}
+
+// 把源索引库中满足条件的doc导入到目标索引库，后台运行，返回jobId
+func Reindex(opts *ReindexOpts) (jobId string, err error) {
+	if !running {
+		return "", fmt.Errorf("the service is stopped")
+	}
+	if err = CheckReindexOpts(opts); err != nil {
+		return "", err
+	}
+
+	src, err := initIndexer(opts.Source)
+	if err != nil {
+		return "", fmt.Errorf("schema %s not found", opts.Source)
+	}
+	dest, err := initIndexer(opts.Dest)
+	if err != nil {
+		return "", fmt.Errorf("schema %s not found, please create schema first", opts.Dest)
+	}
+	pl, err := dest.getPipeline(opts.Pipeline)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	matched, err := src.queryAll(ctx, opts.Q, opts.Fq, opts.F)
+	if err != nil {
+		cancel()
+		return "", err
+	}
+
+	importOpts := &ImportOpts{
+		Async: true,
+		Cb: opts.Cb,
+		OnError: opts.OnError,
+		Pipeline: opts.Pipeline,
+		Refresh: opts.Refresh,
+	}
+	j := newJob("reindex", opts.Dest)
+	j.status.Source = opts.Source
+	stop := make(chan struct{})
+	docChan := src.reindexDocs(matched, dest.schema, opts, stop)
+	go func() {
+		dest.indexDocs(docChan, j, pl, importOpts)
+		close(stop)
+		cancel()
+		for range docChan {
+		}
+	}()
+	return j.status.Id, nil
+}
+
+// 把查询到的doc转换为导入的doc，按docs-per-second限速。stop被关闭后读完剩余的doc并退出
+func (idx *indexer) reindexDocs(matched <-chan matchedDoc, dest *conf.Schema, opts *ReindexOpts, stop <-chan struct{}) <-chan Doc {
+	docChan := make(chan Doc)
+	go func() {
+		defer close(docChan)
+		defer func() {
+			for range matched {
+			}
+		}()
+
+		startTime := time.Now()
+		count := 0
+		for d := range matched {
+			if opts.DocsPerSecond > 0 {
+				// 导入速度超过限制时等待
+				expected := time.Duration(count) * time.Second / time.Duration(opts.DocsPerSecond)
+				if wait := expected - time.Since(startTime); wait > 0 {
+					select {
+					case <-stop:
+						return
+					case <-time.After(wait):
+					}
+				}
+			}
+
+			doc := idx.reindexDoc(d.doc, dest, opts.Rename)
+
+			select {
+			case <-stop:
+				return
+			case docChan <- Doc{doc: doc}:
+			}
+			count += 1
+		}
+	}()
+	return docChan
+}
+
+// 把保存的doc转换为目标索引库导入的doc，并按rename改名。
+// 时间字段在目标中也是时间字段时直接使用保存的UnixNano，否则按源字段的格式格式化，
+// 因为源、目标字段的time-fmt可能不同
+func (idx *indexer) reindexDoc(storedDoc StoredDoc, dest *conf.Schema, rename map[string]string) map[string]interface{} {
+	schema := idx.schema
+	doc := map[string]interface{}{}
+	for k, v := range storedDoc {
+		if k == conf.EXPIRE_AT_FIELD {
+			continue
+		}
+		name := k
+		if to, ok := rename[k]; ok {
+			name = to
+		}
+		if fIdx, ok := schema.TimeIdx[k]; ok {
+			if _, ok = dest.TimeIdx[name]; !ok {
+				v = schema.Fields[fIdx].FormatDatetime(v)
+			}
+			doc[name] = v
+			continue
+		}
+		doc[name] = jsonValue(v)
+	}
+	return doc
+}
+
+// 把保存的字段值转换为从JSON解析出来的类型，以便目标字段的类型和源字段不同时也能转换
+func jsonValue(v interface{}) interface{} {
+	switch v.(type) {
+	case []interface{}:
+		vs := v.([]interface{})
+		res := make([]interface{}, len(vs))
+		for i, v := range vs {
+			res[i] = jsonValue(v)
+		}
+		return res
+	case float32:
+		return float64(v.(float32))
+	default:
+		if n, ok := numericValue(v); ok {
+			return n
+		}
+		return v
+	}
+}
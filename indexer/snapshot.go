@@ -0,0 +1,543 @@
+package indexer
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"go-search/conf"
+	"encoding/json"
+	"archive/tar"
+	"path/filepath"
+	"io/ioutil"
+	"strings"
+	"regexp"
+	"sort"
+	"sync"
+	"path"
+	"time"
+	"fmt"
+	"log"
+	"io"
+	"os"
+)
+
+// 索引库快照: 快照仓库中每个索引库一个目录，每个快照是一个tar.zst包和一个描述文件
+//   <repo-dir>/<index>/<name>.tar.zst
+//   <repo-dir>/<index>/<name>.json
+// 包中的文件路径相对于索引库目录:
+//   - 使用持久化(USE_STORE)时，包含schema.json和store文件，做快照时索引库会被关闭，期间的请求会等待
+//   - 不使用持久化、有WAL时，WAL中有所有的doc，换段后包含schema.json和换段前的WAL段，只在换段时暂停更新
+//   - 不使用持久化、没有WAL时，包含schema.json和一个由所有doc生成的WAL段，只在取出所有doc时暂停更新
+//   恢复时内存模式通过重放WAL建索引。恢复只替换schema.json、store文件和WAL，索引库目录中的inbox、webhooks、sources等保留
+const (
+	snapshotExt     = ".tar.zst"
+	snapshotInfoExt = ".json"
+	snapshotDefaultRepo = "_snapshots"
+	restoringDir    = "_restoring" // 恢复时先解压到"<root-dir>/_restoring"下的临时目录
+)
+
+// 快照名和索引库名都会用作文件名
+var snapshotNamePattern = regexp.MustCompile(`^[0-9A-Za-z_\-][0-9A-Za-z_.\-]*$`)
+
+// 快照信息
+type SnapshotInfo struct {
+	Index      string    `json:"index"`
+	Name       string    `json:"name"`
+	Store      string    `json:"store"`          // 持久化方式，""表示内存模式的快照
+	Docs       int       `json:"docs,omitempty"` // 内存模式快照中的doc数
+	Size       int64     `json:"size"`           // 快照包的大小
+	CreateTime time.Time `json:"create-time"`
+	Elapsed    float64   `json:"elapsed"`        // 做快照的耗时，单位秒
+}
+
+func snapshotRepo() string {
+	if repo := conf.ServiceConf.Snapshot.RepoDir; repo != "" {
+		return repo
+	}
+	return path.Join(conf.ServiceConf.RootDir, snapshotDefaultRepo)
+}
+
+func snapshotFile(index, name, ext string) string {
+	return path.Join(snapshotRepo(), index, fmt.Sprintf("%s%s", name, ext))
+}
+
+func checkSnapshotName(index, name string) error {
+	if !snapshotNamePattern.MatchString(index) {
+		return fmt.Errorf("bad index name %q", index)
+	}
+	if !snapshotNamePattern.MatchString(name) {
+		return fmt.Errorf("bad snapshot name %q", name)
+	}
+	return nil
+}
+
+// 给索引库做快照
+//   name: 快照名，空串表示使用当前时间
+func CreateSnapshot(index, name string) (*SnapshotInfo, error) {
+	if !running {
+		return nil, fmt.Errorf("the service is stopped")
+	}
+	if name == "" {
+		name = time.Now().Format("20060102-150405")
+	}
+	if err := checkSnapshotName(index, name); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(snapshotFile(index, name, snapshotInfoExt)); err == nil {
+		return nil, fmt.Errorf("snapshot %s of %s already exists", name, index)
+	}
+
+	schema, err := conf.LoadSchema(index)
+	if err != nil {
+		return nil, fmt.Errorf("schema of %s not found", index)
+	}
+	var idx *indexer
+	if len(conf.UseStore) == 0 {
+		// 内存模式需要从索引库中导出doc
+		if idx, err = initIndexer(index); err != nil {
+			return nil, err
+		}
+	}
+
+	resume, err := pauseIndexer(index)
+	if err != nil {
+		return nil, err
+	}
+	defer resume()
+
+	info := &SnapshotInfo{Index: index, Name: name, Store: conf.UseStore, CreateTime: time.Now()}
+	if err = os.MkdirAll(path.Dir(snapshotFile(index, name, "")), 0755); err != nil {
+		return nil, err
+	}
+	archive := snapshotFile(index, name, snapshotExt)
+	tmpArchive := fmt.Sprintf("%s.tmp", archive)
+	fp, err := os.Create(tmpArchive)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpArchive)
+	defer fp.Close()
+
+	zw, err := zstd.NewWriter(fp)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(zw)
+	if err = addFileToTar(tw, path.Join(schema.StorePath, "schema.json"), "schema.json"); err != nil {
+		return nil, err
+	}
+	if idx == nil {
+		// 关闭索引库，保证store文件是一致的
+		closeIndexer(index)
+		err = addStoreToTar(tw, schema.StorePath)
+	} else if idx.wal != nil {
+		err = idx.addWalToTar(tw)
+	} else {
+		// 等待正在进行的更新写入后取出所有doc，之后的更新不在快照中
+		idx.writeLock.Lock()
+		<-idx.drain()
+		docs := idx.collectDocs()
+		idx.writeLock.Unlock()
+		info.Docs, err = idx.addDumpedWalToTar(tw, archive, docs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	if err = fp.Sync(); err != nil {
+		return nil, err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info.Size = fi.Size()
+	if err = os.Rename(tmpArchive, archive); err != nil {
+		return nil, err
+	}
+
+	info.Elapsed = time.Since(info.CreateTime).Seconds()
+	b, _ := json.MarshalIndent(info, "", "  ")
+	if err = ioutil.WriteFile(snapshotFile(index, name, snapshotInfoExt), b, 0644); err != nil {
+		os.Remove(archive)
+		return nil, err
+	}
+	log.Printf("[info] snapshot %s of index %s created, %d bytes\n", name, index, info.Size)
+	return info, nil
+}
+
+// 把store目录(riot.<shard>)下的文件加到包中
+func addStoreToTar(tw *tar.Writer, storePath string) error {
+	dirs, err := filepath.Glob(path.Join(storePath, "riot.*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		err = filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(storePath, file)
+			if err != nil {
+				return err
+			}
+			return addFileToTar(tw, file, filepath.ToSlash(rel))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 换新的WAL段，把之前的段加到包中。换段时持有walLock，换段前写入WAL的更新都在包中。
+// 做快照期间索引库被暂停，不会被重新加载，旧的段不会被压缩或删除
+func (idx *indexer) addWalToTar(tw *tar.Writer) error {
+	idx.walLock.Lock()
+	seq := idx.wal.rotateIf(0)
+	idx.walLock.Unlock()
+
+	dir := idx.schema.WalPath()
+	segs, err := listWalSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segs {
+		if seq >= 0 && s > seq {
+			// 换段后写入的段
+			break
+		}
+		seg := walSegmentFile(dir, s)
+		if err = addFileToTar(tw, seg, path.Join("wal", path.Base(seg))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 取出索引库中所有doc的引用，doc更新时会生成新的StoredDoc，取出的doc不会再被修改
+func (idx *indexer) collectDocs() []matchedDoc {
+	pq, err := parseQuery("", "", "", "", "", "", "")
+	if err != nil {
+		return nil
+	}
+	pq.start, pq.rows = 0, 0
+	sr, err := idx.pq2SearchQuery(pq)
+	if err != nil {
+		return nil
+	}
+	var docs []matchedDoc
+	var lock sync.Mutex
+	scorer := sr.RankOpts.ScoringCriteria.(*scorerT)
+	scorer.collect = func(docId string, doc StoredDoc) {
+		lock.Lock()
+		docs = append(docs, matchedDoc{docId: docId, doc: doc})
+		lock.Unlock()
+	}
+	idx.engine.Search(*sr)
+
+	// 一个doc会被打分多次时只保留一个
+	sort.Slice(docs, func(i, j int) bool { return docs[i].docId < docs[j].docId })
+	n := 0
+	for i := range docs {
+		if i == 0 || docs[i].docId != docs[n-1].docId {
+			docs[n] = docs[i]
+			n += 1
+		}
+	}
+	return docs[:n]
+}
+
+// 把doc写成一个WAL段加到包中，返回doc数
+func (idx *indexer) addDumpedWalToTar(tw *tar.Writer, archive string, docs []matchedDoc) (int, error) {
+	tmpDir := fmt.Sprintf("%s.wal", archive)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	w := &wal{dir: tmpDir, mode: conf.WAL_OFF}
+	if err := w.openSegment(); err != nil {
+		return 0, err
+	}
+	defer w.close()
+
+	count := 0
+	for _, d := range docs {
+		_, data, err := idx.buildDocData(idx.formatStoredDoc(d.doc, nil))
+		if err != nil {
+			return 0, fmt.Errorf("doc %s: %v", d.docId, err)
+		}
+		data.Fields = d.doc // 保留原来的字段值，包括过期时间
+		if err = w.append(_INDEX_DOC, d.docId, data); err != nil {
+			return 0, err
+		}
+		count += 1
+	}
+	if err := w.sync(); err != nil {
+		return 0, err
+	}
+	seg := walSegmentFile(tmpDir, w.seq)
+	return count, addFileToTar(tw, seg, path.Join("wal", path.Base(seg)))
+}
+
+func addFileToTar(tw *tar.Writer, file, name string) error {
+	fp, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, fp, fi.Size())
+	return err
+}
+
+func loadSnapshotInfo(index, name string) (*SnapshotInfo, error) {
+	b, err := ioutil.ReadFile(snapshotFile(index, name, snapshotInfoExt))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("snapshot %s of %s not found", name, index)
+		}
+		return nil, err
+	}
+	var info SnapshotInfo
+	if err = json.Unmarshal(b, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// 获取快照信息
+func GetSnapshot(index, name string) (*SnapshotInfo, error) {
+	if err := checkSnapshotName(index, name); err != nil {
+		return nil, err
+	}
+	return loadSnapshotInfo(index, name)
+}
+
+// 列出快照
+//   index: 索引库名，空串表示所有索引库
+func ListSnapshots(index string) ([]SnapshotInfo, error) {
+	pattern := path.Join(snapshotRepo(), "*", fmt.Sprintf("*%s", snapshotInfoExt))
+	if index != "" {
+		if !snapshotNamePattern.MatchString(index) {
+			return nil, fmt.Errorf("bad index name %q", index)
+		}
+		pattern = snapshotFile(index, "*", snapshotInfoExt)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	res := []SnapshotInfo{}
+	for _, file := range files {
+		index, name := path.Base(path.Dir(file)), strings.TrimSuffix(path.Base(file), snapshotInfoExt)
+		info, err := loadSnapshotInfo(index, name)
+		if err != nil {
+			log.Printf("[error] failed to load snapshot %s: %v\n", file, err)
+			continue
+		}
+		res = append(res, *info)
+	}
+	return res, nil
+}
+
+// 删除快照
+func DeleteSnapshot(index, name string) error {
+	if err := checkSnapshotName(index, name); err != nil {
+		return err
+	}
+	if _, err := loadSnapshotInfo(index, name); err != nil {
+		return err
+	}
+	if err := os.Remove(snapshotFile(index, name, snapshotInfoExt)); err != nil {
+		return err
+	}
+	return os.Remove(snapshotFile(index, name, snapshotExt))
+}
+
+// 从快照恢复索引库
+//   to: 恢复到的索引库名，空串表示恢复到原索引库
+//   overwrite: 索引库已经存在时是否覆盖
+func RestoreSnapshot(index, name, to string, overwrite bool) (*SnapshotInfo, error) {
+	if !running {
+		return nil, fmt.Errorf("the service is stopped")
+	}
+	info, err := GetSnapshot(index, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.Store != "" && info.Store != conf.UseStore {
+		return nil, fmt.Errorf("snapshot %s of %s was taken with store %s, it can't be restored with store %q", name, index, info.Store, conf.UseStore)
+	}
+	if to == "" {
+		to = index
+	} else if err = checkSnapshotName(to, name); err != nil {
+		return nil, err
+	}
+
+	resume, err := pauseIndexer(to)
+	if err != nil {
+		return nil, err
+	}
+	err = extractSnapshotTo(snapshotFile(index, name, snapshotExt), to, overwrite)
+	resume()
+	if err != nil {
+		return nil, err
+	}
+
+	// 加载索引库，内存模式的快照在这时重放WAL
+	if _, err = initIndexer(to); err != nil {
+		return nil, err
+	}
+	log.Printf("[info] snapshot %s of index %s restored to %s\n", name, index, to)
+	return info, nil
+}
+
+// 索引库目录中属于快照的数据: schema.json、store文件(riot.<shard>)和WAL。
+// 持久化时原来的WAL中是被替换的数据的更新，不能重放到恢复的数据上，所以也被替换(快照中没有WAL时删除)
+func snapshotDataFiles(dir string) ([]string, error) {
+	names := []string{"schema.json", "wal"}
+	stores, err := filepath.Glob(path.Join(dir, "riot.*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, store := range stores {
+		names = append(names, path.Base(store))
+	}
+	return names, nil
+}
+
+// 把快照解压到索引库目录，需要暂停索引库后调用
+// 先解压到同一个文件系统的临时目录，成功后再替换原来索引库的数据，出错时原来的索引库不受影响
+func extractSnapshotTo(archive, index string, overwrite bool) error {
+	dir := path.Join(conf.ServiceConf.RootDir, index)
+	_, err := os.Stat(dir)
+	exists := err == nil
+	if exists && !overwrite {
+		return fmt.Errorf("index %s already exists", index)
+	}
+
+	tmpRoot := path.Join(conf.ServiceConf.RootDir, restoringDir)
+	if err = os.MkdirAll(tmpRoot, 0755); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(tmpRoot, index+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err = os.Chmod(tmpDir, 0755); err != nil {
+		return err
+	}
+	if err = extractSnapshot(archive, tmpDir); err != nil {
+		return err
+	}
+
+	if !exists {
+		return os.Rename(tmpDir, dir)
+	}
+	closeIndexer(index)
+	oldNames, err := snapshotDataFiles(dir)
+	if err != nil {
+		return err
+	}
+	newNames, err := snapshotDataFiles(tmpDir)
+	if err != nil {
+		return err
+	}
+	old := tmpDir + ".old"
+	if err = os.Mkdir(old, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(old)
+
+	// 先把原来的数据移到old，再把快照中的数据移进来，出错时换回原来的数据
+	var movedOut, movedIn []string
+	rollback := func() {
+		for _, name := range movedIn {
+			os.RemoveAll(path.Join(dir, name))
+		}
+		for _, name := range movedOut {
+			os.Rename(path.Join(old, name), path.Join(dir, name))
+		}
+	}
+	for _, name := range oldNames {
+		if _, err = os.Lstat(path.Join(dir, name)); os.IsNotExist(err) {
+			continue
+		}
+		if err = os.Rename(path.Join(dir, name), path.Join(old, name)); err != nil {
+			rollback()
+			return err
+		}
+		movedOut = append(movedOut, name)
+	}
+	for _, name := range newNames {
+		if _, err = os.Lstat(path.Join(tmpDir, name)); os.IsNotExist(err) {
+			continue
+		}
+		if err = os.Rename(path.Join(tmpDir, name), path.Join(dir, name)); err != nil {
+			rollback()
+			return err
+		}
+		movedIn = append(movedIn, name)
+	}
+	return nil
+}
+
+func extractSnapshot(archive, dir string) error {
+	fp, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	zr, err := zstd.NewReader(fp)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("bad file %s in snapshot", hdr.Name)
+		}
+		file := path.Join(dir, name)
+		if err = os.MkdirAll(path.Dir(file), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
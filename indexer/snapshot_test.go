@@ -0,0 +1,81 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"path"
+	"os"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	conf.ServiceConf.RootDir = t.TempDir()
+	conf.ServiceConf.Inbox.Disabled = true
+	StartIndexers(2)
+	defer StopIndexers(2)
+
+	for _, wal := range []string{"sync", "off"} {
+		index := "snap-" + wal
+		schema := `{"fields":[{"name":"id","type":"u32","pk":true},{"name":"name"}],"wal":"` + wal + `"}`
+		if err := conf.SaveSchema(index, strings.NewReader(schema)); err != nil {
+			t.Fatal(err)
+		}
+		defer closeIndexer(index)
+
+		for i := 1; i <= 3; i++ {
+			if _, err := IndexDoc(index, map[string]interface{}{"id": float64(i), "name": "before"}, REFRESH_FALSE); err != nil {
+				t.Fatal(err)
+			}
+		}
+		info, err := CreateSnapshot(index, "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wal == "off" && info.Docs != 3 {
+			t.Fatalf("%s: 3 docs expected in the snapshot, got %d", index, info.Docs)
+		}
+
+		// 做快照后的更新，恢复后不应该存在
+		if _, err = IndexDoc(index, map[string]interface{}{"id": float64(4), "name": "after"}, REFRESH_FALSE); err != nil {
+			t.Fatal(err)
+		}
+		if err = DeleteDoc(index, 1, REFRESH_TRUE); err != nil {
+			t.Fatal(err)
+		}
+		// 不属于快照的文件，恢复后保留
+		dir := path.Join(conf.ServiceConf.RootDir, index)
+		if err = os.MkdirAll(path.Join(dir, "inbox"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path.Join(dir, "inbox", "a.ndjson"), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = RestoreSnapshot(index, "s1", "", false); err == nil {
+			t.Fatalf("%s: restoring to an existing index without overwrite should fail", index)
+		}
+		if _, err = RestoreSnapshot(index, "s1", "", true); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 4; i++ {
+			doc, err := GetDoc(index, i, "")
+			if exists := err == nil && doc != nil; exists != (i <= 3) {
+				t.Fatalf("%s: doc %d exists: %v after restore", index, i, exists)
+			}
+		}
+		if _, err = os.Stat(path.Join(dir, "inbox", "a.ndjson")); err != nil {
+			t.Fatalf("%s: inbox should be kept after restore: %v", index, err)
+		}
+
+		// 恢复到另一个索引库
+		to := index + "-copy"
+		defer closeIndexer(to)
+		if _, err = RestoreSnapshot(index, "s1", to, false); err != nil {
+			t.Fatal(err)
+		}
+		if doc, err := GetDoc(to, 1, ""); err != nil || doc == nil {
+			t.Fatalf("%s: doc 1 expected, got %v", to, err)
+		}
+	}
+}
@@ -0,0 +1,557 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"encoding/json"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"net"
+	"strconv"
+	"strings"
+	"path"
+	"sync"
+	"io"
+	"time"
+	"fmt"
+	"log"
+	"os"
+)
+
+const (
+	sourcesFile = "sources.json"
+	sourceCheckInterval = time.Second // 检查source是否需要运行的间隔
+
+	// url和params中的该占位符会被替换为watermark
+	WATERMARK_PLACEHOLDER = "{{watermark}}"
+)
+
+// 定期从http拉取数据导入的数据源
+type Source struct {
+	Id             string            `json:"id"`
+	Url            string            `json:"url"`
+	Format         string            `json:"format"`            // 数据格式，同上传文件的扩展名(不含"."): json,jsonl,csv,tsv,xml，可以加上gz,zst，如"jsonl.gz"
+	Every          string            `json:"every"`             // 拉取间隔，如"30s","10m","1h"
+	Headers        map[string]string `json:"headers,omitempty"` // 请求头
+	Params         map[string]string `json:"params,omitempty"`  // query参数，值中可以有WATERMARK_PLACEHOLDER，watermark为空时不加含有占位符的参数
+	WatermarkField string            `json:"watermark-field,omitempty"` // 用于增量拉取的字段，导入后该字段的最大值成为新的watermark
+	Watermark      string            `json:"watermark,omitempty"`       // 当前的watermark
+	Charset        string            `json:"charset,omitempty"`
+	XmlRecord      string            `json:"record,omitempty"`
+	Disabled       bool              `json:"disabled,omitempty"`
+	Status         SourceStatus      `json:"status"`
+}
+
+// 最近一次拉取的状态
+type SourceStatus struct {
+	State   string     `json:"state,omitempty"` // JOB_RUNNING/JOB_DONE/JOB_FAILED/JOB_CANCELLED
+	Error   string     `json:"error,omitempty"`
+	Job     string     `json:"job,omitempty"`
+	LastRun *time.Time `json:"last-run,omitempty"`
+	NextRun *time.Time `json:"next-run,omitempty"`
+	Docs    int        `json:"docs"`   // 成功导入的doc数
+	Failed  int        `json:"failed"` // 出错的doc数
+}
+
+var (
+	sourcesLock = &sync.Mutex{}     // 读写sources.json的锁
+	runningSources = map[string]string{} // "index/id" -> jobId，jobId为空表示正在拉取
+	sourcesWg = &sync.WaitGroup{}
+	sourcesStopChan    chan struct{}
+	sourcesStoppedChan chan struct{}
+
+	// 拉取的请求在stopSources时取消，连接和等待响应头都有超时，读取响应体不限时间
+	sourcesCtx    context.Context
+	sourcesCancel context.CancelFunc
+	sourceClient  = &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}}
+)
+
+func (src *Source) check() error {
+	if src.Id == "" || strings.ContainsAny(src.Id, "/\\") {
+		return fmt.Errorf("bad source id %q", src.Id)
+	}
+	u, err := url.Parse(src.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("http or https url expected")
+	}
+	if _, err = src.generator(); err != nil {
+		return err
+	}
+	if _, err = src.interval(); err != nil {
+		return err
+	}
+	return CheckCharset(src.Charset)
+}
+
+func (src *Source) interval() (time.Duration, error) {
+	d, err := time.ParseDuration(src.Every)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("bad every value %q, a duration like 30s, 10m, 1h expected", src.Every)
+	}
+	return d, nil
+}
+
+func (src *Source) generator() (fnReaderGenerator, error) {
+	format := src.Format
+	if format == "" {
+		format = "json"
+	}
+	ext, _ := SplitCompressedExt("." + format)
+	docGenerator, ok := ext2Generator[ext]
+	if !ok {
+		return nil, fmt.Errorf("unsupported format %s", src.Format)
+	}
+	return docGenerator, nil
+}
+
+// 下次运行的时间，没有运行过的source立即运行
+func (src *Source) nextRun(now time.Time) *time.Time {
+	if src.Disabled {
+		return nil
+	}
+	d, err := src.interval()
+	if err != nil {
+		return nil
+	}
+	next := now
+	if src.Status.LastRun != nil {
+		next = src.Status.LastRun.Add(d)
+	}
+	return &next
+}
+
+// 生成请求的url，把占位符替换为watermark
+func (src *Source) requestUrl() (string, error) {
+	u, err := url.Parse(strings.Replace(src.Url, WATERMARK_PLACEHOLDER, url.QueryEscape(src.Watermark), -1))
+	if err != nil {
+		return "", err
+	}
+	if len(src.Params) == 0 {
+		return u.String(), nil
+	}
+	q := u.Query()
+	for k, v := range src.Params {
+		if strings.Contains(v, WATERMARK_PLACEHOLDER) {
+			if src.Watermark == "" {
+				continue
+			}
+			v = strings.Replace(v, WATERMARK_PLACEHOLDER, src.Watermark, -1)
+		}
+		q.Set(k, v)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func sourcesPath(index string) string {
+	d := path.Join(conf.ServiceConf.RootDir, index)
+	return path.Join(d, sourcesFile)
+}
+
+// 读取一个索引库的所有source，调用者需要持有sourcesLock
+func loadSources(index string) ([]*Source, error) {
+	b, err := ioutil.ReadFile(sourcesPath(index))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Source{}, nil
+		}
+		return nil, err
+	}
+	var sources []*Source
+	if err = json.Unmarshal(b, &sources); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// 保存一个索引库的所有source，调用者需要持有sourcesLock
+func saveSources(index string, sources []*Source) error {
+	b, err := json.MarshalIndent(sources, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := sourcesPath(index)
+	tmp := p + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func findSource(sources []*Source, id string) int {
+	for i, src := range sources {
+		if src.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// 列出一个索引库的所有source
+func ListSources(index string) ([]*Source, error) {
+	if _, err := conf.LoadSchema(index); err != nil {
+		return nil, fmt.Errorf("index %s not found", index)
+	}
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+
+	sources, err := loadSources(index)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, src := range sources {
+		src.Status.NextRun = src.nextRun(now)
+	}
+	return sources, nil
+}
+
+// 获取一个source
+func GetSource(index, id string) (*Source, error) {
+	sources, err := ListSources(index)
+	if err != nil {
+		return nil, err
+	}
+	if i := findSource(sources, id); i >= 0 {
+		return sources[i], nil
+	}
+	return nil, fmt.Errorf("source %s not found", id)
+}
+
+// 增加或替换一个source。替换时如果没有给出watermark，保留原来的watermark
+func SaveSource(index string, src *Source) error {
+	if _, err := conf.LoadSchema(index); err != nil {
+		return fmt.Errorf("index %s not found", index)
+	}
+	if err := src.check(); err != nil {
+		return err
+	}
+
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+
+	sources, err := loadSources(index)
+	if err != nil {
+		return err
+	}
+	src.Status = SourceStatus{}
+	if i := findSource(sources, src.Id); i >= 0 {
+		src.Status = sources[i].Status
+		if src.Watermark == "" {
+			src.Watermark = sources[i].Watermark
+		}
+		sources[i] = src
+	} else {
+		sources = append(sources, src)
+	}
+	return saveSources(index, sources)
+}
+
+// 删除一个source
+func DeleteSource(index, id string) error {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+
+	sources, err := loadSources(index)
+	if err != nil {
+		return err
+	}
+	i := findSource(sources, id)
+	if i < 0 {
+		return fmt.Errorf("source %s not found", id)
+	}
+	sources = append(sources[:i], sources[i+1:]...)
+	return saveSources(index, sources)
+}
+
+// 更新source的状态，source可能已经被删除了
+func updateSource(index, id string, update func(src *Source)) {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+
+	sources, err := loadSources(index)
+	if err != nil {
+		return
+	}
+	if i := findSource(sources, id); i >= 0 {
+		update(sources[i])
+		if err = saveSources(index, sources); err != nil {
+			log.Printf("[error] failed to save sources of %s: %v\n", index, err)
+		}
+	}
+}
+
+// 立即拉取一个source，返回导入的jobId
+func RunSource(index, id string) (string, error) {
+	src, err := GetSource(index, id)
+	if err != nil {
+		return "", err
+	}
+	return runSource(index, src)
+}
+
+func runSource(index string, src *Source) (jobId string, err error) {
+	key := fmt.Sprintf("%s/%s", index, src.Id)
+	sourcesLock.Lock()
+	if _, ok := runningSources[key]; ok {
+		sourcesLock.Unlock()
+		return "", fmt.Errorf("source %s is running", src.Id)
+	}
+	runningSources[key] = ""
+	sourcesLock.Unlock()
+
+	now := time.Now()
+	finish := func(state string, e error, res *ImportResult) {
+		sourcesLock.Lock()
+		delete(runningSources, key)
+		sourcesLock.Unlock()
+
+		updateSource(index, src.Id, func(s *Source) {
+			s.Status.State = state
+			s.Status.Error = ""
+			if e != nil {
+				s.Status.Error = e.Error()
+			}
+			if res != nil {
+				s.Status.Failed = res.Failed
+			}
+		})
+		sourcesWg.Done()
+	}
+
+	sourcesWg.Add(1)
+	updateSource(index, src.Id, func(s *Source) {
+		s.Status = SourceStatus{State: JOB_RUNNING, LastRun: &now}
+	})
+
+	defer func() {
+		if err != nil {
+			log.Printf("[error] source %s of %s: %v\n", src.Id, index, err)
+			finish(JOB_FAILED, err, nil)
+		}
+	}()
+
+	docGenerator, err := src.generator()
+	if err != nil {
+		return
+	}
+	u, err := src.requestUrl()
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	for k, v := range src.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := sourceClient.Do(req.WithContext(sourcesContext()))
+	if err != nil {
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		err = fmt.Errorf("GET %s: %s", u, resp.Status)
+		return
+	}
+
+	_, compression := SplitCompressedExt("." + src.Format)
+	wm := &watermark{}
+	if wm.str = src.Watermark; wm.str != "" {
+		wm.num, wm.isNum = numberOf(wm.str)
+		wm.set = true
+	}
+	opts := &ImportOpts{
+		Async: true,
+		Charset: src.Charset,
+		XmlRecord: src.XmlRecord,
+		Compression: compression,
+		Source: src.Url,
+		OnIndexed: wm.update,
+		OnDone: func(jobId string, res *ImportResult) {
+			status, _ := GetJob(jobId)
+			state := JOB_DONE
+			if status != nil {
+				state = status.State
+				updateSource(index, src.Id, func(s *Source) {
+					s.Status.Docs = status.Succeeded
+				})
+			}
+			if state == JOB_DONE && wm.set && src.WatermarkField != "" {
+				// 只有导入完成才更新watermark，没有完成的下次重新拉取
+				updateSource(index, src.Id, func(s *Source) {
+					s.Watermark = wm.str
+				})
+			}
+			finish(state, res.Aborted, res)
+		},
+	}
+	if _, jobId, err = indexFromDocGenerator(index, resp.Body, decoded(withWatermark(docGenerator, src.WatermarkField)), opts); err != nil {
+		return
+	}
+
+	sourcesLock.Lock()
+	runningSources[key] = jobId
+	sourcesLock.Unlock()
+	updateSource(index, src.Id, func(s *Source) {
+		s.Status.Job = jobId
+	})
+	log.Printf("[info] source %s of %s started, job %s\n", src.Id, index, jobId)
+	return jobId, nil
+}
+
+// 导入过程中watermark字段的最大值。都是数值时按数值比较，否则按字符串比较
+type watermark struct {
+	set   bool
+	isNum bool
+	num   float64
+	str   string
+}
+
+func (wm *watermark) update(v interface{}) {
+	var s string
+	switch v.(type) {
+	case nil:
+		return
+	case float64:
+		s = strconv.FormatFloat(v.(float64), 'f', -1, 64)
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+	num, isNum := numberOf(s)
+
+	switch {
+	case !wm.set:
+	case wm.isNum && isNum:
+		if num <= wm.num {
+			return
+		}
+	default:
+		if s <= wm.str {
+			return
+		}
+		isNum = false
+	}
+	wm.set, wm.isNum, wm.num, wm.str = true, isNum, num, s
+}
+
+func numberOf(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// 把生成的doc中watermark字段的值记在Doc.mark中，成功写入后由OnIndexed计算最大值。
+// 出错的doc、被pipeline丢弃的doc不更新watermark
+func withWatermark(docGenerator fnReaderGenerator, field string) fnReaderGenerator {
+	if field == "" {
+		return docGenerator
+	}
+	return func(in io.Reader, opts *ImportOpts) (<-chan Doc, error) {
+		docs, err := docGenerator(in, opts)
+		if err != nil {
+			return nil, err
+		}
+		docChan := make(chan Doc)
+		go func() {
+			defer close(docChan)
+			for doc := range docs {
+				if doc.err == nil {
+					doc.mark = doc.doc[field]
+				}
+				docChan <- doc
+			}
+		}()
+		return docChan, nil
+	}
+}
+
+func sourcesContext() context.Context {
+	sourcesLock.Lock()
+	defer sourcesLock.Unlock()
+	if sourcesCtx == nil {
+		return context.Background()
+	}
+	return sourcesCtx
+}
+
+func startSources() {
+	sourcesLock.Lock()
+	sourcesCtx, sourcesCancel = context.WithCancel(context.Background())
+	sourcesLock.Unlock()
+	sourcesStopChan = make(chan struct{})
+	sourcesStoppedChan = make(chan struct{})
+	go sourcesThread()
+}
+
+// 停止调度，取消正在运行的导入并等待结束
+func stopSources() {
+	if sourcesStopChan == nil {
+		return
+	}
+	close(sourcesStopChan)
+	<-sourcesStoppedChan
+
+	sourcesLock.Lock()
+	for _, jobId := range runningSources {
+		if jobId != "" {
+			CancelJob(jobId)
+		}
+	}
+	// 取消还在等待响应或者读取响应体的请求
+	sourcesCancel()
+	sourcesLock.Unlock()
+	sourcesWg.Wait()
+}
+
+// 定期检查所有索引库的source，运行到期的source
+func sourcesThread() {
+	defer close(sourcesStoppedChan)
+
+	ticker := time.NewTicker(sourceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sourcesStopChan:
+			return
+		case now := <-ticker.C:
+			runDueSources(now)
+		}
+	}
+}
+
+func runDueSources(now time.Time) {
+	indexes, err := conf.ListIndexes()
+	if err != nil {
+		return
+	}
+	for _, index := range indexes {
+		sourcesLock.Lock()
+		sources, err := loadSources(index)
+		sourcesLock.Unlock()
+		if err != nil {
+			log.Printf("[error] failed to load sources of %s: %v\n", index, err)
+			continue
+		}
+
+		for _, src := range sources {
+			next := src.nextRun(now)
+			if next == nil || next.After(now) {
+				continue
+			}
+			sourcesLock.Lock()
+			_, running := runningSources[fmt.Sprintf("%s/%s", index, src.Id)]
+			sourcesLock.Unlock()
+			if !running {
+				go runSource(index, src)
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"net/http/httptest"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"sync"
+	"time"
+	"fmt"
+)
+
+func waitSource(t *testing.T, index, id string) *Source {
+	for i := 0; i < 100; i++ {
+		src, err := GetSource(index, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src.Status.LastRun != nil && src.Status.State != JOB_RUNNING {
+			return src
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("source %s is still running", id)
+	return nil
+}
+
+func TestSourceWatermark(t *testing.T) {
+	conf.ServiceConf.RootDir = t.TempDir()
+	conf.ServiceConf.Inbox.Disabled = true
+	conf.ServiceConf.Import.MaxErrors = 100
+	schema := `{"fields":[{"name":"id","type":"u32","pk":true},{"name":"ut","tokenizer":"none"}]}`
+	if err := conf.SaveSchema("src", strings.NewReader(schema)); err != nil {
+		t.Fatal(err)
+	}
+	StartIndexers(1)
+	defer StopIndexers(1)
+
+	var lock sync.Mutex
+	docs := []map[string]interface{}{}
+	for i := 1; i <= 3; i++ {
+		docs = append(docs, map[string]interface{}{"id": i, "ut": fmt.Sprintf("2020-01-0%d", i)})
+	}
+	sinces := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		since := r.URL.Query().Get("since")
+		sinces = append(sinces, since)
+		enc := json.NewEncoder(w)
+		for _, doc := range docs {
+			if doc["ut"].(string) > since {
+				enc.Encode(doc)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	err := SaveSource("src", &Source{
+		Id: "s1",
+		Url: srv.URL,
+		Format: "jsonl",
+		Every: "1h",
+		Headers: map[string]string{"X-Token": "secret"},
+		Params: map[string]string{"since": WATERMARK_PLACEHOLDER},
+		WatermarkField: "ut",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第一次由调度运行，全量拉取
+	src := waitSource(t, "src", "s1")
+	if src.Status.State != JOB_DONE || src.Status.Docs != 3 || src.Watermark != "2020-01-03" {
+		t.Fatalf("unexpected first run: %+v, watermark %s", src.Status, src.Watermark)
+	}
+
+	// 第二次只拉取watermark以后的doc
+	lock.Lock()
+	docs = append(docs, map[string]interface{}{"id": 4, "ut": "2020-01-04"})
+	lock.Unlock()
+	if _, err = RunSource("src", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	src = waitSource(t, "src", "s1")
+	if src.Status.State != JOB_DONE || src.Status.Docs != 1 || src.Watermark != "2020-01-04" {
+		t.Fatalf("unexpected second run: %+v, watermark %s", src.Status, src.Watermark)
+	}
+	if doc, err := GetDoc("src", "4", ""); err != nil || doc == nil {
+		t.Fatalf("doc 4 expected: %v", err)
+	}
+
+	// 写入失败的doc不更新watermark
+	lock.Lock()
+	docs = append(docs, map[string]interface{}{"id": "bad", "ut": "2020-01-09"})
+	lock.Unlock()
+	if _, err = RunSource("src", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	src = waitSource(t, "src", "s1")
+	if src.Status.Failed != 1 || src.Watermark != "2020-01-04" {
+		t.Fatalf("unexpected third run: %+v, watermark %s", src.Status, src.Watermark)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(sinces) != 3 || sinces[0] != "" || sinces[1] != "2020-01-03" {
+		t.Fatalf("unexpected since params: %q", sinces)
+	}
+}
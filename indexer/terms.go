@@ -0,0 +1,301 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"context"
+	"strings"
+	"sort"
+	"sync"
+	"fmt"
+	"log"
+)
+
+// 每个字符串字段的词典，用于把前缀(iph*)、通配符(te?m*)扩展成索引中的词
+//   - 第一次扩展时从全部doc中加载，之后随写入、删除的doc一起更新
+//   - 分词的字段是分词后的词，与riot索引中的词相同；不分词的字段是整个值
+//   - 记录每个词的doc数，更新、删除doc时减去旧doc的词，没有doc的词不再扩展，也不占用扩展的数量
+type termDict struct {
+	loadLock   sync.Mutex // 只让一个goroutine加载
+	loaded     bool       // 是否已经加载完成，由loadLock保护
+
+	lock       sync.Mutex
+	collecting bool       // 写入的doc是否要加到词典中，开始加载后为true
+	fields     map[int]*fieldTerms // 字段序号 -> 词典
+	docs       map[string]StoredDoc // docId -> 加到词典中的doc，更新、删除时用于减去旧的词
+	touched    map[string]bool      // 加载期间写入或删除的docId，加载时跳过，不为nil时表示正在加载
+}
+
+// 一个字段的词典: 排好序的词，加上还没有合并进来的新词
+type fieldTerms struct {
+	sorted  []string
+	pending map[string]bool
+	counts  map[string]int // 词 -> doc数，没有doc的词被删除
+	dead    int            // sorted中已经没有doc的词数
+}
+
+// 是否是通配符: 含有'*'或'?'，并且至少有一个其它字符
+func isWildcard(s string) bool {
+	return strings.ContainsAny(s, "*?") && strings.Trim(s, "*?") != ""
+}
+
+// 把写入的doc中的词加到词典中，替换同一个docId原来的doc。词典还没有加载时不需要
+// 在walLock内调用，与更新放入队列的顺序一致
+func (idx *indexer) addTerms(docId string, doc StoredDoc) {
+	t := &idx.terms
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.collecting {
+		return
+	}
+	if t.touched != nil {
+		t.touched[docId] = true
+	}
+	t.setDoc(idx.schema, docId, doc)
+}
+
+// 删除doc时减去它的词，同addTerms
+func (idx *indexer) removeTerms(docId string) {
+	t := &idx.terms
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.collecting {
+		return
+	}
+	if t.touched != nil {
+		t.touched[docId] = true
+	}
+	t.setDoc(idx.schema, docId, nil)
+}
+
+// 用doc替换docId原来的doc，doc为nil表示删除，需要持有lock
+func (t *termDict) setDoc(schema *conf.Schema, docId string, doc StoredDoc) {
+	if old, ok := t.docs[docId]; ok {
+		for i, terms := range docTerms(schema, old) {
+			ft := t.fields[i]
+			for term := range terms {
+				ft.remove(term)
+			}
+		}
+		delete(t.docs, docId)
+	}
+	if doc == nil {
+		return
+	}
+	for i, terms := range docTerms(schema, doc) {
+		ft, ok := t.fields[i]
+		if !ok {
+			ft = &fieldTerms{pending: map[string]bool{}, counts: map[string]int{}}
+			t.fields[i] = ft
+		}
+		for term := range terms {
+			ft.add(term)
+		}
+	}
+	t.docs[docId] = doc
+}
+
+// doc中每个字符串字段的词，一个doc中的词只算一次
+func docTerms(schema *conf.Schema, doc StoredDoc) map[int]map[string]bool {
+	res := map[int]map[string]bool{}
+	for i := range schema.Fields {
+		field := &schema.Fields[i]
+		if field.Type == "json" {
+			continue
+		}
+		vals, ok := doc[field.Name].([]interface{})
+		if !ok {
+			vals = []interface{}{doc[field.Name]}
+		}
+		for _, v := range vals {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			terms, ok := res[i]
+			if !ok {
+				terms = map[string]bool{}
+				res[i] = terms
+			}
+			for _, term := range fieldTokenize(field, s) {
+				terms[term] = true
+			}
+		}
+	}
+	return res
+}
+
+func (ft *fieldTerms) add(term string) {
+	ft.counts[term] += 1
+	if ft.counts[term] > 1 {
+		return
+	}
+	if ft.inSorted(term) {
+		ft.dead -= 1
+	} else {
+		ft.pending[term] = true
+	}
+}
+
+func (ft *fieldTerms) remove(term string) {
+	if ft.counts[term] -= 1; ft.counts[term] > 0 {
+		return
+	}
+	delete(ft.counts, term)
+	if ft.pending[term] {
+		delete(ft.pending, term)
+	} else {
+		ft.dead += 1
+	}
+}
+
+func (ft *fieldTerms) inSorted(term string) bool {
+	i := sort.SearchStrings(ft.sorted, term)
+	return i < len(ft.sorted) && ft.sorted[i] == term
+}
+
+// 第一次使用时从全部doc中加载词典。先刷新索引，使已经写入的doc都可以查到
+func (idx *indexer) loadTerms() error {
+	t := &idx.terms
+	t.loadLock.Lock()
+	defer t.loadLock.Unlock()
+	if t.loaded {
+		return nil
+	}
+
+	// 开始加载后写入的doc直接加到词典中，加载时跳过这些doc，它们可能比查到的更新
+	t.lock.Lock()
+	t.collecting, t.fields, t.docs, t.touched = true, map[int]*fieldTerms{}, map[string]StoredDoc{}, map[string]bool{}
+	t.lock.Unlock()
+
+	idx.flushAndWait()
+	docs, err := idx.queryAll(context.Background(), "", "", "")
+	if err != nil {
+		t.lock.Lock()
+		t.collecting, t.fields, t.docs, t.touched = false, nil, nil, nil
+		t.lock.Unlock()
+		return err
+	}
+	count := 0
+	for d := range docs {
+		t.lock.Lock()
+		if !t.touched[d.docId] {
+			t.setDoc(idx.schema, d.docId, d.doc)
+		}
+		t.lock.Unlock()
+		count += 1
+	}
+	t.lock.Lock()
+	t.touched = nil
+	t.lock.Unlock()
+	t.loaded = true
+	log.Printf("[info] terms of %d docs in index %s loaded\n", count, idx.schema.Name)
+	return nil
+}
+
+// 把通配符扩展成字段中的词，超过conf.ServiceConf.Query.MaxExpansions时返回*BadQueryError，而不是只用一部分词
+//   fIdx: <0表示所有分词的字段
+func (idx *indexer) expandWildcard(fIdx int, pattern string) ([]string, error) {
+	if err := idx.loadTerms(); err != nil {
+		return nil, err
+	}
+
+	prefix := pattern
+	if pos := strings.IndexAny(pattern, "*?"); pos >= 0 {
+		prefix = pattern[:pos]
+	}
+	max := conf.ServiceConf.Query.MaxExpansions
+
+	t := &idx.terms
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	res := []string{}
+	found := map[string]bool{}
+	for i, ft := range t.fields {
+		if fIdx >= 0 && i != fIdx {
+			continue
+		}
+		if fIdx < 0 && idx.schema.Fields[i].Tokenizer == conf.NONE_TOKENIZER {
+			continue
+		}
+		ft.merge()
+		for j := sort.SearchStrings(ft.sorted, prefix); j < len(ft.sorted); j++ {
+			term := ft.sorted[j]
+			if !strings.HasPrefix(term, prefix) {
+				break
+			}
+			if found[term] || ft.counts[term] == 0 || !wildcardMatch(pattern, term) {
+				// 已经没有doc的词不占用扩展的数量
+				continue
+			}
+			if len(res) >= max {
+				return nil, &BadQueryError{Msg: fmt.Sprintf("%s matches more than %d terms, please use a longer prefix", pattern, max)}
+			}
+			found[term] = true
+			res = append(res, term)
+		}
+	}
+	return res, nil
+}
+
+// 把新词合并到排好序的词中，没有doc的词超过一半时从中去掉
+func (ft *fieldTerms) merge() {
+	if ft.dead > 0 && ft.dead*2 >= len(ft.sorted) {
+		live := make([]string, 0, len(ft.sorted)-ft.dead)
+		for _, term := range ft.sorted {
+			if ft.counts[term] > 0 {
+				live = append(live, term)
+			}
+		}
+		ft.sorted, ft.dead = live, 0
+	}
+	if len(ft.pending) == 0 {
+		return
+	}
+	terms := make([]string, 0, len(ft.pending))
+	for term := range ft.pending {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	merged := make([]string, 0, len(ft.sorted)+len(terms))
+	i, j := 0, 0
+	for i < len(ft.sorted) && j < len(terms) {
+		if ft.sorted[i] < terms[j] {
+			merged = append(merged, ft.sorted[i])
+			i += 1
+		} else {
+			merged = append(merged, terms[j])
+			j += 1
+		}
+	}
+	merged = append(merged, ft.sorted[i:]...)
+	ft.sorted = append(merged, terms[j:]...)
+	ft.pending = map[string]bool{}
+}
+
+// 通配符匹配: '*'匹配任意个字符，'?'匹配一个字符
+func wildcardMatch(pattern, s string) bool {
+	p, r := []rune(pattern), []rune(s)
+	pi, ri := 0, 0
+	star, mark := -1, 0 // 最近一个'*'的位置，以及它匹配到的位置
+	for ri < len(r) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == r[ri]):
+			pi, ri = pi+1, ri+1
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, ri
+			pi += 1
+		case star >= 0:
+			// 让上一个'*'多匹配一个字符
+			mark += 1
+			pi, ri = star+1, mark
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi += 1
+	}
+	return pi == len(p)
+}
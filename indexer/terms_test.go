@@ -0,0 +1,93 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestExpandWildcard(t *testing.T) {
+	schema := &conf.Schema{
+		Name: "terms-test",
+		SchemaConf: &conf.SchemaConf{Fields: []conf.Field{
+			{Name: "id", Type: "u32", PK: true},
+			{Name: "title", Type: "str"},
+			{Name: "sku", Type: "str", Tokenizer: conf.NONE_TOKENIZER},
+		}},
+		FieldMap: map[string]int{"id": 0, "title": 1, "sku": 2},
+	}
+	idx := &indexer{schema: schema}
+	idx.terms.loaded, idx.terms.collecting = true, true
+	idx.terms.fields, idx.terms.docs = map[int]*fieldTerms{}, map[string]StoredDoc{}
+	idx.addTerms("1", StoredDoc{"id": uint32(1), "title": "iphone case", "sku": "AB1200"})
+	idx.addTerms("2", StoredDoc{"id": uint32(2), "title": "iphoto team", "sku": "AB13"})
+	idx.addTerms("3", StoredDoc{"id": uint32(3), "title": "term teem", "sku": []interface{}{"AB12", "iphone"}})
+
+	conf.ServiceConf.Query.MaxExpansions = 3
+	cases := []struct {
+		fIdx     int
+		pattern  string
+		expected []string
+	}{
+		{-1, "iph*", []string{"iphone", "iphoto"}},
+		{-1, "te?m", []string{"team", "teem", "term"}},
+		{-1, "*ea*", []string{"team"}},
+		{-1, "AB*", []string{}}, // 不分词的字段不在q中
+		{2, "AB12*", []string{"AB12", "AB1200"}},
+		{2, "iph*", []string{"iphone"}},
+		{1, "AB*", []string{}},
+	}
+	for _, c := range cases {
+		terms, err := idx.expandWildcard(c.fIdx, c.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", c.pattern, err)
+		}
+		sort.Strings(terms)
+		if len(terms) != len(c.expected) {
+			t.Fatalf("%s in field %d: expected %v, got %v", c.pattern, c.fIdx, c.expected, terms)
+		}
+		for i := range terms {
+			if terms[i] != c.expected[i] {
+				t.Fatalf("%s in field %d: expected %v, got %v", c.pattern, c.fIdx, c.expected, terms)
+			}
+		}
+	}
+
+	// 超过上限时出错，而不是只用一部分词
+	if _, err := idx.expandWildcard(-1, "*e*"); err == nil {
+		t.Fatalf("*e*: error expected when more than 3 terms matched")
+	} else if _, ok := err.(*BadQueryError); !ok {
+		t.Fatalf("*e*: BadQueryError expected, got %v", err)
+	}
+
+	// 更新、删除doc后没有doc的词不再扩展，也不占用扩展的数量
+	for i := 0; i < 10; i++ {
+		idx.addTerms("4", StoredDoc{"id": uint32(4), "title": fmt.Sprintf("iphx%d", i)})
+	}
+	idx.addTerms("5", StoredDoc{"id": uint32(5), "title": "iphy"})
+	idx.removeTerms("5")
+	idx.addTerms("2", StoredDoc{"id": uint32(2), "title": "team"})
+	terms, err := idx.expandWildcard(-1, "iph*")
+	if err != nil {
+		t.Fatalf("iph*: %v", err)
+	}
+	sort.Strings(terms)
+	if len(terms) != 2 || terms[0] != "iphone" || terms[1] != "iphx9" {
+		t.Fatalf("iph*: [iphone iphx9] expected, got %v", terms)
+	}
+	// 还有其它doc的词保留
+	idx.removeTerms("1")
+	if terms, err = idx.expandWildcard(2, "iph*"); err != nil || len(terms) != 1 {
+		t.Fatalf("iph* in sku: [iphone] expected, got %v, %v", terms, err)
+	}
+	if terms, err = idx.expandWildcard(-1, "ca*"); err != nil || len(terms) != 0 {
+		t.Fatalf("ca*: no terms expected after doc 1 deleted, got %v, %v", terms, err)
+	}
+	// 没有doc的词超过一半时从排好序的词中去掉
+	idx.removeTerms("3")
+	idx.expandWildcard(1, "te*")
+	if ft := idx.terms.fields[1]; len(ft.sorted) != len(ft.counts) || ft.dead != 0 {
+		t.Fatalf("terms without docs should be removed: %v, %v", ft.sorted, ft.counts)
+	}
+}
@@ -0,0 +1,152 @@
+package indexer
+
+import (
+	"github.com/go-ego/riot/types"
+	"go-search/conf"
+	"time"
+	"log"
+)
+
+// doc过期: schema中配置了ttl或expire-field时，写入doc时计算过期时间，保存在隐藏字段conf.EXPIRE_AT_FIELD中。
+//   - 搜索和获取doc时立即隐藏已经过期的doc
+//   - 后台定期通过deleteDoc删除已经过期的doc
+//   - 更新doc时重新计算过期时间
+
+var (
+	ttlStopChan    chan struct{}
+	ttlStoppedChan chan struct{}
+)
+
+// 计算doc的过期时间(UnixNano)，expire-field有值时使用该值，否则按ttl从现在算起
+func (idx *indexer) expireAt(storedDoc StoredDoc, now time.Time) (int64, bool) {
+	schema := idx.schema
+	if schema.ExpireField != "" {
+		v := storedDoc[schema.ExpireField]
+		if vs, ok := v.([]interface{}); ok {
+			// 多值字段按第一个值
+			v = nil
+			if len(vs) > 0 {
+				v = vs[0]
+			}
+		}
+		// null、0转换后都是0，当作没有给出过期时间，使用schema的ttl
+		if t, ok := v.(int64); ok && t != 0 {
+			if schema.Fields[schema.FieldMap[schema.ExpireField]].Type == "timestamp" {
+				return t * int64(time.Second), true
+			}
+			return t, true
+		}
+	}
+	if ttl := schema.TTLDuration(); ttl > 0 {
+		return now.Add(ttl).UnixNano(), true
+	}
+	return 0, false
+}
+
+// doc在now(UnixNano)时是否已经过期
+func (d StoredDoc) expired(now int64) bool {
+	expireAt, ok := d[conf.EXPIRE_AT_FIELD].(int64)
+	return ok && expireAt <= now
+}
+
+// 搜索时用于隐藏过期doc的时间(UnixNano)，0表示不需要检查
+func (idx *indexer) expireCheckTime() int64 {
+	if !idx.schema.HasTTL() {
+		return 0
+	}
+	return time.Now().UnixNano()
+}
+
+// 删除所有已经过期的doc，返回删除的doc数
+func (idx *indexer) sweepExpired(now time.Time) (int, error) {
+	pq, err := parseQuery("", "", "", "", "", "", "")
+	if err != nil {
+		return 0, err
+	}
+	pq.start, pq.rows = 0, 0 // 输出全部结果
+
+	sr, err := idx.pq2SearchQuery(pq)
+	if err != nil {
+		return 0, err
+	}
+	scorer := sr.RankOpts.ScoringCriteria.(*scorerT)
+	scorer.now, scorer.expiredOnly = now.UnixNano(), true
+	resp := idx.engine.Search(*sr)
+
+	if resp.Docs == nil {
+		return 0, nil
+	}
+	docs, ok := resp.Docs.(types.ScoredDocs)
+	if !ok || len(docs) == 0 {
+		return 0, nil
+	}
+	count := 0
+	pc := &pendingChanges{}
+	for _, doc := range docs {
+		if err = idx.deleteDoc(doc.DocId, nil, pc); err != nil {
+			break
+		}
+		count += 1
+	}
+	if count > 0 {
+		if e := idx.commitChanges(pc); e != nil && err == nil {
+			err = e
+		}
+		idx.afterWrite(REFRESH_DEFAULT)
+	}
+	return count, err
+}
+
+func startTTLSweeper() {
+	ttlStopChan = make(chan struct{})
+	ttlStoppedChan = make(chan struct{})
+	go ttlSweepThread()
+}
+
+// 停止清除过期doc，需要在停止队列前调用
+func stopTTLSweeper() {
+	if ttlStopChan == nil {
+		return
+	}
+	close(ttlStopChan)
+	<-ttlStoppedChan
+}
+
+func ttlSweepThread() {
+	defer close(ttlStoppedChan)
+
+	interval := time.Duration(conf.ServiceConf.TTL.SweepSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-ttlStopChan:
+			return
+		case now = <-ticker.C:
+		}
+
+		indexerLock.RLock()
+		idxes := make([]*indexer, 0, len(indexers))
+		for _, idx := range indexers {
+			if idx.schema.HasTTL() {
+				idxes = append(idxes, idx)
+			}
+		}
+		indexerLock.RUnlock()
+
+		for _, idx := range idxes {
+			count, err := idx.sweepExpired(now)
+			if err != nil {
+				log.Printf("[error] failed to remove expired docs of index %s: %v\n", idx.schema.Name, err)
+			}
+			if count > 0 {
+				log.Printf("[info] %d expired docs of index %s removed\n", count, idx.schema.Name)
+			}
+		}
+	}
+}
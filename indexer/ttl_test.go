@@ -0,0 +1,84 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	conf.ServiceConf.RootDir = t.TempDir()
+	conf.ServiceConf.Inbox.Disabled = true
+	schema := `{"fields":[{"name":"id","type":"u32","pk":true},{"name":"exp","type":"timestamp"}],"ttl":"1h","expire-field":"exp"}`
+	if err := conf.SaveSchema("ttl", strings.NewReader(schema)); err != nil {
+		t.Fatal(err)
+	}
+	StartIndexers(2)
+	defer StopIndexers(2)
+	defer closeIndexer("ttl")
+
+	now := time.Now()
+	docs := []map[string]interface{}{
+		{"id": float64(1), "exp": float64(now.Add(-time.Minute).Unix())}, // 已经过期
+		{"id": float64(2), "exp": float64(now.Add(3 * time.Hour).Unix())},
+		{"id": float64(3)}, // 按ttl在1小时后过期
+	}
+	for _, doc := range docs {
+		if _, err := IndexDoc("ttl", doc, REFRESH_TRUE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx, err := initIndexer("ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	countDocs := func() int {
+		matched, err := idx.queryAll(context.Background(), "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for range matched {
+			n += 1
+		}
+		return n
+	}
+
+	// 过期的doc立即隐藏，还没有删除
+	if doc, err := GetDoc("ttl", 1, ""); err != nil || doc != nil {
+		t.Fatalf("expired doc 1 should be hidden, got %v, %v", doc, err)
+	}
+	if doc, err := GetDoc("ttl", 3, ""); err != nil || doc == nil {
+		t.Fatalf("doc 3 expected, got %v", err)
+	} else if _, ok := doc[conf.EXPIRE_AT_FIELD]; ok {
+		t.Fatalf("the expire time should not be output: %v", doc)
+	}
+	if n := countDocs(); n != 2 {
+		t.Fatalf("2 docs expected, got %d", n)
+	}
+
+	// 清除时只删除在该时间已经过期的doc
+	for _, c := range []struct {
+		at      time.Time
+		removed int
+	}{
+		{now, 1},
+		{now.Add(2 * time.Hour), 1},
+		{now.Add(4 * time.Hour), 1},
+		{now.Add(4 * time.Hour), 0},
+	} {
+		removed, err := idx.sweepExpired(c.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		idx.flushAndWait()
+		if removed != c.removed {
+			t.Fatalf("sweeping at %v: %d docs should be removed, got %d", c.at.Sub(now), c.removed, removed)
+		}
+	}
+	if n := len(idx.engine.GetAllDocIds()); n != 0 {
+		t.Fatalf("all docs should be removed, %d left", n)
+	}
+}
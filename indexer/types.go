@@ -4,12 +4,27 @@ import (
 	"go-search/conf"
 	"github.com/go-ego/riot"
 	"sync"
+	"time"
 )
 
 // 索引库: 一个索引schema定义 + 一个搜索引擎实例
 type indexer struct {
 	schema *conf.Schema
 	engine *riot.Engine
+	wal    *wal // 没有打开WAL时为nil
+	walLock sync.Mutex // 写WAL和放入队列、WAL换段和放入flush都在锁内进行，队列中操作的顺序与WAL一致
+
+	refreshInterval time.Duration // 后台刷新的间隔，<=0表示每次写操作后刷新
+	refreshLock     sync.Mutex
+	dirty           bool            // 有没有刷新的更新
+	waiters         []chan struct{} // refresh=wait_for的写操作，下次刷新后通知
+	lastRefresh     time.Time
+
+	terms termDict // 前缀、通配符查询使用的词典
+
+	writeLock sync.RWMutex // 更新写WAL、放入队列时持有读锁，关闭索引库、做快照时持有写锁
+	closed    bool         // 已经关闭，之后的更新使用重新加载的indexer，由writeLock保护
+	shutdownDone chan struct{} // 关闭时的刷新完成后关闭
 }
 
 // q
@@ -30,6 +45,8 @@ type sorting struct {
 type range_ struct {
 	from interface{}
 	to   interface{}
+	fromExcl bool // 不包含from，用于JSON查询的gt
+	toExcl   bool // 不包含to，用于JSON查询的lt
 }
 
 // f
@@ -62,5 +79,7 @@ type StoredDoc map[string]interface{} // field name -> value
 var (
 	indexers    = map[string]*indexer{}  // index name => index
 	indexerLock = &sync.RWMutex{}
+	pausedIndexers = map[string]chan struct{}{} // index name => 恢复时关闭，由indexerLock保护
+	loadingIndexers = map[string]chan struct{}{} // index name => 加载完成时关闭，由indexerLock保护
 	allDocs     = []string{"."}  // a tricky, 在没有q的情况下搜索所有的doc
 )
@@ -0,0 +1,157 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+)
+
+// update-by-query的更新操作，可以同时出现
+type UpdateOps struct {
+	Doc   map[string]interface{} `json:"doc"`   // 部分doc，用其中的字段覆盖原有字段
+	Unset []string               `json:"unset"` // 需要清空的字段
+	Inc   map[string]float64     `json:"inc"`   // 数值字段的增量，可以为负数
+}
+
+// 更新失败的doc
+type UpdateFailure struct {
+	Id    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// update-by-query的结果
+type UpdateByQueryResult struct {
+	Matched  int             `json:"matched"`
+	Updated  int             `json:"updated"`
+	Failed   int             `json:"failed"`
+	Failures []UpdateFailure `json:"failures"`
+}
+
+// 对所有满足q、fq、f条件的doc执行更新操作，并重新加入索引库
+func UpdateByQuery(index, q, fq, f string, ops *UpdateOps) (*UpdateByQueryResult, error) {
+	if !running {
+		return nil, fmt.Errorf("the service is stopped")
+	}
+
+	idx, err := initIndexer(index)
+	if err != nil {
+		return nil, fmt.Errorf("schema %s not found, please create schema first", index)
+	}
+
+	if err = idx.checkUpdateOps(ops); err != nil {
+		return nil, err
+	}
+
+	docs, err := idx.queryAll(context.Background(), q, fq, f)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &UpdateByQueryResult{}
+	pc := &pendingChanges{}
+	var commitErr error
+	for d := range docs {
+		res.Matched += 1
+
+		doc := idx.formatStoredDoc(d.doc, nil)
+		if err = idx.applyUpdateOps(doc, ops); err == nil {
+			_, err = idx.updateDoc(doc, pc)
+		}
+		if err != nil {
+			res.Failed += 1
+			res.Failures = append(res.Failures, UpdateFailure{Id: d.docId, Error: err.Error()})
+			continue
+		}
+		res.Updated += 1
+		if len(pc.changes) >= importCommitDocs && commitErr == nil {
+			// 分批提交，不在内存中积累所有的变更
+			commitErr = idx.commitChanges(pc)
+		}
+	}
+
+	if res.Updated > 0 {
+		if err = idx.commitChanges(pc); commitErr == nil {
+			commitErr = err
+		}
+		idx.afterWrite(REFRESH_DEFAULT)
+		if commitErr != nil {
+			return nil, commitErr
+		}
+	}
+	log.Printf("[info] update-by-query on index %s: %d matched, %d updated\n", index, res.Matched, res.Updated)
+	return res, nil
+}
+
+// 检查更新操作，PK字段不允许更新，否则会生成新的doc
+func (idx *indexer) checkUpdateOps(ops *UpdateOps) error {
+	if ops == nil || (len(ops.Doc) == 0 && len(ops.Unset) == 0 && len(ops.Inc) == 0) {
+		return fmt.Errorf("no update operation specified")
+	}
+
+	schema := idx.schema
+	checkField := func(fieldName string) error {
+		fieldIdx, ok := schema.FieldMap[fieldName]
+		if !ok {
+			return fmt.Errorf("field %s not found", fieldName)
+		}
+		if schema.Fields[fieldIdx].PK {
+			return fmt.Errorf("pk field %s can not be updated", fieldName)
+		}
+		return nil
+	}
+
+	for fieldName := range ops.Doc {
+		if err := checkField(fieldName); err != nil {
+			return err
+		}
+	}
+	for _, fieldName := range ops.Unset {
+		if err := checkField(fieldName); err != nil {
+			return err
+		}
+	}
+	for fieldName := range ops.Inc {
+		if err := checkField(fieldName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 把更新操作应用到doc上
+func (idx *indexer) applyUpdateOps(doc StoredDoc, ops *UpdateOps) error {
+	for k, v := range ops.Doc {
+		doc[k] = v
+	}
+	for _, k := range ops.Unset {
+		delete(doc, k)
+	}
+	for k, delta := range ops.Inc {
+		v, ok := doc[k]
+		if !ok || v == nil {
+			doc[k] = delta
+			continue
+		}
+		n, ok := numericValue(v)
+		if !ok {
+			return fmt.Errorf("field %s is not a number", k)
+		}
+		doc[k] = n + delta
+	}
+	return nil
+}
+
+func numericValue(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch v.(type) {
+	case int8, int16, int32, int64, int:
+		return float64(rv.Int()), true
+	case uint8, uint16, uint32, uint64, uint:
+		return float64(rv.Uint()), true
+	case float32, float64:
+		return rv.Float(), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,420 @@
+package indexer
+
+import (
+	"github.com/go-ego/riot"
+	"github.com/go-ego/riot/types"
+	"go-search/conf"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/crc32"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"bytes"
+	"sort"
+	"sync"
+	"path"
+	"time"
+	"fmt"
+	"log"
+	"io"
+	"os"
+)
+
+// WAL(write-ahead log): 更新操作在放入索引库的队列前先写入WAL，按WAL模式fsync后才返回，
+// 初始化索引库时重放WAL，以便进程崩溃后恢复已经返回成功的更新。
+//   - WAL分成多个段文件"<16位序号>.wal"，每条记录为: 4字节长度 + 4字节CRC32 + gob编码的walRecord
+//   - 使用持久化(USE_STORE)时，engine.Flush成功后删除已经写满的段
+//   - 不使用持久化时，WAL是唯一保存数据的地方，不会删除，只在重放时压缩成只有最新doc的一个段。
+//     运行期间不换段也不压缩，WAL会一直增长到下次加载索引库(重启或被LRU回收后再使用)
+const (
+	walExt         = ".wal"
+	walHeaderSize  = 8
+	walSegmentSize = 16 << 20 // 段文件超过该大小后，在下次flush时换新的段
+	walMaxRecord   = 1 << 30
+)
+
+type walRecord struct {
+	Op    int
+	DocId string
+	Doc   *types.DocData
+}
+
+type wal struct {
+	lock  sync.Mutex
+	dir   string
+	mode  string
+	seq   int64    // 当前段的序号
+	fp    *os.File // 当前段
+	size  int64    // 当前段的大小
+	dirty bool     // 有没有fsync的写入
+}
+
+var (
+	walStopChan    chan struct{}
+	walStoppedChan chan struct{}
+)
+
+func walSegmentFile(dir string, seq int64) string {
+	return path.Join(dir, fmt.Sprintf("%016d%s", seq, walExt))
+}
+
+// 按序号列出WAL的段
+func listWalSegments(dir string) ([]int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	segs := []int64{}
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, walExt) {
+			continue
+		}
+		if seq, err := strconv.ParseInt(strings.TrimSuffix(name, walExt), 10, 64); err == nil {
+			segs = append(segs, seq)
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+	return segs, nil
+}
+
+// 重放索引库的WAL，并按WAL模式打开WAL。模式为WAL_OFF时返回nil
+func (idx *indexer) recoverWal() (*wal, error) {
+	schema := idx.schema
+	dir, mode := schema.WalPath(), schema.WalMode()
+	useStore := len(conf.UseStore) > 0
+
+	segs, err := listWalSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) == 0 && (mode == "" || mode == conf.WAL_OFF) {
+		return nil, nil
+	}
+
+	// 不使用持久化时，需要记住每个doc最新的记录，用于压缩
+	var live map[string]*walRecord
+	if !useStore {
+		live = make(map[string]*walRecord)
+	}
+	records := 0
+	for _, seq := range segs {
+		n, err := replayWalSegment(walSegmentFile(dir, seq), idx.engine, live)
+		if err != nil {
+			return nil, err
+		}
+		records += n
+	}
+	if records > 0 {
+		idx.engine.Flush()
+		log.Printf("[info] %d wal records of index %s replayed\n", records, schema.Name)
+	}
+
+	var nextSeq int64
+	if len(segs) > 0 {
+		nextSeq = segs[len(segs)-1] + 1
+	}
+
+	if mode == "" || mode == conf.WAL_OFF {
+		// WAL被关闭了，持久化时数据已经在store中，否则数据只在内存中
+		if !useStore {
+			log.Printf("[warn] wal of index %s is off, the in-memory docs will be lost after restart\n", schema.Name)
+		}
+		return nil, os.RemoveAll(dir)
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &wal{dir: dir, mode: mode, seq: nextSeq}
+	if err = w.openSegment(); err != nil {
+		return nil, err
+	}
+
+	if !useStore && (len(segs) > 1 || records > len(live)) {
+		// 只保留每个doc最新的记录，写完并fsync后才删除原来的段
+		for _, rec := range live {
+			if err = w.append(rec.Op, rec.DocId, rec.Doc); err != nil {
+				w.close()
+				return nil, err
+			}
+		}
+		if err = w.sync(); err != nil {
+			w.close()
+			return nil, err
+		}
+		log.Printf("[info] wal of index %s compacted: %d records -> %d\n", schema.Name, records, len(live))
+	} else if !useStore {
+		return w, nil
+	}
+	removeWalSegments(dir, segs)
+	return w, nil
+}
+
+// 重放一个段，返回记录数。段尾不完整的记录(写入时崩溃)会被截掉
+//   live: 不为nil时记录每个doc最新的记录，删除的doc不保留
+func replayWalSegment(file string, engine *riot.Engine, live map[string]*walRecord) (int, error) {
+	fp, err := os.OpenFile(file, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	var offset int64
+	count := 0
+	header := make([]byte, walHeaderSize)
+	for {
+		rec, n, err := readWalRecord(fp, header)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			log.Printf("[warn] wal %s truncated at offset %d: %v\n", file, offset, err)
+			return count, fp.Truncate(offset)
+		}
+		offset += n
+		count += 1
+
+		switch rec.Op {
+		case _INDEX_DOC:
+			engine.IndexDoc(rec.DocId, *rec.Doc, true)
+			if live != nil {
+				live[rec.DocId] = rec
+			}
+		case _DELETE_DOC:
+			engine.RemoveDoc(rec.DocId, true)
+			if live != nil {
+				delete(live, rec.DocId)
+			}
+		}
+	}
+}
+
+// 读一条记录，返回记录和记录占用的字节数
+func readWalRecord(r io.Reader, header []byte) (*walRecord, int64, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, fmt.Errorf("incomplete header")
+		}
+		return nil, 0, err
+	}
+	size := binary.LittleEndian.Uint32(header)
+	sum := binary.LittleEndian.Uint32(header[4:])
+	if size == 0 || size > walMaxRecord {
+		return nil, 0, fmt.Errorf("bad record size %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, fmt.Errorf("incomplete record")
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, 0, fmt.Errorf("checksum mismatch")
+	}
+	var rec walRecord
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+		return nil, 0, err
+	}
+	if rec.Op == _INDEX_DOC && rec.Doc == nil {
+		return nil, 0, fmt.Errorf("doc expected")
+	}
+	return &rec, int64(walHeaderSize + size), nil
+}
+
+func removeWalSegments(dir string, segs []int64) {
+	for _, seq := range segs {
+		if err := os.Remove(walSegmentFile(dir, seq)); err != nil && !os.IsNotExist(err) {
+			log.Printf("[error] failed to remove wal segment: %v\n", err)
+		}
+	}
+}
+
+func (w *wal) openSegment() error {
+	fp, err := os.OpenFile(walSegmentFile(w.dir, w.seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	w.fp, w.size = fp, fi.Size()
+	return nil
+}
+
+// 写入一条记录，WAL_SYNC模式下还需要调用commit
+func (w *wal) append(op int, docId string, doc *types.DocData) error {
+	buf := &bytes.Buffer{}
+	buf.Write(make([]byte, walHeaderSize))
+	if err := gob.NewEncoder(buf).Encode(&walRecord{Op: op, DocId: docId, Doc: doc}); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	payload := b[walHeaderSize:]
+	binary.LittleEndian.PutUint32(b, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(b[4:], crc32.ChecksumIEEE(payload))
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.fp == nil {
+		return fmt.Errorf("wal is closed")
+	}
+	if _, err := w.fp.Write(b); err != nil {
+		return fmt.Errorf("failed to write wal: %v", err)
+	}
+	w.size += int64(len(b))
+	w.dirty = true
+	return nil
+}
+
+// 返回成功前调用，WAL_SYNC模式下fsync
+func (w *wal) commit() error {
+	if w.mode != conf.WAL_SYNC {
+		return nil
+	}
+	return w.sync()
+}
+
+func (w *wal) sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.fp == nil || !w.dirty {
+		return nil
+	}
+	if err := w.fp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync wal: %v", err)
+	}
+	w.dirty = false
+	return nil
+}
+
+// 当前段超过walSegmentSize时换新的段，返回可以在flush后删除的最后一个段的序号，-1表示没有
+func (w *wal) rotate() int64 {
+	return w.rotateIf(walSegmentSize)
+}
+
+// 当前段不小于minSize时换新的段，返回已经写完的最后一个段的序号，-1表示没有换段(WAL已经关闭时也是)
+func (w *wal) rotateIf(minSize int64) int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.fp == nil || w.size < minSize {
+		return -1
+	}
+	if w.dirty {
+		w.fp.Sync()
+	}
+	w.fp.Close()
+	w.fp, w.dirty = nil, false
+	done := w.seq
+	w.seq += 1
+	if err := w.openSegment(); err != nil {
+		log.Printf("[error] failed to open wal segment: %v\n", err)
+	}
+	return done
+}
+
+// 删除序号不大于seq的段
+func (w *wal) truncate(seq int64) {
+	segs, err := listWalSegments(w.dir)
+	if err != nil {
+		return
+	}
+	for i, s := range segs {
+		if s > seq {
+			segs = segs[:i]
+			break
+		}
+	}
+	removeWalSegments(w.dir, segs)
+}
+
+func (w *wal) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.fp == nil {
+		return
+	}
+	if w.dirty {
+		w.fp.Sync()
+	}
+	w.fp.Close()
+	w.fp = nil
+}
+
+// WAL_SYNC模式下返回成功前fsync
+func (idx *indexer) commit() error {
+	if idx = idx.current(); idx == nil || idx.wal == nil {
+		// 已经关闭时WAL也已经fsync
+		return nil
+	}
+	return idx.wal.commit()
+}
+
+// 使已经放入队列的更新在进程崩溃后不会丢失: 有WAL时fsync，没有WAL但使用持久化时等待flush完成
+//   没有WAL也不使用持久化时更新只在内存中，返回false
+func (idx *indexer) persist() (bool, error) {
+	if cur := idx.current(); cur != nil {
+		idx = cur
+	}
+	if idx.wal != nil {
+		return true, idx.wal.sync()
+	}
+	if len(conf.UseStore) == 0 {
+		return false, nil
+	}
+	idx.flushAndWait()
+	return true, nil
+}
+
+// WAL_ASYNC模式的定期fsync
+func startWalSync() {
+	walStopChan = make(chan struct{})
+	walStoppedChan = make(chan struct{})
+	go walSyncThread()
+}
+
+func stopWalSync() {
+	if walStopChan == nil {
+		return
+	}
+	close(walStopChan)
+	<-walStoppedChan
+}
+
+func walSyncThread() {
+	defer close(walStoppedChan)
+
+	interval := time.Duration(conf.ServiceConf.Wal.SyncMs) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-walStopChan:
+			return
+		case <-ticker.C:
+		}
+
+		indexerLock.RLock()
+		wals := make([]*wal, 0, len(indexers))
+		for _, idx := range indexers {
+			if idx.wal != nil {
+				wals = append(wals, idx.wal)
+			}
+		}
+		indexerLock.RUnlock()
+
+		for _, w := range wals {
+			if err := w.sync(); err != nil {
+				log.Printf("[error] %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package indexer
+
+import (
+	"github.com/go-ego/riot/types"
+	"go-search/conf"
+	"encoding/gob"
+	"strings"
+	"testing"
+	"sync"
+	"io"
+	"os"
+)
+
+func TestWalRecords(t *testing.T) {
+	gob.Register(StoredDoc{})
+	w := &wal{dir: t.TempDir(), mode: "sync"}
+	if err := w.openSegment(); err != nil {
+		t.Fatal(err)
+	}
+	doc := &types.DocData{Fields: StoredDoc{"id": int64(1), "name": "hello"}, Labels: allDocs}
+	if err := w.append(_INDEX_DOC, "1", doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.append(_DELETE_DOC, "2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.commit(); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟写入时崩溃留下的不完整记录
+	w.fp.Write([]byte{100, 0, 0, 0, 1, 2})
+	w.close()
+
+	fp, err := os.Open(walSegmentFile(w.dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	header := make([]byte, walHeaderSize)
+	rec, _, err := readWalRecord(fp, header)
+	if err != nil || rec.Op != _INDEX_DOC || rec.DocId != "1" || rec.Doc.Fields.(StoredDoc)["name"] != "hello" {
+		t.Fatalf("unexpected record #1: %+v, %v", rec, err)
+	}
+	rec, _, err = readWalRecord(fp, header)
+	if err != nil || rec.Op != _DELETE_DOC || rec.DocId != "2" {
+		t.Fatalf("unexpected record #2: %+v, %v", rec, err)
+	}
+	if _, _, err = readWalRecord(fp, header); err == nil || err == io.EOF {
+		t.Fatalf("incomplete record expected, got %v", err)
+	}
+}
+
+func TestWalConcurrentLoad(t *testing.T) {
+	conf.ServiceConf.RootDir = t.TempDir()
+	conf.ServiceConf.Inbox.Disabled = true
+	schema := `{"fields":[{"name":"id","type":"u32","pk":true},{"name":"name"}],"wal":"sync"}`
+	if err := conf.SaveSchema("walload", strings.NewReader(schema)); err != nil {
+		t.Fatal(err)
+	}
+	StartIndexers(2)
+	defer StopIndexers(2)
+	defer closeIndexer("walload")
+
+	for i := 1; i <= 3; i++ {
+		if _, err := IndexDoc("walload", map[string]interface{}{"id": float64(i), "name": "hello"}, REFRESH_TRUE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeIndexer("walload")
+
+	// 同时加载时只打开一次engine、重放一次WAL
+	var wg sync.WaitGroup
+	loaded := make([]*indexer, 4)
+	for i := range loaded {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			idx, err := initIndexer("walload")
+			if err != nil {
+				t.Error(err)
+			}
+			loaded[i] = idx
+		}(i)
+	}
+	wg.Wait()
+	for _, idx := range loaded[1:] {
+		if idx != loaded[0] {
+			t.Fatalf("the index is loaded more than once")
+		}
+	}
+	if doc, err := GetDoc("walload", "3", ""); err != nil || doc == nil {
+		t.Fatalf("doc 3 expected after replay: %v", err)
+	}
+}
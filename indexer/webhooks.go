@@ -0,0 +1,625 @@
+package indexer
+
+import (
+	"github.com/rosbit/gnet"
+	"go-search/conf"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"bufio"
+	"path"
+	"sync"
+	"time"
+	"fmt"
+	"log"
+	"os"
+)
+
+// 索引库的webhook: 从变更记录中读取变更，按操作和字段条件过滤后批量POST到注册的url
+//   - 配置保存在"<root-dir>/<index>/webhooks.json"中
+//   - 只通知webhook启动后的变更，服务重启前没有通知的变更不再通知
+//   - 通知失败按conf.ServiceConf.Callback的配置重试，仍然失败时写入dead-letter日志后继续通知以后的变更
+const (
+	webhooksFile = "webhooks.json"
+	webhookCheckInterval = time.Second // 检查webhook配置变化的间隔
+	defaultWebhookBatch  = 100
+
+	WEBHOOK_IDLE       = "idle"
+	WEBHOOK_DELIVERING = "delivering"
+	WEBHOOK_RETRYING   = "retrying"
+	WEBHOOK_DISABLED   = "disabled"
+)
+
+type Webhook struct {
+	Id        string            `json:"id"`
+	Url       string            `json:"url"`
+	Ops       []string          `json:"ops,omitempty"`        // 通知的操作: CHANGE_INDEX, CHANGE_UPDATE, CHANGE_DELETE，为空表示全部
+	F         string            `json:"f,omitempty"`          // 只通知满足条件的doc，语法同/search的f参数。删除的变更没有doc，总是通知
+	Doc       bool              `json:"doc,omitempty"`        // 通知中是否带上doc
+	BatchSize int               `json:"batch-size,omitempty"` // 每次最多通知的变更数，缺省为defaultWebhookBatch
+	Headers   map[string]string `json:"headers,omitempty"`    // 请求头
+	Disabled  bool              `json:"disabled,omitempty"`
+	Status    *WebhookStatus    `json:"status,omitempty"`     // 投递状态，不保存
+}
+
+// 投递状态，服务重启后重新计数
+type WebhookStatus struct {
+	State         string     `json:"state"`            // WEBHOOK_IDLE/WEBHOOK_DELIVERING/WEBHOOK_RETRYING/WEBHOOK_DISABLED
+	Seq           uint64     `json:"seq"`              // 最后处理的变更序号
+	Batches       int        `json:"batches"`          // 成功的通知次数
+	Delivered     int        `json:"delivered"`        // 成功通知的变更数
+	Failed        int        `json:"failed"`           // 通知失败写入dead-letter的变更数
+	Lost          int        `json:"lost"`             // 通知太慢，已经不再保留而没有通知的变更数
+	LastDelivery  *time.Time `json:"last-delivery,omitempty"`
+	LastError     string     `json:"last-error,omitempty"`
+	LastErrorTime *time.Time `json:"last-error-time,omitempty"`
+}
+
+// dead-letter日志中的一项
+type DeadLetter struct {
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error"`
+	From    uint64    `json:"from"`              // 第一个变更的序号
+	To      uint64    `json:"to"`                // 最后一个变更的序号
+	Changes []Change  `json:"changes,omitempty"` // 没有送达的变更，变更已经不再保留时为空
+}
+
+// 一个webhook的投递
+type webhookWorker struct {
+	index   string
+	lock    sync.Mutex
+	hook    *Webhook
+	status  WebhookStatus
+	feed    *ChangeFeed
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+var (
+	webhooksLock = &sync.Mutex{} // 读写webhooks.json的锁
+	webhookWorkers = map[string]*webhookWorker{} // "index/id" -> worker
+	webhookWorkersLock = &sync.Mutex{}
+	webhooksStopChan    chan struct{}
+	webhooksStoppedChan chan struct{}
+)
+
+func (hook *Webhook) check(schema *conf.Schema) error {
+	if hook.Id == "" || strings.ContainsAny(hook.Id, "/\\") {
+		return fmt.Errorf("bad webhook id %q", hook.Id)
+	}
+	u, err := url.Parse(hook.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("http or https url expected")
+	}
+	for _, op := range hook.Ops {
+		switch op {
+		case CHANGE_INDEX, CHANGE_UPDATE, CHANGE_DELETE:
+		default:
+			return fmt.Errorf("unknown op %s, %s, %s or %s expected", op, CHANGE_INDEX, CHANGE_UPDATE, CHANGE_DELETE)
+		}
+	}
+	if hook.BatchSize < 0 {
+		return fmt.Errorf("batch-size must not be negative")
+	}
+	filters, err := parseF(hook.F)
+	if err != nil {
+		return err
+	}
+	for _, f := range filters {
+		if _, ok := schema.FieldMap[f.fieldName]; !ok {
+			return fmt.Errorf("filter field %s not found", f.fieldName)
+		}
+	}
+	return nil
+}
+
+func (hook *Webhook) batchSize() int {
+	if hook.BatchSize > 0 {
+		return hook.BatchSize
+	}
+	return defaultWebhookBatch
+}
+
+func (hook *Webhook) hasOp(op string) bool {
+	if len(hook.Ops) == 0 {
+		return true
+	}
+	for _, o := range hook.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+func webhooksPath(index string) string {
+	return path.Join(conf.ServiceConf.RootDir, index, webhooksFile)
+}
+
+func deadLettersPath(index, id string) string {
+	return path.Join(conf.ServiceConf.RootDir, index, fmt.Sprintf("webhook-%s.dead.jsonl", id))
+}
+
+// 读取一个索引库的所有webhook，调用者需要持有webhooksLock
+func loadWebhooks(index string) ([]*Webhook, error) {
+	b, err := ioutil.ReadFile(webhooksPath(index))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Webhook{}, nil
+		}
+		return nil, err
+	}
+	var hooks []*Webhook
+	if err = json.Unmarshal(b, &hooks); err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// 保存一个索引库的所有webhook，调用者需要持有webhooksLock
+func saveWebhooks(index string, hooks []*Webhook) error {
+	b, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := webhooksPath(index)
+	tmp := p + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func findWebhook(hooks []*Webhook, id string) int {
+	for i, hook := range hooks {
+		if hook.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// 列出一个索引库的所有webhook和投递状态
+func ListWebhooks(index string) ([]*Webhook, error) {
+	if _, err := conf.LoadSchema(index); err != nil {
+		return nil, fmt.Errorf("index %s not found", index)
+	}
+	webhooksLock.Lock()
+	hooks, err := loadWebhooks(index)
+	webhooksLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	webhookWorkersLock.Lock()
+	defer webhookWorkersLock.Unlock()
+	for _, hook := range hooks {
+		if w, ok := webhookWorkers[fmt.Sprintf("%s/%s", index, hook.Id)]; ok {
+			w.lock.Lock()
+			status := w.status
+			w.lock.Unlock()
+			hook.Status = &status
+		} else {
+			hook.Status = &WebhookStatus{State: WEBHOOK_DISABLED}
+		}
+	}
+	return hooks, nil
+}
+
+// 获取一个webhook和投递状态
+func GetWebhook(index, id string) (*Webhook, error) {
+	hooks, err := ListWebhooks(index)
+	if err != nil {
+		return nil, err
+	}
+	if i := findWebhook(hooks, id); i >= 0 {
+		return hooks[i], nil
+	}
+	return nil, fmt.Errorf("webhook %s not found", id)
+}
+
+// 增加或替换一个webhook，替换时投递状态和没有通知的变更保留
+func SaveWebhook(index string, hook *Webhook) error {
+	if conf.ServiceConf.Changes.Disabled {
+		return fmt.Errorf("changes are disabled, webhooks need the changes")
+	}
+	schema, err := conf.LoadSchema(index)
+	if err != nil {
+		return fmt.Errorf("index %s not found", index)
+	}
+	if err = hook.check(schema); err != nil {
+		return err
+	}
+	hook.Status = nil
+
+	webhooksLock.Lock()
+	hooks, err := loadWebhooks(index)
+	if err == nil {
+		if i := findWebhook(hooks, hook.Id); i >= 0 {
+			hooks[i] = hook
+		} else {
+			hooks = append(hooks, hook)
+		}
+		err = saveWebhooks(index, hooks)
+	}
+	webhooksLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if running {
+		syncWebhooks()
+	}
+	return nil
+}
+
+// 删除一个webhook和它的dead-letter日志
+func DeleteWebhook(index, id string) error {
+	webhooksLock.Lock()
+	hooks, err := loadWebhooks(index)
+	if err == nil {
+		i := findWebhook(hooks, id)
+		if i < 0 {
+			err = fmt.Errorf("webhook %s not found", id)
+		} else {
+			hooks = append(hooks[:i], hooks[i+1:]...)
+			err = saveWebhooks(index, hooks)
+		}
+	}
+	webhooksLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if running {
+		syncWebhooks()
+	}
+	os.Remove(deadLettersPath(index, id))
+	return nil
+}
+
+// 读取一个webhook的dead-letter日志，按时间顺序
+func ListDeadLetters(index, id string) ([]*DeadLetter, error) {
+	if _, err := GetWebhook(index, id); err != nil {
+		return nil, err
+	}
+	fp, err := os.Open(deadLettersPath(index, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*DeadLetter{}, nil
+		}
+		return nil, err
+	}
+	defer fp.Close()
+
+	letters := []*DeadLetter{}
+	r := bufio.NewReader(fp)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var letter DeadLetter
+			if e := json.Unmarshal(line, &letter); e == nil {
+				letters = append(letters, &letter)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return letters, nil
+}
+
+// 清空一个webhook的dead-letter日志
+func ClearDeadLetters(index, id string) error {
+	if _, err := GetWebhook(index, id); err != nil {
+		return err
+	}
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	if err := os.Remove(deadLettersPath(index, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (w *webhookWorker) addDeadLetter(letter *DeadLetter) {
+	b, err := json.Marshal(letter)
+	if err != nil {
+		log.Printf("[error] failed to encode dead letter: %v\n", err)
+		return
+	}
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+
+	w.lock.Lock()
+	id := w.hook.Id
+	w.lock.Unlock()
+	fp, err := os.OpenFile(deadLettersPath(w.index, id), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("[error] failed to write dead letter of webhook %s of %s: %v\n", id, w.index, err)
+		return
+	}
+	defer fp.Close()
+	fp.Write(append(b, '\n'))
+}
+
+func (w *webhookWorker) setError(err error) {
+	now := time.Now()
+	w.status.LastError, w.status.LastErrorTime = err.Error(), &now
+}
+
+// 读取变更并通知，直到stop被关闭
+func (w *webhookWorker) run() {
+	defer close(w.stopped)
+
+	for {
+		w.lock.Lock()
+		hook := w.hook
+		w.lock.Unlock()
+
+		changes, wait, err := w.feed.read(hook.batchSize())
+		if err != nil {
+			// 通知得太慢，跳过已经不再保留的变更
+			gone := err.(*ChangesGoneError)
+			w.addDeadLetter(&DeadLetter{Time: time.Now(), Error: err.Error(), From: gone.Since + 1, To: gone.Oldest - 1})
+			w.lock.Lock()
+			w.status.Lost += int(gone.Oldest - gone.Since - 1)
+			w.setError(err)
+			w.lock.Unlock()
+			w.feed.next = gone.Oldest
+			continue
+		}
+		if len(changes) == 0 {
+			select {
+			case <-w.stop:
+				return
+			case <-wait:
+			}
+			continue
+		}
+
+		toSend, err := w.filter(hook, changes)
+		last := changes[len(changes)-1].Seq
+		if err != nil {
+			// 无法按条件过滤，整批变更都写入dead-letter日志
+			err = fmt.Errorf("failed to filter changes: %v", err)
+			w.addDeadLetter(&DeadLetter{Time: time.Now(), Error: err.Error(), From: changes[0].Seq, To: last, Changes: toSend})
+		} else if len(toSend) > 0 {
+			if err = w.deliver(hook, toSend); err != nil {
+				w.addDeadLetter(&DeadLetter{Time: time.Now(), Error: err.Error(), From: toSend[0].Seq, To: toSend[len(toSend)-1].Seq, Changes: toSend})
+			}
+		}
+
+		w.lock.Lock()
+		w.status.Seq = last
+		if err != nil {
+			w.status.Failed += len(toSend)
+			w.setError(err)
+		} else if len(toSend) > 0 {
+			now := time.Now()
+			w.status.Batches += 1
+			w.status.Delivered += len(toSend)
+			w.status.LastDelivery = &now
+		}
+		w.status.State = WEBHOOK_IDLE
+		w.lock.Unlock()
+
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+	}
+}
+
+// 按操作和字段条件过滤变更
+//   只用到schema，不加载索引库，以免webhook让索引库一直留在LRU中
+//   出错时返回只按操作过滤、不带doc的变更
+func (w *webhookWorker) filter(hook *Webhook, changes []*Change) ([]Change, error) {
+	var idx *indexer
+	var filters []filter
+	if hook.F != "" || hook.Doc {
+		schema, err := conf.LoadSchema(w.index)
+		if err != nil {
+			res := []Change{}
+			for _, c := range changes {
+				if hook.hasOp(c.Op) {
+					change := *c
+					change.Doc = nil
+					res = append(res, change)
+				}
+			}
+			return res, err
+		}
+		idx = &indexer{schema: schema}
+		filters, _ = parseF(hook.F)
+		checkFilters(&filters, idx.schema)
+	}
+
+	res := []Change{}
+	for _, c := range changes {
+		if !hook.hasOp(c.Op) {
+			continue
+		}
+		if filters != nil && c.Doc != nil && !c.Doc.satisfied(filters, idx.schema) {
+			continue
+		}
+		change := *c
+		if hook.Doc && c.Doc != nil {
+			change.Doc = idx.formatStoredDoc(c.Doc, nil)
+		} else {
+			change.Doc = nil
+		}
+		res = append(res, change)
+	}
+	return res, nil
+}
+
+// 通知一批变更，失败后按指数退避重试
+func (w *webhookWorker) deliver(hook *Webhook, changes []Change) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"index": w.index,
+		"webhook": hook.Id,
+		"changes": changes,
+	})
+	if err != nil {
+		return err
+	}
+
+	headers := map[string]string{}
+	for k, v := range hook.Headers {
+		headers[k] = v
+	}
+	headers[HEADER_IDEMPOTENCY_KEY] = fmt.Sprintf("%s-%d", hook.Id, changes[0].Seq)
+	secret := conf.ServiceConf.Callback.Secret
+	if schema, e := conf.LoadSchema(w.index); e == nil && schema.CallbackSecret != "" {
+		secret = schema.CallbackSecret
+	}
+	if secret != "" {
+		headers[HEADER_SIGNATURE] = signCallback(secret, body)
+	}
+
+	callbackConf := &conf.ServiceConf.Callback
+	backoff := time.Duration(callbackConf.BackoffMs) * time.Millisecond
+	for i:=0; ; i++ {
+		w.lock.Lock()
+		if i == 0 {
+			w.status.State = WEBHOOK_DELIVERING
+		} else {
+			w.status.State = WEBHOOK_RETRYING
+		}
+		w.lock.Unlock()
+
+		var status int
+		status, _, _, err = gnet.JSON(hook.Url, gnet.Params(body), gnet.Headers(headers))
+		if err == nil && status >= http.StatusOK && status < http.StatusMultipleChoices {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("status %d", status)
+		}
+		if i >= callbackConf.MaxRetries {
+			log.Printf("[error] failed to notify webhook %s of %s after %d retries: %v\n", hook.Id, w.index, i, err)
+			return err
+		}
+
+		w.lock.Lock()
+		w.setError(err)
+		w.lock.Unlock()
+		log.Printf("failed to notify webhook %s of %s: %v, retry in %v\n", hook.Id, w.index, err, backoff)
+		select {
+		case <-w.stop:
+			return fmt.Errorf("%v, the service is stopped", err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxCallbackBackoff {
+			backoff = maxCallbackBackoff
+		}
+	}
+}
+
+// 按所有索引库的webhooks.json启动、更新或停止webhook的投递
+func syncWebhooks() {
+	indexes, err := conf.ListIndexes()
+	if err != nil {
+		return
+	}
+	enabled := map[string]*Webhook{}
+	indexOf := map[string]string{}
+	webhooksLock.Lock()
+	for _, index := range indexes {
+		hooks, err := loadWebhooks(index)
+		if err != nil {
+			log.Printf("[error] failed to load webhooks of %s: %v\n", index, err)
+			continue
+		}
+		for _, hook := range hooks {
+			if !hook.Disabled {
+				key := fmt.Sprintf("%s/%s", index, hook.Id)
+				enabled[key], indexOf[key] = hook, index
+			}
+		}
+	}
+	webhooksLock.Unlock()
+
+	var toStop []*webhookWorker
+	webhookWorkersLock.Lock()
+	for key, w := range webhookWorkers {
+		if _, ok := enabled[key]; !ok {
+			toStop = append(toStop, w)
+			delete(webhookWorkers, key)
+		}
+	}
+	for key, hook := range enabled {
+		if w, ok := webhookWorkers[key]; ok {
+			w.lock.Lock()
+			w.hook = hook
+			w.lock.Unlock()
+			continue
+		}
+		index := indexOf[key]
+		w := &webhookWorker{
+			index: index,
+			hook: hook,
+			status: WebhookStatus{State: WEBHOOK_IDLE},
+			feed: liveChanges(index),
+			stop: make(chan struct{}),
+			stopped: make(chan struct{}),
+		}
+		webhookWorkers[key] = w
+		go w.run()
+	}
+	webhookWorkersLock.Unlock()
+
+	for _, w := range toStop {
+		close(w.stop)
+		<-w.stopped
+	}
+}
+
+func startWebhooks() {
+	if conf.ServiceConf.Changes.Disabled {
+		return
+	}
+	syncWebhooks()
+	webhooksStopChan = make(chan struct{})
+	webhooksStoppedChan = make(chan struct{})
+	go webhooksThread()
+}
+
+// 停止所有webhook的投递，没有通知的变更不再通知
+func stopWebhooks() {
+	if webhooksStopChan == nil {
+		return
+	}
+	close(webhooksStopChan)
+	<-webhooksStoppedChan
+
+	webhookWorkersLock.Lock()
+	workers := webhookWorkers
+	webhookWorkers = map[string]*webhookWorker{}
+	webhookWorkersLock.Unlock()
+	for _, w := range workers {
+		close(w.stop)
+		<-w.stopped
+	}
+}
+
+// 定期检查webhook配置的变化，如索引库被删除或恢复
+func webhooksThread() {
+	defer close(webhooksStoppedChan)
+
+	ticker := time.NewTicker(webhookCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-webhooksStopChan:
+			return
+		case <-ticker.C:
+			syncWebhooks()
+		}
+	}
+}
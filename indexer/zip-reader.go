@@ -0,0 +1,111 @@
+package indexer
+
+import (
+	"go-search/conf"
+	"archive/zip"
+	"io/ioutil"
+	"strings"
+	"fmt"
+	"io"
+	"os"
+)
+
+// zip包中的文件按扩展名获取doc
+var ext2Generator = map[string]fnReaderGenerator{
+	".json":  fromJsonFile,
+	".jsonl": fromJsonLines,
+	".csv":   fromCsvFile,
+	".tsv":   fromTsvFile,
+	".xml":   fromXmlFile,
+}
+
+//从zip包中的文件依次获取doc，文件类型由扩展名确定，可以是压缩的文件，如"a.json.gz"
+func fromZipFile(in io.Reader, opts *ImportOpts) (<-chan Doc, error) {
+	if opts.Compression != "" {
+		// 压缩过的zip包(如a.zip.gz)先解压，再保存到临时文件
+		dIn, err := Decompress(in, opts.Compression)
+		if err != nil {
+			return nil, err
+		}
+		defer dIn.Close()
+		in = dIn
+	}
+	ra, size, tmpFile, err := toReaderAt(in)
+	if err != nil {
+		return nil, err
+	}
+	removeTmp := func() {
+		if tmpFile != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}
+	}
+
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		removeTmp()
+		return nil, err
+	}
+
+	docChan := make(chan Doc)
+	go func() {
+		defer close(docChan)
+		defer removeTmp()
+
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") {
+				continue
+			}
+			fromZipEntry(f, opts, docChan)
+		}
+	}()
+	return docChan, nil
+}
+
+func fromZipEntry(f *zip.File, opts *ImportOpts, docChan chan<- Doc) {
+	ext, compression := SplitCompressedExt(f.Name)
+	docGenerator, ok := ext2Generator[ext]
+	if !ok {
+		docChan <- Doc{err: fmt.Errorf("unsupported file type"), file: f.Name}
+		return
+	}
+
+	r, err := f.Open()
+	if err != nil {
+		docChan <- Doc{err: err, file: f.Name}
+		return
+	}
+	defer r.Close()
+
+	o := *opts
+	o.Compression = compression
+	docs, err := decoded(docGenerator)(r, &o)
+	if err != nil {
+		docChan <- Doc{err: err, file: f.Name}
+		return
+	}
+	for doc := range docs {
+		doc.file = f.Name
+		docChan <- doc
+	}
+}
+
+// zip包需要随机读取，不能随机读取的输入先保存到临时文件
+func toReaderAt(in io.Reader) (ra io.ReaderAt, size int64, tmpFile *os.File, err error) {
+	if s, ok := in.(interface{io.ReaderAt; io.Seeker}); ok {
+		if size, err = s.Seek(0, io.SeekEnd); err != nil {
+			return
+		}
+		return s, size, nil, nil
+	}
+
+	if tmpFile, err = ioutil.TempFile(conf.ServiceConf.RootDir, "tmp"); err != nil {
+		return
+	}
+	if size, err = io.Copy(tmpFile, in); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, 0, nil, err
+	}
+	return tmpFile, size, tmpFile, nil
+}
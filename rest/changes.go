@@ -0,0 +1,153 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+	"fmt"
+	"io"
+)
+
+// 变更流的输出格式
+const (
+	CHANGES_SSE    = "sse"
+	CHANGES_NDJSON = "ndjson"
+
+	changesBatch     = 100
+	changesKeepalive = 15 * time.Second
+)
+
+// GET /changes/:index[?since=seq][&format=sse|ndjson][&doc]
+//
+// stream the changes(index, update, delete) of an index. the stream is kept open
+// and new changes are sent as soon as they are recorded.
+//
+// path parameter
+//  - index  name of index
+// query arguments:
+//  - since   only the changes after the sequence number are sent, 0 for all the retained changes.
+//            only new changes are sent if not specified. for SSE, header Last-Event-ID is used if
+//            since is not specified.
+//  - format  "sse"(default): Server-Sent Events, the event id is the sequence number, the event type is the op;
+//            "ndjson": one change per line
+//  - doc     send the document with the change of index and update
+// 410 is returned if the changes after since are no longer retained.
+//
+// a change:
+// {"seq": 1234, "op": "index|update|delete", "id": "docid", "doc": {...}, "time": "2019-10-10T19:01:48+08:00"}
+func Changes(c *mgin.Context) {
+	index := c.Param("index")
+
+	format := c.QueryParam("format")
+	switch format {
+	case "":
+		format = CHANGES_SSE
+	case CHANGES_SSE, CHANGES_NDJSON:
+	default:
+		c.Error(http.StatusBadRequest, fmt.Sprintf("unknown format %s, sse or ndjson expected", format))
+		return
+	}
+	_, withDoc := c.QueryParams()["doc"]
+
+	since := int64(-1)
+	s := c.QueryParam("since")
+	if s == "" && format == CHANGES_SSE {
+		s = c.Request().Header.Get("Last-Event-ID")
+	}
+	if s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil || since < 0 {
+			c.Error(http.StatusBadRequest, fmt.Sprintf("bad since value %s", s))
+			return
+		}
+	}
+
+	feed, err := indexer.OpenChanges(index, since)
+	if err != nil {
+		if _, ok := err.(*indexer.ChangesGoneError); ok {
+			c.Error(http.StatusGone, err.Error())
+		} else {
+			c.Error(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	w := c.Response()
+	if format == CHANGES_SSE {
+		w.Header().Set(HEADER_CONTENT_TYPE, "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set(HEADER_CONTENT_TYPE, JSONLINES_MIME)
+	}
+	w.WriteHeader(http.StatusOK)
+	flush := func() {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	flush()
+
+	done := c.Request().Context().Done()
+	keepalive := time.NewTicker(changesKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		changes, wait, err := feed.Read(changesBatch, withDoc)
+		if err != nil {
+			// 读得太慢，变更已经不再保留，客户端需要重新同步
+			writeChangesError(w, format, err)
+			return
+		}
+		if len(changes) > 0 {
+			for i := range changes {
+				if err = writeChange(w, format, &changes[i]); err != nil {
+					return
+				}
+			}
+			flush()
+			continue
+		}
+
+		select {
+		case <-wait:
+		case <-done:
+			return
+		case <-keepalive.C:
+			if !indexer.IsRunning() {
+				return
+			}
+			if format == CHANGES_SSE {
+				io.WriteString(w, ": keepalive\n\n")
+				flush()
+			}
+		}
+	}
+}
+
+func writeChange(w io.Writer, format string, change *indexer.Change) error {
+	b, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if format == CHANGES_SSE {
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", change.Seq, change.Op, b)
+	} else {
+		_, err = fmt.Fprintf(w, "%s\n", b)
+	}
+	return err
+}
+
+func writeChangesError(w io.Writer, format string, err error) {
+	b, _ := json.Marshal(map[string]interface{}{
+		"code": http.StatusGone,
+		"msg": err.Error(),
+	})
+	if format == CHANGES_SSE {
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", b)
+	} else {
+		fmt.Fprintf(w, "%s\n", b)
+	}
+}
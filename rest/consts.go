@@ -2,8 +2,14 @@ package rest
 
 const (
 	HEADER_CONTENT_TYPE = "Content-Type"
+	HEADER_CONTENT_ENCODING = "Content-Encoding"
+	HEADER_RETRY_AFTER = "Retry-After"
 	MULTIPART_FORM = "multipart/form-data"
 	CSV_MIME       = "text/csv"
+	TSV_MIME       = "text/tab-separated-values"
 	JSON_MIME      = "application/json"
 	JSONLINES_MIME = "application/x-ndjson"
+	ZIP_MIME       = "application/zip"
+	XML_MIME       = "application/xml"
+	TEXT_XML_MIME  = "text/xml"
 )
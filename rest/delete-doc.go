@@ -6,7 +6,9 @@ import (
 	"go-search/indexer"
 )
 
-// DELETE /doc/:index
+// DELETE /doc/:index[?refresh=true|false|wait_for]
+//
+// see IndexDoc for the refresh argument.
 //
 // POST body:
 // {
@@ -14,6 +16,11 @@ import (
 // }
 func DeleteDoc(c *mgin.Context) {
 	index := c.Param("index")
+	refresh, err := getRefresh(c)
+	if err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
 	var doc struct {
 		Id interface{} `json:"id"`
 	}
@@ -21,8 +28,8 @@ func DeleteDoc(c *mgin.Context) {
 		c.Error(code, err.Error())
 		return
 	}
-	if err := indexer.DeleteDoc(index, doc.Id); err != nil {
-		c.Error(http.StatusInternalServerError, err.Error())
+	if err := indexer.DeleteDoc(index, doc.Id, refresh); err != nil {
+		indexingError(c, err)
 		return
 	}
 
@@ -33,7 +40,9 @@ func DeleteDoc(c *mgin.Context) {
 	})
 }
 
-// DELETE /docs/:index
+// DELETE /docs/:index[?refresh=true|false|wait_for]
+//
+// see IndexDoc for the refresh argument.
 //
 // POST body:
 // [
@@ -41,6 +50,11 @@ func DeleteDoc(c *mgin.Context) {
 // ]
 func DeleteDocs(c *mgin.Context) {
 	index := c.Param("index")
+	refresh, err := getRefresh(c)
+	if err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
 
 	var docIds []interface{}
 	if code, err := c.ReadJSON(&docIds); err != nil {
@@ -48,8 +62,8 @@ func DeleteDocs(c *mgin.Context) {
 		return
 	}
 
-	if err := indexer.DeleteDocs(index, docIds); err != nil {
-		c.Error(http.StatusInternalServerError, err.Error())
+	if err := indexer.DeleteDocs(index, docIds, refresh); err != nil {
+		indexingError(c, err)
 		return
 	}
 
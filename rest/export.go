@@ -0,0 +1,120 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"encoding/json"
+	"context"
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"fmt"
+	"log"
+)
+
+// 导出格式
+const (
+	EXPORT_NDJSON = "ndjson"
+	EXPORT_CSV    = "csv"
+)
+
+// GET /export/:index?format=ndjson|csv&q=xxx&fq=xxx&f=xxx&fl=f1,f2
+//
+// stream all the documents matching the query, without pagination.
+//
+// path parameter
+//  - index  name of index
+// query arguments:
+//  - format  "ndjson"(default): one JSON document per line;
+//            "csv": a header line with the field names, then one document per line,
+//            multi-value and json fields are output as JSON strings.
+//  - q, fq, f  same as /search/:index, all the documents are exported if none is specified
+//  - fl        comma separated field names to output, all the fields of the schema by default
+func Export(c *mgin.Context) {
+	index := c.Param("index")
+
+	format := c.QueryParam("format")
+	switch format {
+	case "":
+		format = EXPORT_NDJSON
+	case EXPORT_NDJSON, EXPORT_CSV:
+	default:
+		c.Error(http.StatusBadRequest, fmt.Sprintf("unknown format %s, ndjson or csv expected", format))
+		return
+	}
+
+	// 输出出错(如客户端断开)时取消导出，不再读取剩下的doc
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	fields, docs, err := indexer.Export(ctx, index, c.QueryParam("q"), c.QueryParam("fq"), c.QueryParam("f"), c.QueryParam("fl"))
+	if err != nil {
+		c.Error(http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer func() {
+		cancel()
+		for range docs {
+		}
+	}()
+
+	w := c.Response()
+	contentType := JSONLINES_MIME
+	if format == EXPORT_CSV {
+		contentType = CSV_MIME
+	}
+	w.Header().Set(HEADER_CONTENT_TYPE, fmt.Sprintf("%s; charset=utf-8", contentType))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, index, format))
+	w.WriteHeader(http.StatusOK)
+
+	count := 0
+	if format == EXPORT_NDJSON {
+		je := json.NewEncoder(w)
+		for doc := range docs {
+			if err = je.Encode(doc); err != nil {
+				break
+			}
+			count += 1
+		}
+	} else {
+		cw := csv.NewWriter(w)
+		cw.Write(fields)
+		record := make([]string, len(fields))
+		for doc := range docs {
+			for i, fn := range fields {
+				record[i] = csvValue(doc[fn])
+			}
+			if err = cw.Write(record); err != nil {
+				break
+			}
+			count += 1
+		}
+		cw.Flush()
+		if err == nil {
+			err = cw.Error()
+		}
+	}
+	if err != nil {
+		log.Printf("[error] export of %s stopped after %d docs: %v\n", index, count, err)
+		return
+	}
+	log.Printf("[info] %d docs of %s exported\n", count, index)
+}
+
+// 把字段值转换为csv中的字符串
+func csvValue(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v.(string)
+	case float64:
+		return strconv.FormatFloat(v.(float64), 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v.(float32)), 'f', -1, 32)
+	case []interface{}, map[string]interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
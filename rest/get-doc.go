@@ -0,0 +1,83 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"net/http"
+	"fmt"
+)
+
+// GET /doc/:index/:id[?fl=f1,f2]
+//
+// get a document by its docid
+//
+// path parameter
+//  - index  name of index
+//  - id     docid of the document
+// query arguments:
+//  - fl     field list to output, all fields will be output if not specified
+func GetDoc(c *mgin.Context) {
+	index := c.Param("index")
+	id := c.Param("id")
+
+	doc, err := indexer.GetDoc(index, id, c.QueryParam("fl"))
+	if err != nil {
+		c.Error(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if doc == nil {
+		c.Error(http.StatusNotFound, fmt.Sprintf("doc %s not found", id))
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"id": id,
+		"doc": doc,
+	})
+}
+
+// POST /mget/:index[?fl=f1,f2]
+//
+// get multiple documents by docids
+//
+// POST body:
+// [
+//   docId1, {"pk-field1": xx, "pk-field2": xx}, ...
+// ]
+//
+// the docs in the response are in the same order as the request.
+func MultiGetDocs(c *mgin.Context) {
+	index := c.Param("index")
+
+	var docIds []interface{}
+	if code, err := c.ReadJSON(&docIds); err != nil {
+		c.Error(code, err.Error())
+		return
+	}
+
+	docs, ids, err := indexer.MultiGetDocs(index, docIds, c.QueryParam("fl"))
+	if err != nil {
+		c.Error(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	res := make([]map[string]interface{}, len(docs))
+	missing := []string{}
+	for i, doc := range docs {
+		if doc == nil {
+			res[i] = map[string]interface{}{"id": ids[i], "found": false}
+			missing = append(missing, ids[i])
+		} else {
+			res[i] = map[string]interface{}{"id": ids[i], "found": true, "doc": doc}
+		}
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"docs": res,
+		"missing": missing,
+	})
+}
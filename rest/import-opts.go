@@ -0,0 +1,114 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"unicode/utf8"
+	"strconv"
+	"strings"
+	"fmt"
+)
+
+// 从query参数或multipart表单中获取批量导入的选项
+func getImportOpts(c *mgin.Context) (*indexer.ImportOpts, error) {
+	opts := &indexer.ImportOpts{}
+
+	opts.OnError = getParam(c, "on-error")
+	switch opts.OnError {
+	case "", indexer.ON_ERROR_SKIP, indexer.ON_ERROR_ABORT:
+	default:
+		return nil, fmt.Errorf("unknown on-error value %s, skip or abort expected", opts.OnError)
+	}
+
+	opts.Charset = getParam(c, "charset")
+	if err := indexer.CheckCharset(opts.Charset); err != nil {
+		return nil, err
+	}
+
+	csvOpts, err := getCsvOpts(c)
+	if err != nil {
+		return nil, err
+	}
+	opts.Csv = csvOpts
+	opts.XmlRecord = getParam(c, "record")
+
+	if opts.Refresh, err = getRefresh(c); err != nil {
+		return nil, err
+	}
+
+	opts.Pipeline = getParam(c, "pipeline")
+	if opts.Pipeline != "" && opts.Pipeline != indexer.PIPELINE_NONE {
+		if _, err := indexer.GetPipeline(opts.Pipeline); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// 写操作的refresh参数，只出现参数名时同refresh=true
+func getRefresh(c *mgin.Context) (string, error) {
+	refresh, ok := c.GetQueryParam("refresh")
+	if ok && refresh == "" {
+		refresh = indexer.REFRESH_TRUE
+	}
+	if err := indexer.CheckRefresh(refresh); err != nil {
+		return "", err
+	}
+	return refresh, nil
+}
+
+func getCsvOpts(c *mgin.Context) (*indexer.CsvOpts, error) {
+	o := &indexer.CsvOpts{}
+	var err error
+
+	if o.Delimiter, err = getCharParam(c, "delimiter"); err != nil {
+		return nil, err
+	}
+	if o.Comment, err = getCharParam(c, "comment"); err != nil {
+		return nil, err
+	}
+	o.Quote = getParam(c, "quote")
+
+	if header := getParam(c, "header"); header != "" {
+		hasHeader, e := strconv.ParseBool(header)
+		if e != nil {
+			return nil, fmt.Errorf("bad header value %s, true or false expected", header)
+		}
+		o.NoHeader = !hasHeader
+	}
+
+	if columns := getParam(c, "columns"); columns != "" {
+		o.Columns = strings.Split(columns, ",")
+	}
+
+	if rename := getParam(c, "rename"); rename != "" {
+		o.Rename = make(map[string]string)
+		for _, pair := range strings.Split(rename, ",") {
+			p := strings.SplitN(pair, ":", 2)
+			if len(p) != 2 || len(p[0]) == 0 {
+				return nil, fmt.Errorf("bad rename value %s, column:field expected", pair)
+			}
+			o.Rename[strings.TrimSpace(p[0])] = strings.TrimSpace(p[1])
+		}
+	}
+	if err = o.Check(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// 获取一个字符的参数，"\t"或"tab"表示制表符
+func getCharParam(c *mgin.Context, name string) (rune, error) {
+	v := getParam(c, name)
+	switch v {
+	case "":
+		return 0, nil
+	case "\t", `\t`, "tab":
+		return '\t', nil
+	}
+	if utf8.RuneCountInString(v) != 1 {
+		return 0, fmt.Errorf("%s must be a single character", name)
+	}
+	r, _ := utf8.DecodeRuneInString(v)
+	return r, nil
+}
@@ -6,10 +6,15 @@ import (
 	"net/http"
 )
 
-// PUT /doc/:index
+// PUT /doc/:index[?refresh=true|false|wait_for]
 //
 // add one document to index
 //
+// query arguments:
+//  - refresh  "true" to refresh the index and return after the doc is searchable,
+//             "wait_for" to return after the next scheduled refresh,
+//             "false" not to refresh. the refresh policy of the index is used by default.
+//
 // POST body:
 // {
 //   "field-name": "xxx",
@@ -19,9 +24,10 @@ func IndexDoc(c *mgin.Context) {
 	updateDoc(c, indexer.IndexDoc, "doc added to index")
 }
 
-// PUT /update/:index
+// PUT /update/:index[?refresh=true|false|wait_for]
 //
 // update an existing document. there must be pk fields in the body.
+// see IndexDoc for the refresh argument.
 //
 // POST body:
 // {
@@ -35,14 +41,20 @@ func UpdateDoc(c *mgin.Context) {
 func updateDoc(c *mgin.Context, fnUpdateDoc indexer.FnUpdateDoc, okStr string) {
 	index := c.Param("index")
 
+	refresh, err := getRefresh(c)
+	if err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+
 	var doc map[string]interface{}
 	if code, err := c.ReadJSON(&doc); err != nil {
 		c.Error(code, err.Error())
 		return
 	}
-	docId, err := fnUpdateDoc(index, doc)
+	docId, err := fnUpdateDoc(index, doc, refresh)
 	if err != nil {
-		c.Error(http.StatusInternalServerError, err.Error())
+		indexingError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, map[string]interface{}{
@@ -52,16 +64,38 @@ func updateDoc(c *mgin.Context, fnUpdateDoc indexer.FnUpdateDoc, okStr string) {
 	})
 }
 
-// PUT /docs/:index[?cb=url-encoded-callback-url]
+// PUT /docs/:index[?cb=url-encoded-callback-url][&async][&on-error=skip|abort][&charset=xxx][&csv-options][&record=xxx][&pipeline=xxx][&refresh=true|false|wait_for]
 //
 // add 1 or more documents to index
 //
 // path parameter
 //  - index  name of index
+// query arguments:
+//  - cb     callback url, the docs will be indexed asynchronously if specified
+//  - async  index the docs asynchronously, a job id will be returned
+//  - on-error  "skip"(default) to skip the bad docs, "abort" to stop at the first bad doc.
+//              it can also be a multipart field.
+//  - charset   charset of the uploaded content, e.g. GBK/GB18030, UTF-8 by default.
+//  - csv/tsv options, they can also be multipart fields:
+//    - delimiter  field delimiter, "," for csv and "\t"(or "tab") for tsv by default
+//    - quote      "strict"(default), "lazy" to allow bad quotes, "none" to treat quotes as normal chars
+//    - comment    lines beginning with the comment character are ignored
+//    - header     "false" if there's no header line, columns must be specified then
+//    - columns    comma separated column names, the header line will be ignored if specified.
+//                 columns with empty name are not indexed
+//    - rename     comma separated column:field pairs to map column names to field names
+//  - record    name of the xml element holding a doc, children of the root element by default.
+//              it can also be a multipart field.
+//  - pipeline  name of the pipeline to process the docs, the pipeline of the schema by default,
+//              "_none" to skip the pipeline of the schema. it can also be a multipart field.
+//  - refresh   how to refresh the index after all the docs are indexed, see IndexDoc.
 // POST Head:
+//   - Content-Encoding: gzip/zstd, optional, the body will be decompressed
 //   - Content-Type: multipart/form-data
 //   arguments:
-//   - file  file name with ext ".json"/".csv" to upload
+//   - file  file name with ext ".json"/".csv"/".tsv"/".jsonl"/".xml"/".zip" to upload.
+//           ".gz"/".zst" can be appended to a compressed file, e.g. ".json.gz".
+//           files in a zip archive are indexed one by one according to their exts.
 //
 // ---- OR ----
 //
@@ -81,14 +115,30 @@ func updateDoc(c *mgin.Context, fnUpdateDoc indexer.FnUpdateDoc, okStr string) {
 //   val1,v2,v3,...
 //
 // ---- OR -----
+//   - Content-Type: text/tab-separated-values
+//   POST body: same as text/csv, delimited by tab
+//
+// ---- OR -----
 //   - Content-Type: application/x-ndjson
 //   POST body:
 //   {json}
 //   {json}
+//
+// ---- OR -----
+//   - Content-Type: application/xml
+//   POST body:
+//   <items>
+//     <item id="1"><name>xxx</name><tag>t1</tag><tag>t2</tag></item>
+//     ...
+//   </items>
+//
+// ---- OR -----
+//   - Content-Type: application/zip
+//   POST body: zip archive of files above
 func IndexDocs(c *mgin.Context) {
 	index := c.Param("index")
 
-	in, contentType, ext, err := getReader(c, "file")
+	in, contentType, ext, compression, err := getReader(c, "file")
 	if err != nil {
 		c.Error(http.StatusNotAcceptable, err.Error())
 		return
@@ -98,7 +148,7 @@ func IndexDocs(c *mgin.Context) {
 	var indexReader indexer.FnIndexReader
 	var ok bool
 	if contentType == MULTIPART_FORM {
-		if indexReader, ok = ext2Indexer[ext]; !ok {
+		if indexReader, ok = indexer.IndexReaderOfExt(ext); !ok {
 			indexReader = indexer.IndexJSON
 		}
 	} else {
@@ -107,17 +157,33 @@ func IndexDocs(c *mgin.Context) {
 		}
 	}
 
+	opts, err := getImportOpts(c)
+	if err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+	opts.Compression = compression
+
 	cb := c.QueryParam("cb")
-	if cb == "" {
-		docIds, err := indexReader(index, in)
-		if err != nil && docIds != nil {
+	_, async := c.QueryParams()["async"]
+	if cb == "" && !async {
+		res, _, err := indexReader(index, in, opts)
+		if err != nil {
 			c.Error(http.StatusInternalServerError, err.Error())
 			return
 		}
-		c.JSON(http.StatusOK, map[string]interface{}{
-			"code": http.StatusOK,
-			"msg": "docs added to index",
-			"ids": docIds,
+		code, msg := http.StatusOK, "docs added to index"
+		if res.Aborted != nil {
+			code, msg = http.StatusBadRequest, res.Aborted.Error()
+		}
+		c.JSON(code, map[string]interface{}{
+			"code": code,
+			"msg": msg,
+			"ids": res.DocIds,
+			"failed": res.Failed,
+			"dropped": res.Dropped,
+			"errors": res.Errors,
+			"errors-truncated": res.ErrorsTruncated,
 		})
 	} else {
 		tmpName, inTmp, err := saveTmpFile(in)
@@ -125,22 +191,26 @@ func IndexDocs(c *mgin.Context) {
 			c.Error(http.StatusInternalServerError, err.Error())
 			return
 		}
-		indexReader(index, inTmp, cb, tmpName)
+		opts.Async, opts.Cb, opts.TmpFile = true, cb, tmpName
+		_, jobId, err := indexReader(index, inTmp, opts)
+		if err != nil {
+			c.Error(http.StatusInternalServerError, err.Error())
+			return
+		}
 		c.JSON(http.StatusOK, map[string]interface{}{
 			"code": http.StatusOK,
 			"msg": "indexing request accepted",
+			"job": jobId,
 		})
 	}
 }
 
-var ext2Indexer = map[string]indexer.FnIndexReader{
-	".csv":   indexer.IndexCSV,
-	".jsonl": indexer.IndexJSONLines,
-	".json":  indexer.IndexJSON,
-}
-
 var contentType2Indexer = map[string]indexer.FnIndexReader{
 	JSON_MIME:      indexer.IndexJSON,
 	CSV_MIME:       indexer.IndexCSV,
+	TSV_MIME:       indexer.IndexTSV,
 	JSONLINES_MIME: indexer.IndexJSONLines,
+	XML_MIME:       indexer.IndexXML,
+	TEXT_XML_MIME:  indexer.IndexXML,
+	ZIP_MIME:       indexer.IndexZip,
 }
@@ -0,0 +1,65 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"net/http"
+)
+
+// GET /jobs[?index=xxx]
+//
+// list all the jobs
+//
+// query arguments:
+//  - index  only list jobs of the index if specified
+func ListJobs(c *mgin.Context) {
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"jobs": indexer.ListJobs(c.QueryParam("index")),
+	})
+}
+
+// GET /jobs/:id
+//
+// show the status of a job
+//
+// path parameter
+//  - id  job id
+func GetJob(c *mgin.Context) {
+	job, err := indexer.GetJob(c.Param("id"))
+	if err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"job": job,
+	})
+}
+
+// DELETE /jobs/:id
+//
+// cancel a running job, or remove the record of a finished job
+//
+// path parameter
+//  - id  job id
+func CancelJob(c *mgin.Context) {
+	job, err := indexer.CancelJob(c.Param("id"))
+	if err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+
+	msg := "job removed"
+	if job.State == indexer.JOB_RUNNING {
+		msg = "job cancelling"
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": msg,
+		"job": job,
+	})
+}
@@ -0,0 +1,133 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"net/http"
+)
+
+// GET /pipelines
+//
+// list all the pipelines
+func ListPipelines(c *mgin.Context) {
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"pipelines": indexer.ListPipelines(),
+	})
+}
+
+// GET /pipeline/:name
+//
+// show a pipeline
+//
+// path parameter
+//  - name  name of pipeline
+func GetPipeline(c *mgin.Context) {
+	p, err := indexer.GetPipeline(c.Param("name"))
+	if err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"pipeline": p,
+	})
+}
+
+// PUT /pipeline/:name
+//
+// create or replace a pipeline
+//
+// path parameter
+//  - name  name of pipeline
+// POST body:
+// {
+//   "description": "xxx",
+//   "processors": [
+//     {"type": "rename", "field": "title", "to": "name"},
+//     {"type": "drop-if", "field": "status", "equals": "deleted"},
+//     ...
+//   ]
+// }
+func SavePipeline(c *mgin.Context) {
+	var p indexer.Pipeline
+	if code, err := c.ReadJSON(&p); err != nil {
+		c.Error(code, err.Error())
+		return
+	}
+	p.Name = c.Param("name")
+	if err := indexer.SavePipeline(&p); err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "pipeline saved",
+		"name": p.Name,
+	})
+}
+
+// DELETE /pipeline/:name
+//
+// delete a pipeline
+//
+// path parameter
+//  - name  name of pipeline
+func DeletePipeline(c *mgin.Context) {
+	if err := indexer.DeletePipeline(c.Param("name")); err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "pipeline deleted",
+	})
+}
+
+// POST /pipeline/_simulate
+//
+// run a pipeline on the docs and show the results without indexing them
+//
+// POST body:
+// {
+//   "name": "saved pipeline name",  // or
+//   "pipeline": {"processors": [...]},
+//   "docs": [{doc1}, {doc2}, ...]
+// }
+func SimulatePipeline(c *mgin.Context) {
+	var req struct {
+		Name     string                   `json:"name"`
+		Pipeline *indexer.Pipeline        `json:"pipeline"`
+		Docs     []map[string]interface{} `json:"docs"`
+	}
+	if code, err := c.ReadJSON(&req); err != nil {
+		c.Error(code, err.Error())
+		return
+	}
+
+	p := req.Pipeline
+	if req.Name != "" {
+		var err error
+		if p, err = indexer.GetPipeline(req.Name); err != nil {
+			c.Error(http.StatusNotFound, err.Error())
+			return
+		}
+	}
+	if p == nil {
+		c.Error(http.StatusBadRequest, "name or pipeline expected")
+		return
+	}
+
+	res, err := indexer.SimulatePipeline(p, req.Docs)
+	if err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"docs": res,
+	})
+}
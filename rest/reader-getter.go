@@ -2,13 +2,15 @@ package rest
 
 import (
 	"github.com/rosbit/mgin"
+	"go-search/indexer"
 	"io"
 	"fmt"
-	"path"
 	"strings"
 )
 
-func getReader(c *mgin.Context, multipartFileParam string) (in io.ReadCloser, contentType, ext string, err error) {
+// 获取上传的内容。multipart上传时ext是上传文件的扩展名。
+// compression是内容的压缩方式，由请求头Content-Encoding或上传文件的扩展名(如".json.gz")确定
+func getReader(c *mgin.Context, multipartFileParam string) (in io.ReadCloser, contentType, ext, compression string, err error) {
 	ct := strings.FieldsFunc(c.Header(HEADER_CONTENT_TYPE), func(ch rune)bool{
 		return ch == ' ' || ch == ';'
 	})
@@ -16,11 +18,30 @@ func getReader(c *mgin.Context, multipartFileParam string) (in io.ReadCloser, co
 		contentType = ct[0]
 	}
 
+	encoding, e := indexer.ParseCompression(c.Header(HEADER_CONTENT_ENCODING))
+	if e != nil {
+		err = e
+		return
+	}
+
+	r := c.Request()
+	if r.Body == nil {
+		err = fmt.Errorf("post body expected")
+		return
+	}
+
 	switch contentType {
 	case MULTIPART_FORM:
+		if encoding != "" {
+			// 整个multipart请求体是压缩的，需要先解压才能解析表单
+			if r.Body, err = indexer.Decompress(r.Body, encoding); err != nil {
+				return
+			}
+		}
 		file, e := c.FormFile(multipartFileParam)
 		if e != nil {
 			err = fmt.Errorf("argument %s expected", multipartFileParam)
+			return
 		}
 		fp, e := file.Open()
 		if e != nil {
@@ -28,14 +49,23 @@ func getReader(c *mgin.Context, multipartFileParam string) (in io.ReadCloser, co
 			return
 		}
 		in = fp
-		ext = strings.ToLower(path.Ext(file.Filename))
+		ext, compression = indexer.SplitCompressedExt(file.Filename)
 	default:
-		r := c.Request()
-		if r.Body == nil {
-			err = fmt.Errorf("post body expected")
-			return
-		}
 		in = r.Body
+		compression = encoding
 	}
 	return
 }
+
+// 获取query参数，如果没有，再从multipart表单中获取
+func getParam(c *mgin.Context, name string) string {
+	if v := c.QueryParam(name); v != "" {
+		return v
+	}
+	if r := c.Request(); r.MultipartForm != nil {
+		if vs, ok := r.MultipartForm.Value[name]; ok && len(vs) > 0 {
+			return vs[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"net/http"
+)
+
+// POST /reindex
+//
+// copy the documents of the source index to the dest index in background, a job id will be returned.
+// the schema of the dest index must be created first.
+//
+// POST body:
+// {
+//   "source": "source-index",
+//   "dest": "dest-index",
+//   "q": "", "fq": "", "f": "",      // optional, only the matched docs are copied, same as /search/:index
+//   "rename": {"old-field": "new-field", ...}, // optional, fields to rename before the pipeline
+//   "pipeline": "",                  // optional, the pipeline of the dest schema by default, "_none" to skip it
+//   "docs-per-second": 0,            // optional, max docs copied per second, 0 for no limit
+//   "on-error": "skip"|"abort",      // optional, "skip" by default
+//   "cb": "",                        // optional, callback url when the job is done
+//   "refresh": ""                    // optional, how to refresh the dest index after all the docs are copied
+// }
+func Reindex(c *mgin.Context) {
+	var opts indexer.ReindexOpts
+	if code, err := c.ReadJSON(&opts); err != nil {
+		c.Error(code, err.Error())
+		return
+	}
+	if err := indexer.CheckReindexOpts(&opts); err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+	if opts.Pipeline != "" && opts.Pipeline != indexer.PIPELINE_NONE {
+		if _, err := indexer.GetPipeline(opts.Pipeline); err != nil {
+			c.Error(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	jobId, err := indexer.Reindex(&opts)
+	if err != nil {
+		c.Error(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "reindex request accepted",
+		"job": jobId,
+	})
+}
@@ -33,7 +33,13 @@ func CreateSchema(c *mgin.Context) {
 		return
 	}
 
-	jsonFile, _, _, err := getReader(c, "file")
+	in, _, _, compression, err := getReader(c, "file")
+	if err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+	defer in.Close()
+	jsonFile, err := indexer.Decompress(in, compression)
 	if err != nil {
 		c.Error(http.StatusBadRequest, err.Error())
 		return
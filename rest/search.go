@@ -16,6 +16,7 @@ import (
 //
 // query arguments:
 //  q:  查询条件，+xxx:必出现、-xxx"必不出现、xxx:可以出现
+//      "xx yy"是短语，"xx yy"~N允许词移动N个位置；iph*、te?m*是通配符，扩展出的词过多时返回400
 //  fq: 指定字段的q，格式为"字段名:q"，多个fq间用','或';'分割，如fq=name:rosbit;age:10
 //  s:  排序字段，格式为"字段名[:desc|asc]"，多个s间用','或';'分割，如s=name;age:asc
 //  f:  过滤，支持区间，格式为"字段名:val1,val2,min~max"，min/max可以只出现一个，多个f间用';'分割，如s=name:rosbit,bitros;age:10,16~20,~8,30~
@@ -23,6 +24,9 @@ import (
 //  pagesize: 每页条数，最大100
 //  fl: 输出字段列表，多个字段名用','分割
 //  pretty: 是否美化输出结果，如果没有该参数，则紧凑输出
+//  defType: 为"lucene"时q是Lucene风格的查询串，如q=title:"red shoes" AND (brand:nike OR brand:adidas) -status:sold price:[10 TO 50]，
+//           这时fq不起作用，没有s时按满足的子句的权重(^boost)之和排序
+//  q.op: defType为lucene时，没有操作符的子句之间的关系: OR(缺省)或AND
 //
 // 返回结果:
 // {
@@ -44,6 +48,8 @@ import (
 // }
 //
 // 注意: ';'必须进行url编码，net/url中';'和'&'的作用是一样的。
+// defType为lucene时，查询串有语法错误返回400，pos为出错的位置(从1开始的字符序号):
+// {"code": 400, "msg": "syntax error at position 5: unexpected \")\"", "pos": 5}
 func Search(c *mgin.Context) {
 	log.Printf("[query] %s\n", c.Request().RequestURI)
 	index := c.Param("index")
@@ -57,9 +63,91 @@ func Search(c *mgin.Context) {
 	fl := c.QueryParam("fl")
 	_, pretty := c.QueryParams()["pretty"]
 
-	pagination, timeout, docs, err := indexer.Query(index, q, fq, s, f, page, pagesize, fl)
+	var pagination interface{}
+	var timeout bool
+	var docs <-chan interface{}
+	var err error
+	switch defType := c.QueryParam("defType"); defType {
+	case "":
+		pagination, timeout, docs, err = indexer.Query(index, q, fq, s, f, page, pagesize, fl)
+	case indexer.DEF_TYPE_LUCENE:
+		pagination, timeout, docs, err = indexer.QueryLucene(index, q, c.QueryParam("q.op"), s, f, page, pagesize, fl)
+	default:
+		c.Error(http.StatusBadRequest, fmt.Sprintf("unknown defType %s", defType))
+		return
+	}
 	if err != nil {
-		c.Error(http.StatusInternalServerError, err.Error())
+		switch e := err.(type) {
+		case *indexer.QuerySyntaxError:
+			c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"code": http.StatusBadRequest,
+				"msg": e.Error(),
+				"pos": e.Pos,
+			})
+		case *indexer.BadQueryError:
+			c.Error(http.StatusBadRequest, e.Error())
+		default:
+			c.Error(http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	w := c.Response()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if !pretty {
+		outputJSONDocByDoc(w, pagination, timeout, docs)
+	} else {
+		prettyOutputJSONDocByDoc(w, pagination, timeout, docs)
+	}
+}
+
+// POST /search/:index[?pretty]
+//
+// 用JSON请求体进行搜索，可以嵌套bool子句，不需要对';'等进行url编码
+//
+// POST body:
+// {
+//   "query": {
+//     "bool": {
+//       "must": [{"match": {"name": "rosbit"}}],
+//       "should": [{"term": {"brand": "A"}}, {"term": {"brand": "B"}}],
+//       "must_not": [{"bool": {"filter": [{"term": {"status": "deleted"}}, {"range": {"age": {"gt": 3}}}]}}],
+//       "filter": [{"exists": {"field": "price"}}, {"prefix": {"code": "CN"}}]
+//     }
+//   },
+//   "s": "age:asc",
+//   "page": 1,
+//   "pagesize": 20,
+//   "fl": "id,name"
+// }
+//  query: 查询子句，为空时查询全部doc，子句有:
+//    bool:   {"must": [子句], "should": [子句], "must_not": [子句], "filter": [子句], "minimum_should_match": n}
+//            只有should时至少要满足一个，must和filter相同
+//    term:   {"字段名": 值}，与f参数的一个值相同
+//    terms:  {"字段名": [值1, 值2]}，满足一个即可
+//    match:  {"字段名": "文本"}或{"字段名": {"query": "文本", "operator": "and|or"}}，按字段的分词器分词，缺省出现一个词即可
+//    range:  {"字段名": {"gt|gte": 最小值, "lt|lte": 最大值}}
+//    exists: {"field": "字段名"}
+//    prefix: {"字段名": "前缀"}，字段值或者分词后的一个词以前缀开头
+//  s, page, pagesize, fl: 同GET /search/:index
+//
+// 返回结果同GET /search/:index，查询子句有错误时返回400
+func SearchDSL(c *mgin.Context) {
+	var body indexer.SearchBody
+	if code, err := c.ReadJSON(&body); err != nil {
+		c.Error(code, err.Error())
+		return
+	}
+	_, pretty := c.QueryParams()["pretty"]
+
+	pagination, timeout, docs, err := indexer.QueryDSL(c.Param("index"), &body)
+	if err != nil {
+		if _, ok := err.(*indexer.BadQueryError); ok {
+			c.Error(http.StatusBadRequest, err.Error())
+		} else {
+			c.Error(http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
@@ -0,0 +1,114 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"net/http"
+)
+
+// POST /snapshot/:index[?name=snapshot-name]
+//
+// create a snapshot of an index in the snapshot repository
+//
+// path parameter
+//  - index  name of index
+// query arguments:
+//  - name   name of the snapshot, the current time "YYYYMMDD-HHMMSS" by default
+func CreateSnapshot(c *mgin.Context) {
+	info, err := indexer.CreateSnapshot(c.Param("index"), c.QueryParam("name"))
+	if err != nil {
+		c.Error(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "snapshot created",
+		"snapshot": info,
+	})
+}
+
+// GET /snapshots[?index=index-name]
+//
+// list the snapshots
+//
+// query arguments:
+//  - index  only list the snapshots of the index
+func ListSnapshots(c *mgin.Context) {
+	snapshots, err := indexer.ListSnapshots(c.QueryParam("index"))
+	if err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"snapshots": snapshots,
+	})
+}
+
+// GET /snapshot/:index/:name
+//
+// show a snapshot
+//
+// path parameter
+//  - index  name of index
+//  - name   name of snapshot
+func GetSnapshot(c *mgin.Context) {
+	info, err := indexer.GetSnapshot(c.Param("index"), c.Param("name"))
+	if err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"snapshot": info,
+	})
+}
+
+// DELETE /snapshot/:index/:name
+//
+// delete a snapshot
+//
+// path parameter
+//  - index  name of index
+//  - name   name of snapshot
+func DeleteSnapshot(c *mgin.Context) {
+	if err := indexer.DeleteSnapshot(c.Param("index"), c.Param("name")); err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "snapshot deleted",
+	})
+}
+
+// POST /snapshot/:index/:name/_restore[?to=index-name][&overwrite]
+//
+// restore an index from a snapshot
+//
+// path parameter
+//  - index  name of index
+//  - name   name of snapshot
+// query arguments:
+//  - to         name of the index to restore to, the original index by default
+//  - overwrite  replace the index if it exists
+func RestoreSnapshot(c *mgin.Context) {
+	_, overwrite := c.QueryParams()["overwrite"]
+	to := c.QueryParam("to")
+	info, err := indexer.RestoreSnapshot(c.Param("index"), c.Param("name"), to, overwrite)
+	if err != nil {
+		c.Error(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if to == "" {
+		to = info.Index
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "snapshot restored",
+		"index": to,
+		"snapshot": info,
+	})
+}
@@ -0,0 +1,118 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"net/http"
+)
+
+// GET /sources/:index
+//
+// list all the http sources of an index
+//
+// path parameter
+//  - index  name of index
+func ListSources(c *mgin.Context) {
+	sources, err := indexer.ListSources(c.Param("index"))
+	if err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"sources": sources,
+	})
+}
+
+// GET /sources/:index/:id
+//
+// show a source and its last-run status
+//
+// path parameter
+//  - index  name of index
+//  - id     source id
+func GetSource(c *mgin.Context) {
+	src, err := indexer.GetSource(c.Param("index"), c.Param("id"))
+	if err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"source": src,
+	})
+}
+
+// PUT /sources/:index/:id
+//
+// create or replace a source
+//
+// path parameter
+//  - index  name of index
+//  - id     source id
+// POST body:
+// {
+//   "url": "http://host/export",
+//   "format": "jsonl",
+//   "every": "10m",
+//   "headers": {"Authorization": "Bearer xxx"},
+//   "params": {"since": "{{watermark}}"},
+//   "watermark-field": "updated_at"
+// }
+func SaveSource(c *mgin.Context) {
+	var src indexer.Source
+	if code, err := c.ReadJSON(&src); err != nil {
+		c.Error(code, err.Error())
+		return
+	}
+	src.Id = c.Param("id")
+	if err := indexer.SaveSource(c.Param("index"), &src); err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "source saved",
+		"id": src.Id,
+	})
+}
+
+// DELETE /sources/:index/:id
+//
+// delete a source, the running import is not affected
+//
+// path parameter
+//  - index  name of index
+//  - id     source id
+func DeleteSource(c *mgin.Context) {
+	if err := indexer.DeleteSource(c.Param("index"), c.Param("id")); err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "source deleted",
+	})
+}
+
+// POST /sources/:index/:id/run
+//
+// fetch a source immediately
+//
+// path parameter
+//  - index  name of index
+//  - id     source id
+func RunSource(c *mgin.Context) {
+	jobId, err := indexer.RunSource(c.Param("index"), c.Param("id"))
+	if err != nil {
+		c.Error(http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "source is running",
+		"job": jobId,
+	})
+}
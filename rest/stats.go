@@ -0,0 +1,31 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"go-search/conf"
+	"net/http"
+	"strconv"
+)
+
+// GET /stats
+//
+// show the indexing queues of the loaded indexes
+func Stats(c *mgin.Context) {
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"workers": conf.ServiceConf.WorkerNum,
+		"queues": indexer.GetQueueStats(),
+	})
+}
+
+// 更新队列满时返回429和Retry-After，其它错误返回500
+func indexingError(c *mgin.Context, err error) {
+	if e, ok := err.(*indexer.QueueFullError); ok {
+		c.SetHeader(HEADER_RETRY_AFTER, strconv.Itoa(e.RetryAfter))
+		c.Error(http.StatusTooManyRequests, e.Error())
+		return
+	}
+	c.Error(http.StatusInternalServerError, err.Error())
+}
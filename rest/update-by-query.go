@@ -0,0 +1,42 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"net/http"
+)
+
+// POST /update-by-query/:index?q=xxx&fq=xxx&f=xxx
+//
+// update all the documents matching the query. q, fq, f are same as those of /search/:index.
+//
+// POST body:
+// {
+//   "doc": {"field-name": "new-value", ...},  // fields to overwrite
+//   "unset": ["field-name", ...],             // fields to remove
+//   "inc": {"field-name": 1, ...}             // number fields to increase
+// }
+func UpdateByQuery(c *mgin.Context) {
+	index := c.Param("index")
+
+	var ops indexer.UpdateOps
+	if code, err := c.ReadJSON(&ops); err != nil {
+		c.Error(code, err.Error())
+		return
+	}
+
+	res, err := indexer.UpdateByQuery(index, c.QueryParam("q"), c.QueryParam("fq"), c.QueryParam("f"), &ops)
+	if err != nil {
+		c.Error(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "docs updated",
+		"matched": res.Matched,
+		"updated": res.Updated,
+		"failed": res.Failed,
+		"failures": res.Failures,
+	})
+}
@@ -0,0 +1,137 @@
+package rest
+
+import (
+	"github.com/rosbit/mgin"
+	"go-search/indexer"
+	"net/http"
+)
+
+// GET /webhooks/:index
+//
+// list all the webhooks of an index with their delivery status
+//
+// path parameter
+//  - index  name of index
+func ListWebhooks(c *mgin.Context) {
+	hooks, err := indexer.ListWebhooks(c.Param("index"))
+	if err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"webhooks": hooks,
+	})
+}
+
+// GET /webhooks/:index/:id
+//
+// show a webhook and its delivery status
+//
+// path parameter
+//  - index  name of index
+//  - id     webhook id
+func GetWebhook(c *mgin.Context) {
+	hook, err := indexer.GetWebhook(c.Param("index"), c.Param("id"))
+	if err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"webhook": hook,
+	})
+}
+
+// PUT /webhooks/:index/:id
+//
+// create or replace a webhook, the changes after that are POSTed to the url in batches.
+//
+// path parameter
+//  - index  name of index
+//  - id     webhook id
+// PUT body:
+// {
+//   "url": "http://host/invalidate",
+//   "ops": ["index", "update", "delete"],
+//   "f": "brand:apple",
+//   "doc": false,
+//   "batch-size": 100,
+//   "headers": {"Authorization": "Bearer xxx"}
+// }
+func SaveWebhook(c *mgin.Context) {
+	var hook indexer.Webhook
+	if code, err := c.ReadJSON(&hook); err != nil {
+		c.Error(code, err.Error())
+		return
+	}
+	hook.Id = c.Param("id")
+	if err := indexer.SaveWebhook(c.Param("index"), &hook); err != nil {
+		c.Error(http.StatusBadRequest, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "webhook saved",
+		"id": hook.Id,
+	})
+}
+
+// DELETE /webhooks/:index/:id
+//
+// delete a webhook and its dead letters
+//
+// path parameter
+//  - index  name of index
+//  - id     webhook id
+func DeleteWebhook(c *mgin.Context) {
+	if err := indexer.DeleteWebhook(c.Param("index"), c.Param("id")); err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "webhook deleted",
+	})
+}
+
+// GET /webhooks/:index/:id/dead-letters
+//
+// list the batches failed to deliver after all the retries, and the changes lost
+// because of delivering too slowly
+//
+// path parameter
+//  - index  name of index
+//  - id     webhook id
+func ListDeadLetters(c *mgin.Context) {
+	letters, err := indexer.ListDeadLetters(c.Param("index"), c.Param("id"))
+	if err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "OK",
+		"dead-letters": letters,
+	})
+}
+
+// DELETE /webhooks/:index/:id/dead-letters
+//
+// clear the dead letters of a webhook
+//
+// path parameter
+//  - index  name of index
+//  - id     webhook id
+func ClearDeadLetters(c *mgin.Context) {
+	if err := indexer.ClearDeadLetters(c.Param("index"), c.Param("id")); err != nil {
+		c.Error(http.StatusNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code": http.StatusOK,
+		"msg": "dead letters cleared",
+	})
+}
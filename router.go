@@ -27,12 +27,44 @@ func StartService() error {
 	api.POST("/schema/:index",   rest.CreateSchema)
 	api.DELETE("/schema/:index", rest.DeleteSchema)
 	api.PUT("/schema/:index/:newIndex", rest.RenameSchema)
+	api.GET("/doc/:index/:id",   rest.GetDoc)
+	api.POST("/mget/:index",     rest.MultiGetDocs)
 	api.PUT("/doc/:index",       rest.IndexDoc)
 	api.PUT("/docs/:index",      rest.IndexDocs)
 	api.PUT("/update/:index",    rest.UpdateDoc)
+	api.POST("/update-by-query/:index", rest.UpdateByQuery)
+	api.POST("/reindex",          rest.Reindex)
 	api.DELETE("/doc/:index",    rest.DeleteDoc)
 	api.DELETE("/docs/:index",   rest.DeleteDocs)
 	api.GET("/search/:index",    rest.Search)
+	api.POST("/search/:index",   rest.SearchDSL)
+	api.GET("/export/:index",    rest.Export)
+	api.GET("/changes/:index",   rest.Changes)
+	api.GET("/jobs",             rest.ListJobs)
+	api.GET("/jobs/:id",         rest.GetJob)
+	api.DELETE("/jobs/:id",      rest.CancelJob)
+	api.GET("/sources/:index",   rest.ListSources)
+	api.GET("/sources/:index/:id",    rest.GetSource)
+	api.PUT("/sources/:index/:id",    rest.SaveSource)
+	api.DELETE("/sources/:index/:id", rest.DeleteSource)
+	api.POST("/sources/:index/:id/run", rest.RunSource)
+	api.GET("/webhooks/:index",   rest.ListWebhooks)
+	api.GET("/webhooks/:index/:id",    rest.GetWebhook)
+	api.PUT("/webhooks/:index/:id",    rest.SaveWebhook)
+	api.DELETE("/webhooks/:index/:id", rest.DeleteWebhook)
+	api.GET("/webhooks/:index/:id/dead-letters",    rest.ListDeadLetters)
+	api.DELETE("/webhooks/:index/:id/dead-letters", rest.ClearDeadLetters)
+	api.GET("/snapshots",        rest.ListSnapshots)
+	api.POST("/snapshot/:index", rest.CreateSnapshot)
+	api.GET("/snapshot/:index/:name",    rest.GetSnapshot)
+	api.DELETE("/snapshot/:index/:name", rest.DeleteSnapshot)
+	api.POST("/snapshot/:index/:name/_restore", rest.RestoreSnapshot)
+	api.GET("/stats",            rest.Stats)
+	api.GET("/pipelines",        rest.ListPipelines)
+	api.POST("/pipeline/_simulate", rest.SimulatePipeline)
+	api.GET("/pipeline/:name",    rest.GetPipeline)
+	api.PUT("/pipeline/:name",    rest.SavePipeline)
+	api.DELETE("/pipeline/:name", rest.DeletePipeline)
 
 	// health check
 	api.GET("/health", func(c *mgin.Context) {